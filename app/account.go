@@ -0,0 +1,390 @@
+package complaints
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/taskqueue"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/mailer"
+	"github.com/skypies/complaints/rbac"
+	"github.com/skypies/complaints/sessions"
+)
+
+// Users can take everything we have on them away with them, as a zip file, and can delete
+// their account. Deletion happens after a grace period, so they can change their minds (or
+// notice that someone else asked); see complaintdb/accounts.go for what gets deleted.
+
+const (
+	kAccountDeletionGrace = 14 * 24 * time.Hour
+	kAccountDeletionBatch = 200
+	kAccountTimeBudget = 45 * time.Second
+)
+
+func init() {
+	http.HandleFunc("/account", sessions.ProtectCSRF(accountHandler))
+	http.HandleFunc("/account/export", accountExportHandler)
+	http.HandleFunc("/admin/deletions", rbac.Require(deletionsHandler, complaintdb.RoleAdmin))
+	http.HandleFunc("/task/account-deletions", accountDeletionsTaskHandler)
+	http.HandleFunc("/task/delete-account", deleteAccountTaskHandler)
+}
+
+// {{{ accountHandler
+
+// GET shows the page; POST with action=delete (confirm, which must be the email address)
+// schedules the account for deletion, and action=cancel unschedules it.
+func accountHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	session := sessions.Get(r)
+	if session.Values["email"] == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	email := session.Values["email"].(string)
+	if !masqCheck(w, r, r.Method == "POST") { return }
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	message := r.FormValue("msg")
+
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "delete":
+			if !strings.EqualFold(strings.TrimSpace(r.FormValue("confirm")), email) {
+				message = "To delete your account, type in your email address"
+				break
+			}
+			d,err := cdb.RequestAccountDeletion(email, kAccountDeletionGrace)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			c.Infof("account: <%s> asked for deletion, due %s", email, d.Due)
+			sendAccountDeletionEmail(c, *d)
+			http.Redirect(w, r, "/account?msg="+url.QueryEscape("Your account will be deleted"),
+				http.StatusFound)
+			return
+
+		case "cancel":
+			if err := cdb.CancelAccountDeletion(email); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			c.Infof("account: <%s> cancelled deletion", email)
+			http.Redirect(w, r, "/account?msg="+url.QueryEscape("Your account will not be deleted"),
+				http.StatusFound)
+			return
+		}
+	}
+
+	d,err := cdb.GetAccountDeletion(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	params := map[string]interface{}{
+		"Email": email,
+		"Deletion": d,
+		"GraceDays": int(kAccountDeletionGrace.Hours() / 24),
+		"Message": message,
+		"CSRFToken": sessions.CSRFToken(r, w),
+	}
+	if err := templates.ExecuteTemplate(w, "account", params); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// }}}
+// {{{ sendAccountDeletionEmail
+
+// So that they find out if it wasn't them that asked.
+func sendAccountDeletionEmail(c appengine.Context, d complaintdb.AccountDeletion) {
+	msg := &mailer.Message{
+		Sender:  kSenderEmail,
+		To:      []string{d.EmailAddress},
+		Subject: "Your stop.jetnoise.net account will be deleted",
+	}
+	params := map[string]interface{}{
+		"Due": d.Due,
+		"URL": siteURL() + "/account",
+	}
+	if err := renderEmail(msg, "email-account-deletion", params); err != nil {
+		c.Errorf("account: renderEmail: %v", err)
+	} else if err := mailer.New(c).Send(msg); err != nil {
+		c.Errorf("account: send to <%s>: %v", d.EmailAddress, err)
+	}
+}
+
+// }}}
+
+// {{{ accountExportHandler
+
+// A zip file of everything: the profile, all the complaints (with their submission receipts,
+// which also get a CSV file of their own), and the tokens, buttons, webhooks and sessions
+// (but not their secrets). If it runs out of time, the complaints stop short, and there's a
+// note saying how to fetch the rest.
+func accountExportHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	deadline := time.Now().Add(kAccountTimeBudget)
+	session := sessions.Get(r)
+	if session.Values["email"] == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	email := session.Values["email"].(string)
+	if !masqCheck(w, r, false) { return }
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	cp,err := cdb.GetProfileByEmailAddress(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	account,err := accountRecords(cdb, email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("jetnoise-account-%s.zip", time.Now().Format("20060102"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+
+	// From here on, the status has gone out; errors can only be logged.
+	z := zip.NewWriter(w)
+	defer z.Close()
+
+	writeJSON := func(name string, v interface{}) {
+		f,err := z.Create(name)
+		if err != nil {
+			c.Errorf("account export <%s>: %s: %v", email, name, err)
+			return
+		}
+		b,_ := json.MarshalIndent(v, "", "  ")
+		f.Write(b)
+	}
+	writeJSON("profile.json", cp)
+	writeJSON("account.json", account)
+
+	f,err := z.Create("complaints.ndjson")
+	if err != nil {
+		c.Errorf("account export <%s>: %v", email, err)
+		return
+	}
+	enc := json.NewEncoder(f)
+	receipts := [][]string{{"complaint", "complaint_time", "airport", "submitted"}}
+
+	// The same query as /export-complaints makes, so its cursors work there too
+	start,end := time.Unix(0,0), time.Now().Add(time.Hour)
+	iter := cdb.NewIter(cdb.QueryInSpanByEmailAddress(start, end, email))
+	n,next := 0,""
+	for {
+		if n > 0 && n % kExportCheckpoint == 0 && time.Now().After(deadline) {
+			if cur,err := iter.Iter.Cursor(); err == nil { next = cur.String() }
+			break
+		}
+		comp,err := iter.NextWithErr()
+		if err != nil {
+			c.Errorf("account export <%s>: after %d: %v", email, n, err)
+			if cur,err := iter.Iter.Cursor(); err == nil { next = cur.String() }
+			break
+		} else if comp == nil {
+			break
+		}
+		enc.Encode(exportComplaint{Complaint: *comp})
+		for _,s := range comp.Submissions {
+			receipts = append(receipts, []string{comp.DatastoreKey,
+				comp.Timestamp.Format(time.RFC3339), s.Airport, s.T.Format(time.RFC3339)})
+		}
+		n++
+	}
+
+	if f,err := z.Create("submissions.csv"); err == nil {
+		csv.NewWriter(f).WriteAll(receipts)
+	}
+	if next != "" {
+		if f,err := z.Create("INCOMPLETE.txt"); err == nil {
+			fmt.Fprintf(f, "There were too many complaints to fit in one go; this file has the "+
+				"first %d.\nFor the rest, go to:\n\n  %s/export-complaints?start=%d&end=%d&cursor=%s\n",
+				n, siteURL(), start.Unix(), end.Unix(), url.QueryEscape(next))
+		}
+	}
+	c.Infof("account export <%s>: %d complaints, next=%q", email, n, next)
+}
+
+// }}}
+// {{{ accountRecords
+
+// Everything that isn't the profile or a complaint; secrets are left out.
+func accountRecords(cdb complaintdb.ComplaintDB, email string) (map[string]interface{}, error) {
+	tokens,err := cdb.GetAccessTokens(email)
+	if err != nil { return nil, err }
+	devices,err := cdb.GetButtonDevices(email)
+	if err != nil { return nil, err }
+	hooks,err := cdb.GetWebhooks(email)
+	if err != nil { return nil, err }
+	sess,err := cdb.GetSessionsByEmailAddress(email)
+	if err != nil { return nil, err }
+
+	ret := map[string]interface{}{}
+	list := []map[string]interface{}{}
+	for _,t := range tokens {
+		list = append(list, map[string]interface{}{"Name": t.Name, "Hint": t.Hint,
+			"Scopes": t.Scopes, "Created": t.Created, "LastUsed": t.LastUsed})
+	}
+	ret["AccessTokens"] = list
+
+	list = []map[string]interface{}{}
+	for _,d := range devices {
+		list = append(list, map[string]interface{}{"ID": d.ID, "Name": d.Name,
+			"Created": d.Created, "LastUsed": d.LastUsed})
+	}
+	ret["Buttons"] = list
+
+	list = []map[string]interface{}{}
+	for _,h := range hooks {
+		list = append(list, map[string]interface{}{"URL": h.URL, "Events": h.Events,
+			"Created": h.Created})
+	}
+	ret["Webhooks"] = list
+
+	list = []map[string]interface{}{}
+	for _,s := range sess {
+		list = append(list, map[string]interface{}{"UserAgent": s.UserAgent, "IP": s.IP,
+			"Created": s.Created, "LastSeen": s.LastSeen})
+	}
+	ret["Sessions"] = list
+
+	return ret, nil
+}
+
+// }}}
+
+// {{{ accountDeletionsTaskHandler
+
+// Run by cron: starts off the deletions whose grace period is over.
+func accountDeletionsTaskHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	ds,err := cdb.GetDueAccountDeletions(time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _,d := range ds {
+		if err := enqueueAccountDeletion(c, d.EmailAddress); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Write([]byte(fmt.Sprintf("OK, %d due\n", len(ds))))
+}
+
+func enqueueAccountDeletion(c appengine.Context, email string) error {
+	t := taskqueue.NewPOSTTask("/task/delete-account", map[string][]string{"user": {email}})
+	_,err := taskqueue.Add(c, t, "")
+	return err
+}
+
+// }}}
+// {{{ deleteAccountTaskHandler
+
+// Anonymizes complaints in batches until it runs low on time, then queues itself up to carry
+// on; once they're all done, it deletes the rest of the account. Every step is safe to rerun.
+func deleteAccountTaskHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.Timeout(appengine.NewContext(r), 60*time.Second)
+	cdb := complaintdb.ComplaintDB{C: c}
+	email := r.FormValue("user")
+	deadline := time.Now().Add(kAccountTimeBudget)
+
+	d,err := cdb.GetAccountDeletion(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if d == nil || d.IsDone() || time.Now().Before(d.Due) {
+		w.Write([]byte("OK, nothing to do\n")) // e.g. it was cancelled
+		return
+	}
+
+	for {
+		n,err := cdb.AnonymizeComplaints(email, d.AnonymousID, kAccountDeletionBatch)
+		if err != nil {
+			c.Errorf("delete-account <%s>: %v", email, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		d.Anonymized += n
+		if n == 0 { break }
+
+		if time.Now().After(deadline) {
+			if err := cdb.PutAccountDeletion(*d); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			} else if err := enqueueAccountDeletion(c, email); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			c.Infof("delete-account <%s>: %d complaints anonymized so far", email, d.Anonymized)
+			w.Write([]byte("OK, more to do\n"))
+			return
+		}
+	}
+
+	n,err := cdb.DeleteAccountRecords(email)
+	if err != nil {
+		c.Errorf("delete-account <%s>: %v", email, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.Deleted = n
+	d.Done = time.Now()
+	d.AnonymousID = ""
+	if err := cdb.PutAccountDeletion(*d); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.Infof("delete-account <%s>: done; %d complaints anonymized, %d records deleted", email,
+		d.Anonymized, d.Deleted)
+	w.Write([]byte("OK, done\n"))
+}
+
+// }}}
+// {{{ deletionsHandler
+
+// The admin report: pending deletions, and the ones that are done.
+func deletionsHandler(w http.ResponseWriter, r *http.Request) {
+	cdb := complaintdb.ComplaintDB{C: appengine.NewContext(r)}
+
+	ds,err := cdb.GetAccountDeletions()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	params := map[string]interface{}{
+		"Deletions": ds,
+		"Message": r.FormValue("msg"),
+	}
+	if err := templates.ExecuteTemplate(w, "deletions", params); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -39,10 +39,10 @@ var (
 
 func init() {
 	http.HandleFunc("/button", buttonHandler)
-	http.HandleFunc("/add-complaint", addComplaintHandler)
-	http.HandleFunc("/add-historical-complaint", addHistoricalComplaintHandler)
-	http.HandleFunc("/update-complaint", updateComplaintHandler)
-	http.HandleFunc("/delete-complaints", deleteComplaintsHandler)
+	http.HandleFunc("/add-complaint", sessions.RequireCSRF(addComplaintHandler))
+	http.HandleFunc("/add-historical-complaint", sessions.RequireCSRF(addHistoricalComplaintHandler))
+	http.HandleFunc("/update-complaint", sessions.RequireCSRF(updateComplaintHandler))
+	http.HandleFunc("/delete-complaints", sessions.RequireCSRF(deleteComplaintsHandler))
 	http.HandleFunc("/complaint-updateform", complaintUpdateFormHandler)
 }
 
@@ -57,6 +57,7 @@ func form2Complaint(r *http.Request) types.Complaint {
 		HeardSpeedbreaks: FormValueCheckbox(r, "speedbrakes"),
 		Loudness:  int(FormValueInt64(r, "loudness")),
 		Activity:  r.FormValue("activity"),
+		DoNotSubmit: FormValueCheckbox(r, "donotsubmit"),
 	}
 
 	// This field is set during updates (it identifies a complaint to update)
@@ -79,7 +80,16 @@ func form2Complaint(r *http.Request) types.Complaint {
 
 // {{{ buttonHandler
 
+// Hardware buttons should send signed requests (see buttons.go). /button with an
+// "Authorization: Bearer" header makes a complaint for the token's owner; the token needs the
+// complain scope. The old /button?c=CALLERCODE still works for buttons already out there, but
+// not for anyone who has set up a token or a signed button, since caller codes are guessable.
 func buttonHandler(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("d") != "" {
+		signedButtonHandler(w, r)
+		return
+	}
+
 	c := appengine.NewContext(r)
 	cdb := complaintdb.ComplaintDB{C: c}
 	resp := "OK"
@@ -88,14 +98,55 @@ func buttonHandler(w http.ResponseWriter, r *http.Request) {
 	complaint := types.Complaint{
 		Timestamp:   time.Now(), // No point setting a timezone, it gets reset to UTC
 	}
+
+	if requestToken(r) != "" {
+		email,status := tokenUser(c, r, complaintdb.ScopeComplain)
+		if status != http.StatusOK {
+			http.Error(w, "bad token", status)
+			return
+		}
+		if err := cdb.ComplainByEmailAddress(email, &complaint); err != nil {
+			resp = fmt.Sprintf("fail: %s\n", err)
+		}
+		w.Write([]byte(fmt.Sprintf("%s\n", resp)))
+		return
+	}
 	
-	if err := cdb.ComplainByCallerCode(cc, &complaint); err != nil {
+	if cp,err := cdb.GetProfileByCallerCode(cc); err != nil {
+		resp = fmt.Sprintf("fail for %s: %s\n", cc, err)
+	} else if cp == nil {
+		// No such caller code; nothing to do, as ever
+	} else if ok,err := callerCodeAllowed(cdb, cp.EmailAddress); err != nil {
 		resp = fmt.Sprintf("fail for %s: %s\n", cc, err)
+	} else if !ok {
+		c.Infof("button: refused caller code for <%s>, who has tokens or buttons", cp.EmailAddress)
+		http.Error(w, "caller codes are turned off for this account; use a token", http.StatusForbidden)
+		return
+	} else {
+		c.Warningf("button: deprecated caller code used for <%s>", cp.EmailAddress)
+		if err := cdb.ComplainByCallerCode(cc, &complaint); err != nil {
+			resp = fmt.Sprintf("fail for %s: %s\n", cc, err)
+		}
 	}
 	
 	w.Write([]byte(fmt.Sprintf("%s for %s\n", resp, cc)))
 }
 
+// }}}
+// {{{ callerCodeAllowed
+
+// Once someone has an access token or a registered button, their caller code stops working.
+func callerCodeAllowed(cdb complaintdb.ComplaintDB, email string) (bool, error) {
+	if tokens,err := cdb.GetAccessTokens(email); err != nil {
+		return false, err
+	} else if len(tokens) > 0 {
+		return false, nil
+	}
+	devices,err := cdb.GetButtonDevices(email)
+	if err != nil { return false, err }
+	return len(devices) == 0, nil
+}
+
 // }}}
 // {{{ complaintUpdateFormHandler
 
@@ -109,10 +160,18 @@ func complaintUpdateFormHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	email := session.Values["email"].(string)
+	if !masqCheck(w, r, false) { return }
 
 	cdb := complaintdb.ComplaintDB{C: c}
 	key := r.FormValue("k")
 
+	cp, err := cdb.GetProfileByEmailAddress(email)
+	if err != nil {
+		c.Errorf("updateform, getProfile: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	if complaint, err := cdb.GetComplaintByKey(key, email); err != nil {
 		c.Errorf("updateform, getComplaint: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -126,7 +185,10 @@ func complaintUpdateFormHandler(w http.ResponseWriter, r *http.Request) {
 			"DefaultLoudness": complaint.Loudness,
 			"DefaultSpeedbrakes": complaint.HeardSpeedbreaks,
 			"DefaultDescription": complaint.Description,
+			"DefaultDoNotSubmit": complaint.DoNotSubmit,
+			"HeldForReview": cp.IsHeldForReview(*complaint),
 			"C": complaint,
+			"CSRFToken": sessions.CSRFToken(r, w),
 		}
 	
 		if err := templates.ExecuteTemplate(w, "complaint-updateform", params); err != nil {
@@ -148,6 +210,7 @@ func addComplaintHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	email := session.Values["email"].(string)
+	if !masqCheck(w, r, true) { return }
 	
 	cdb := complaintdb.ComplaintDB{C: c}
 	complaint := form2Complaint(r)
@@ -174,6 +237,7 @@ func addHistoricalComplaintHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	email := session.Values["email"].(string)
+	if !masqCheck(w, r, true) { return }
 	
 	cdb := complaintdb.ComplaintDB{C: c}
 	complaint := form2Complaint(r)
@@ -202,26 +266,41 @@ func updateComplaintHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	email := session.Values["email"].(string)
+	if !masqCheck(w, r, true) { return }
 
 	cdb := complaintdb.ComplaintDB{C: c}
 	new := form2Complaint(r)
 	newFlightNumber := r.FormValue("manualflightnumber")
 	newTimeString := r.FormValue("manualtimestring")
 
+	cp, err := cdb.GetProfileByEmailAddress(email)
+	if err != nil {
+		c.Errorf("updateform, getProfile: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	if orig, err := cdb.GetComplaintByKey(new.DatastoreKey, email); err != nil {
 		c.Errorf("updateform, getComplaint: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 
 	} else {
+		wasHeld := cp.IsHeldForReview(*orig)
+
 		// Overlay our new values
 		orig.Description = new.Description
 		orig.Loudness = new.Loudness
 		orig.Activity = new.Activity
 		orig.HeardSpeedbreaks = new.HeardSpeedbreaks
+		orig.DoNotSubmit = new.DoNotSubmit
+		if FormValueCheckbox(r, "reviewedok") {
+			orig.ReviewedOK = true
+		}
 
 		// If we're manually changing a flightnumber, wipe out all the other flight data
 		if newFlightNumber != orig.AircraftOverhead.FlightNumber {
 			orig.AircraftOverhead = fr24.Aircraft{FlightNumber: newFlightNumber}
+			complaintdb.ClassifyAircraft(orig)
 		}
 
 		// Compose a new timestamp, by inserting hew HH:MM:SS fragment into the old timestamp (date+nanoseconds)
@@ -238,6 +317,13 @@ func updateComplaintHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+
+		// If it was waiting for review and now isn't, send it off right away
+		if wasHeld && !cp.IsHeldForReview(*orig) && !orig.DoNotSubmit {
+			if err := cdb.EnqueueSubmission(email, orig.DatastoreKey, 0); err != nil {
+				c.Errorf("cdb.EnqueueSubmission failed: %v", err)
+			}
+		}
 	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
@@ -255,6 +341,7 @@ func deleteComplaintsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	email := session.Values["email"].(string)
+	if !masqCheck(w, r, true) { return }
 	
 	r.ParseForm()
 	// This is so brittle; need to move away from display text
@@ -268,7 +355,7 @@ func deleteComplaintsHandler(w http.ResponseWriter, r *http.Request) {
 	
 	keyStrings := []string{}
 	for k,_ := range r.Form {
-		if len(k) < 50 { continue }
+		if len(k) < 50 || k == sessions.CSRFFormField { continue }
 		keyStrings = append(keyStrings, k)
 	}
 	c.Infof("Deleting %d complaints for %s", len(keyStrings), email)
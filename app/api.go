@@ -0,0 +1,522 @@
+package complaints
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/skypies/complaints/bksv"
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/fr24"
+	"github.com/skypies/complaints/sessions"
+)
+
+// A JSON API, for apps and gizmos. Everything lives under /api/v1/:
+//   GET    /api/v1/complaints        ?start=&end= (RFC3339, or epoch secs), &limit=, &cursor=
+//   POST   /api/v1/complaints        body is an apiComplaintInput; returns the new complaint
+//   GET    /api/v1/complaints/<key>
+//   PUT    /api/v1/complaints/<key>  body is an apiComplaintInput; only given fields change
+//   DELETE /api/v1/complaints/<key>
+//   GET    /api/v1/profile
+//   PUT    /api/v1/profile           body is an apiProfileInput; only given fields change
+//   GET    /api/v1/export            everything, streamed (see export.go)
+// Errors come back as {"error": "..."}, with a suitable HTTP status. Clients should send an
+// access token ("Authorization: Bearer cpt_..."); GETs need the read scope, POSTing a new
+// complaint needs the complain scope, and everything else needs write.
+
+const (
+	kApiPrefix = "/api/v1"
+	kApiDefaultLimit = 100
+	kApiMaxLimit = 1000
+)
+
+func init() {
+	http.HandleFunc(kApiPrefix+"/complaints", apiComplaintsHandler)
+	http.HandleFunc(kApiPrefix+"/complaints/", apiComplaintHandler)
+	http.HandleFunc(kApiPrefix+"/profile", apiProfileHandler)
+}
+
+// {{{ apiComplaint, apiProfile
+
+type apiSubmission struct {
+	Airport       string    `json:"airport"`
+	Time          time.Time `json:"time"`
+	OperationType string    `json:"operation_type,omitempty"`
+}
+
+type apiFlight struct {
+	FlightNumber string  `json:"flight_number"`
+	Registration string  `json:"registration,omitempty"`
+	EquipType    string  `json:"equip_type,omitempty"`
+	Origin       string  `json:"origin,omitempty"`
+	Destination  string  `json:"destination,omitempty"`
+	Altitude     float64 `json:"altitude_ft,omitempty"`
+	Speed        float64 `json:"speed_knots,omitempty"`
+}
+
+type apiComplaint struct {
+	Key              string          `json:"key"`
+	Timestamp        time.Time       `json:"timestamp"`
+	Loudness         int             `json:"loudness"`
+	Speedbrakes      bool            `json:"speedbrakes"`
+	Activity         string          `json:"activity"`
+	Description      string          `json:"description"`
+	Flight           *apiFlight      `json:"flight,omitempty"`
+	AircraftCategory string          `json:"aircraft_category,omitempty"`
+	DoNotSubmit      bool            `json:"do_not_submit"`
+	HeldForReview    bool            `json:"held_for_review"`
+	Submissions      []apiSubmission `json:"submissions"`
+}
+
+func toApiComplaint(cp types.ComplainerProfile, c types.Complaint) apiComplaint {
+	ac := apiComplaint{
+		Key: c.DatastoreKey,
+		Timestamp: c.Timestamp,
+		Loudness: c.Loudness,
+		Speedbrakes: c.HeardSpeedbreaks,
+		Activity: c.Activity,
+		Description: c.Description,
+		AircraftCategory: c.AircraftCategory,
+		DoNotSubmit: c.DoNotSubmit,
+		HeldForReview: cp.IsHeldForReview(c),
+		Submissions: []apiSubmission{},
+	}
+	if a := c.AircraftOverhead; a.FlightNumber != "" || a.Registration != "" {
+		ac.Flight = &apiFlight{
+			FlightNumber: a.FlightNumber,
+			Registration: a.Registration,
+			EquipType: a.EquipType,
+			Origin: a.Origin,
+			Destination: a.Destination,
+			Altitude: a.Altitude,
+			Speed: a.Speed,
+		}
+	}
+	for _,s := range c.Submissions {
+		ac.Submissions = append(ac.Submissions, apiSubmission{s.Airport, s.T, s.OperationType})
+	}
+	return ac
+}
+
+// Fields are pointers so that we can tell which ones were given.
+type apiComplaintInput struct {
+	Timestamp    *time.Time `json:"timestamp"`
+	Loudness     *int       `json:"loudness"`
+	Speedbrakes  *bool      `json:"speedbrakes"`
+	Activity     *string    `json:"activity"`
+	Description  *string    `json:"description"`
+	FlightNumber *string    `json:"flight_number"`
+	DoNotSubmit  *bool      `json:"do_not_submit"`
+	ReviewedOK   *bool      `json:"reviewed_ok"`
+}
+
+func (in apiComplaintInput)validate() error {
+	if in.Loudness != nil && (*in.Loudness < 1 || *in.Loudness > 3) {
+		return fmt.Errorf("loudness must be 1, 2 or 3")
+	}
+	if in.Timestamp != nil && in.Timestamp.After(time.Now().Add(time.Minute)) {
+		return fmt.Errorf("timestamp is in the future")
+	}
+	return nil
+}
+
+// Overlays the given fields onto the complaint.
+func (in apiComplaintInput)apply(c *types.Complaint) {
+	if in.Timestamp != nil   { c.Timestamp = *in.Timestamp }
+	if in.Loudness != nil    { c.Loudness = *in.Loudness }
+	if in.Speedbrakes != nil { c.HeardSpeedbreaks = *in.Speedbrakes }
+	if in.Activity != nil    { c.Activity = *in.Activity }
+	if in.Description != nil { c.Description = *in.Description }
+	if in.DoNotSubmit != nil { c.DoNotSubmit = *in.DoNotSubmit }
+	if in.ReviewedOK != nil && *in.ReviewedOK { c.ReviewedOK = true }
+
+	// If we're manually changing a flightnumber, wipe out all the other flight data
+	if in.FlightNumber != nil && *in.FlightNumber != c.AircraftOverhead.FlightNumber {
+		c.AircraftOverhead = fr24.Aircraft{FlightNumber: *in.FlightNumber}
+		complaintdb.ClassifyAircraft(c)
+	}
+}
+
+type apiProfile struct {
+	EmailAddress    string   `json:"email"`
+	CallerCode      string   `json:"caller_code"`
+	FullName        string   `json:"full_name"`
+	Address         string   `json:"address"`
+	Lat             float64  `json:"lat"`
+	Long            float64  `json:"long"`
+	SubmitAirports  []string `json:"submit_airports"`
+	SubmitPromptly  bool     `json:"submit_promptly"`
+	HoldForReview   bool     `json:"hold_for_review"`
+	ReviewFromHour  int      `json:"review_from_hour"`
+	ReviewToHour    int      `json:"review_to_hour"`
+	DigestFrequency string   `json:"digest_frequency"`
+	Announcements   bool     `json:"announcements"`
+}
+
+func toApiProfile(cp types.ComplainerProfile) apiProfile {
+	return apiProfile{
+		EmailAddress: cp.EmailAddress,
+		CallerCode: cp.CallerCode,
+		FullName: cp.FullName,
+		Address: cp.Address,
+		Lat: cp.Lat,
+		Long: cp.Long,
+		SubmitAirports: bksv.SubmitAirports(cp),
+		SubmitPromptly: cp.SubmitPromptly,
+		HoldForReview: cp.HoldForReview,
+		ReviewFromHour: cp.ReviewFromHour,
+		ReviewToHour: cp.ReviewToHour,
+		DigestFrequency: cp.Digest(),
+		Announcements: !cp.NoAnnouncements,
+	}
+}
+
+// The address isn't editable here; it needs the geocoding that the profile page does.
+type apiProfileInput struct {
+	CallerCode      *string   `json:"caller_code"`
+	FullName        *string   `json:"full_name"`
+	SubmitAirports  *[]string `json:"submit_airports"`
+	SubmitPromptly  *bool     `json:"submit_promptly"`
+	HoldForReview   *bool     `json:"hold_for_review"`
+	ReviewFromHour  *int      `json:"review_from_hour"`
+	ReviewToHour    *int      `json:"review_to_hour"`
+	DigestFrequency *string   `json:"digest_frequency"`
+	Announcements   *bool     `json:"announcements"`
+}
+
+func (in apiProfileInput)apply(cp *types.ComplainerProfile) error {
+	if in.SubmitAirports != nil {
+		known := map[string]bool{}
+		for _,a := range bksv.KnownAirports { known[a.Code] = true }
+		for _,code := range *in.SubmitAirports {
+			if !known[code] { return fmt.Errorf("unknown airport %q", code) }
+		}
+	}
+	for _,h := range []*int{in.ReviewFromHour, in.ReviewToHour} {
+		if h != nil && (*h < 0 || *h > 23) { return fmt.Errorf("hours must be 0-23") }
+	}
+	if f := in.DigestFrequency; f != nil {
+		switch *f {
+		case types.DigestNone, types.DigestDaily, types.DigestWeekly, types.DigestMonthly:
+		default: return fmt.Errorf("unknown digest_frequency %q", *f)
+		}
+	}
+
+	if in.CallerCode != nil      { cp.CallerCode = *in.CallerCode }
+	if in.FullName != nil        { cp.FullName = strings.TrimSpace(*in.FullName) }
+	if in.SubmitAirports != nil  {
+		cp.SubmitAirports = *in.SubmitAirports
+		cp.CcSfo = len(cp.SubmitAirports) > 0
+	}
+	if in.SubmitPromptly != nil  { cp.SubmitPromptly = *in.SubmitPromptly }
+	if in.HoldForReview != nil   { cp.HoldForReview = *in.HoldForReview }
+	if in.ReviewFromHour != nil  { cp.ReviewFromHour = *in.ReviewFromHour }
+	if in.ReviewToHour != nil    { cp.ReviewToHour = *in.ReviewToHour }
+	if in.DigestFrequency != nil { cp.DigestFrequency = *in.DigestFrequency }
+	if in.Announcements != nil   { cp.NoAnnouncements = !*in.Announcements }
+	return nil
+}
+
+// }}}
+
+// {{{ apiAuthenticate
+
+// Returns the email address of the user making the request. Clients send an access token
+// (see tokens.go), which needs the given scope; a logged-in browser session can do anything,
+// but anything beyond reading needs the session's CSRF token in an X-CSRF-Token header.
+// If it returns "", it has already written an error response.
+func apiAuthenticate(w http.ResponseWriter, r *http.Request, scope string) string {
+	if requestToken(r) != "" {
+		email,status := tokenUser(appengine.NewContext(r), r, scope)
+		switch status {
+		case http.StatusOK:
+			return email
+		case http.StatusForbidden:
+			apiError(w, status, "token lacks the %q scope", scope)
+		default:
+			apiError(w, status, "bad token")
+		}
+		return ""
+	}
+
+	session := sessions.Get(r)
+	if session.Values["email"] == nil {
+		apiError(w, http.StatusUnauthorized, "not logged in; send an access token")
+		return ""
+	}
+	if scope != complaintdb.ScopeRead && r.Header.Get(sessions.CSRFHeader) == "" {
+		apiError(w, http.StatusForbidden, "send an access token, or the %s header", sessions.CSRFHeader)
+		return ""
+	} else if scope != complaintdb.ScopeRead && !sessions.CheckCSRF(r) {
+		apiError(w, http.StatusForbidden, "bad %s header", sessions.CSRFHeader)
+		return ""
+	}
+	if !masqCheck(w, r, scope != complaintdb.ScopeRead) { return "" }
+	return session.Values["email"].(string)
+}
+
+// The scope a request needs, going by its method.
+func apiScope(r *http.Request) string {
+	if r.Method == "GET" { return complaintdb.ScopeRead }
+	return complaintdb.ScopeWrite
+}
+
+// }}}
+// {{{ apiWriteJSON, apiError, apiReadJSON
+
+func apiWriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	jsonBytes,err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
+
+func apiError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	apiWriteJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+func apiReadJSON(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	dec := json.NewDecoder(io.LimitReader(r.Body, 64*1024))
+	return dec.Decode(v)
+}
+
+// }}}
+// {{{ apiTime
+
+// Accepts RFC3339 ("2016-03-14T06:40:00-07:00") or epoch seconds.
+func apiTime(s string) (time.Time, error) {
+	if secs,err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// }}}
+
+// {{{ apiComplaintsHandler
+
+func apiComplaintsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	scope := apiScope(r)
+	if r.Method == "POST" { scope = complaintdb.ScopeComplain }
+	email := apiAuthenticate(w, r, scope)
+	if email == "" { return }
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	cp,err := cdb.GetProfileByEmailAddress(email)
+	if err == datastore.ErrNoSuchEntity {
+		apiError(w, http.StatusNotFound, "no profile; create one on the website first")
+		return
+	} else if err != nil {
+		apiError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		start,end := time.Time{}, time.Now().Add(time.Hour)
+		if s := r.FormValue("start"); s != "" {
+			if start,err = apiTime(s); err != nil {
+				apiError(w, http.StatusBadRequest, "bad start: %v", err)
+				return
+			}
+		}
+		if s := r.FormValue("end"); s != "" {
+			if end,err = apiTime(s); err != nil {
+				apiError(w, http.StatusBadRequest, "bad end: %v", err)
+				return
+			}
+		}
+		limit := kApiDefaultLimit
+		if s := r.FormValue("limit"); s != "" {
+			if limit,err = strconv.Atoi(s); err != nil || limit < 1 || limit > kApiMaxLimit {
+				apiError(w, http.StatusBadRequest, "limit must be 1-%d", kApiMaxLimit)
+				return
+			}
+		}
+
+		q := cdb.QueryInSpanByEmailAddress(start, end, email)
+		complaints,next,err := cdb.GetComplaintsPage(q, r.FormValue("cursor"), limit)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+
+		out := []apiComplaint{}
+		for _,comp := range complaints { out = append(out, toApiComplaint(*cp, comp)) }
+		apiWriteJSON(w, http.StatusOK, map[string]interface{}{
+			"complaints": out,
+			"next_cursor": next,
+		})
+
+	case "POST":
+		in := apiComplaintInput{}
+		if err := apiReadJSON(r, &in); err != nil {
+			apiError(w, http.StatusBadRequest, "bad JSON: %v", err)
+			return
+		} else if err := in.validate(); err != nil {
+			apiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+
+		complaint := types.Complaint{
+			Timestamp: time.Now(), // No point setting a timezone, it gets reset to UTC
+			Loudness: 1,
+		}
+		in.apply(&complaint)
+
+		if err := cdb.ComplainByEmailAddress(email, &complaint); err != nil {
+			c.Errorf("api: cdb.Complain failed: %v", err)
+			apiError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+
+		// Re-read it; it may have been merged into an existing complaint
+		stored,err := cdb.GetComplaintByKey(complaint.DatastoreKey, email)
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		apiWriteJSON(w, http.StatusCreated, toApiComplaint(*cp, *stored))
+
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "%s not allowed", r.Method)
+	}
+}
+
+// }}}
+// {{{ apiComplaintHandler
+
+func apiComplaintHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	email := apiAuthenticate(w, r, apiScope(r))
+	if email == "" { return }
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	// Someone else's complaint looks the same as one that doesn't exist
+	key := strings.TrimPrefix(r.URL.Path, kApiPrefix+"/complaints/")
+	if owner,err := complaintdb.ComplaintOwner(key); err != nil || owner != email {
+		apiError(w, http.StatusNotFound, "no such complaint")
+		return
+	}
+
+	cp,err := cdb.GetProfileByEmailAddress(email)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	complaint,err := cdb.GetComplaintByKey(key, email)
+	if err == datastore.ErrNoSuchEntity {
+		apiError(w, http.StatusNotFound, "no such complaint")
+		return
+	} else if err != nil {
+		apiError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		apiWriteJSON(w, http.StatusOK, toApiComplaint(*cp, *complaint))
+
+	case "PUT":
+		in := apiComplaintInput{}
+		if err := apiReadJSON(r, &in); err != nil {
+			apiError(w, http.StatusBadRequest, "bad JSON: %v", err)
+			return
+		} else if err := in.validate(); err != nil {
+			apiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+
+		wasHeld := cp.IsHeldForReview(*complaint)
+		in.apply(complaint)
+		if err := cdb.UpdateComplaint(*complaint, email); err != nil {
+			c.Errorf("api: cdb.UpdateComplaint failed: %v", err)
+			apiError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+
+		// If it was waiting for review and now isn't, send it off right away
+		if wasHeld && !cp.IsHeldForReview(*complaint) && !complaint.DoNotSubmit {
+			if err := cdb.EnqueueSubmission(email, complaint.DatastoreKey, 0); err != nil {
+				c.Errorf("api: cdb.EnqueueSubmission failed: %v", err)
+			}
+		}
+		apiWriteJSON(w, http.StatusOK, toApiComplaint(*cp, *complaint))
+
+	case "DELETE":
+		if err := cdb.DeleteComplaints([]string{key}, email); err != nil {
+			apiError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "%s not allowed", r.Method)
+	}
+}
+
+// }}}
+// {{{ apiProfileHandler
+
+func apiProfileHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	email := apiAuthenticate(w, r, apiScope(r))
+	if email == "" { return }
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	cp,err := cdb.GetProfileByEmailAddress(email)
+	if err == datastore.ErrNoSuchEntity {
+		apiError(w, http.StatusNotFound, "no profile; create one on the website first")
+		return
+	} else if err != nil {
+		apiError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		apiWriteJSON(w, http.StatusOK, toApiProfile(*cp))
+
+	case "PUT":
+		in := apiProfileInput{}
+		if err := apiReadJSON(r, &in); err != nil {
+			apiError(w, http.StatusBadRequest, "bad JSON: %v", err)
+			return
+		} else if err := in.apply(cp); err != nil {
+			apiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		if err := cdb.PutProfile(*cp); err != nil {
+			apiError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		apiWriteJSON(w, http.StatusOK, toApiProfile(*cp))
+
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "%s not allowed", r.Method)
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
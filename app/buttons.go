@@ -0,0 +1,169 @@
+package complaints
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/skypies/complaints/button"
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/sessions"
+)
+
+// Hardware buttons, which sign their requests (see the button package for the format).
+// Users register each one on /buttons, and copy its ID and secret into the device.
+
+func init() {
+	http.HandleFunc("/buttons", sessions.ProtectCSRF(buttonsHandler))
+	http.HandleFunc("/task/prune-button-nonces", pruneButtonNoncesHandler)
+}
+
+// {{{ signedButtonHandler
+
+// Called by buttonHandler, for requests that have a device ID.
+func signedButtonHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+	id,nonce,sig := r.FormValue("d"), r.FormValue("n"), r.FormValue("sig")
+
+	ts,err := strconv.ParseInt(r.FormValue("ts"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad ts", http.StatusBadRequest)
+		return
+	} else if len(nonce) > button.MaxNonceLen {
+		http.Error(w, "nonce too long", http.StatusBadRequest) // It ends up in a key name
+		return
+	}
+
+	d,err := cdb.GetButtonDevice(id)
+	if err != nil {
+		c.Infof("button: device %q: %v", id, err)
+		http.Error(w, "unknown device", http.StatusUnauthorized)
+		return
+	}
+	if err := button.Verify(d.Secret, id, ts, nonce, sig, time.Now()); err != nil {
+		c.Infof("button: device %s (%s): %v", id, d.EmailAddress, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Only check the nonce once the signature is good, so junk can't fill up the datastore
+	if fresh,err := cdb.ClaimButtonNonce(id, nonce); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !fresh {
+		c.Infof("button: device %s (%s): replayed nonce %s", id, d.EmailAddress, nonce)
+		http.Error(w, "already seen", http.StatusConflict)
+		return
+	}
+
+	// Use the time of the press, not of the request, in case it took a few retries to get here
+	complaint := types.Complaint{ Timestamp: time.Unix(ts,0) }
+	if err := cdb.ComplainByEmailAddress(d.EmailAddress, &complaint); err != nil {
+		c.Errorf("button: device %s (%s): %v", id, d.EmailAddress, err)
+		// Else the retry would get a 409, and the device would think this press got through
+		if err2 := cdb.ReleaseButtonNonce(id, nonce); err2 != nil {
+			c.Errorf("button: release nonce %s: %v", nonce, err2)
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := cdb.TouchButtonDevice(*d); err != nil {
+		c.Errorf("button: touch %s: %v", id, err)
+	}
+
+	w.Write([]byte("OK\n"))
+}
+
+// }}}
+// {{{ buttonsHandler
+
+// GET lists the user's buttons; POST with action=create (name) registers a new one, and
+// action=delete (id) removes one.
+func buttonsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	session := sessions.Get(r)
+	if session.Values["email"] == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	email := session.Values["email"].(string)
+	if !masqCheck(w, r, r.Method == "POST") { return }
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	var newDevice *complaintdb.ButtonDevice
+
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "create":
+			name := strings.TrimSpace(r.FormValue("name"))
+			if name == "" { name = "unnamed" }
+			d,err := cdb.CreateButtonDevice(email, name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			newDevice = d
+			c.Infof("registered button %s (%q) for %s", d.ID, name, email)
+
+		case "delete":
+			if err := cdb.DeleteButtonDevice(email, r.FormValue("id")); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/buttons?msg="+url.QueryEscape("Button removed"), http.StatusFound)
+			return
+		}
+	}
+
+	devices,err := cdb.GetButtonDevices(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	params := map[string]interface{}{
+		"Email": email,
+		"Devices": devices,
+		"NewDevice": newDevice,
+		"ButtonURL": siteURL() + "/button",
+		"Message": r.FormValue("msg"),
+		"CSRFToken": sessions.CSRFToken(r, w),
+	}
+	if err := templates.ExecuteTemplate(w, "buttons", params); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// }}}
+
+// {{{ pruneButtonNoncesHandler
+
+func pruneButtonNoncesHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	// Any press older than this would fail button.Verify anyway
+	n,err := cdb.PruneButtonNonces(time.Now().Add(-2 * button.MaxSkew))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(fmt.Sprintf("OK, pruned %d\n", n)))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
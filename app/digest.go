@@ -0,0 +1,364 @@
+package complaints
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/taskqueue"
+
+	"github.com/skypies/util/date"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/mailer"
+	"github.com/skypies/complaints/sessions"
+)
+
+// Weekly & monthly summary emails, for users who'd rather not get the daily one.
+
+const kTrendWeeks = 6 // How many weeks of week-over-week trend to show
+
+func init() {
+	http.HandleFunc("/emails-for-last-week", sendEmailsForLastWeekHandler)
+	http.HandleFunc("/emails-for-last-month", sendEmailsForLastMonthHandler)
+	http.HandleFunc("/task/send-digest", sendDigestTaskHandler)
+	http.HandleFunc("/digest-preview", digestPreviewHandler)
+}
+
+// {{{ Breakdown
+
+type KeyCount struct {
+	Key string
+	N   int
+}
+
+// A Breakdown counts up a set of complaints by airline, date and hour of day. The personal
+// report has always used the timestamps as stored; the digests use PDT.
+type Breakdown struct {
+	Pdt       bool
+	N         int
+	ByHour    [24]int
+	ByDate    map[string]int
+	ByAirline map[string]int
+}
+
+func NewBreakdown() *Breakdown {
+	return &Breakdown{ByDate: map[string]int{}, ByAirline: map[string]int{}}
+}
+
+func NewPdtBreakdown() *Breakdown {
+	b := NewBreakdown()
+	b.Pdt = true
+	return b
+}
+
+func (b *Breakdown)Add(c types.Complaint) {
+	t := c.Timestamp
+	if b.Pdt { t = date.InPdt(t) }
+	b.N++
+	b.ByHour[t.Hour()]++
+	b.ByDate[t.Format("2006.01.02")]++
+	if airline := c.AircraftOverhead.IATAAirlineCode(); airline != "" {
+		b.ByAirline[airline]++
+	}
+}
+
+func (b Breakdown)NumDays() int { return len(b.ByDate) }
+
+// Most complained-about airlines first
+func (b Breakdown)Airlines() []KeyCount {
+	ret := []KeyCount{}
+	for _,k := range keysByIntValDesc(b.ByAirline) { ret = append(ret, KeyCount{k, b.ByAirline[k]}) }
+	return ret
+}
+
+func (b Breakdown)Dates() []KeyCount {
+	ret := []KeyCount{}
+	for _,k := range keysByKeyAsc(b.ByDate) { ret = append(ret, KeyCount{k, b.ByDate[k]}) }
+	return ret
+}
+
+func (b Breakdown)Hours() []KeyCount {
+	ret := []KeyCount{}
+	for i,n := range b.ByHour { ret = append(ret, KeyCount{fmt.Sprintf("%02d", i), n}) }
+	return ret
+}
+
+// }}}
+// {{{ Trend
+
+// A Trend compares a count with the one from the period before.
+type Trend struct {
+	Start time.Time
+	N     int
+	PrevN int
+}
+
+func (t Trend)Change() string {
+	if t.PrevN == 0 { return "n/a" }
+	return fmt.Sprintf("%+d%%", (100 * (t.N - t.PrevN)) / t.PrevN)
+}
+
+// }}}
+
+// {{{ Digest
+
+type Digest struct {
+	Frequency  string
+	Profile    types.ComplainerProfile
+	Start,End  time.Time // [Start,End)
+	Breakdown  *Breakdown
+
+	Overall    Trend     // This period, compared with the previous one
+	Weeks      []Trend   // Week-over-week, oldest first
+	Community  Trend     // Everyone's complaints, from GlobalStats
+	People     int       // The most people complaining on any day in the period
+
+	UnsubscribeURL string
+	PreferencesURL string
+}
+
+func (d Digest)LastDay() time.Time { return d.End.Add(-1 * time.Second) }
+
+// What fraction of everyone's complaints were this user's
+func (d Digest)SharePercent() string {
+	if d.Community.N == 0 { return "n/a" }
+	return fmt.Sprintf("%.1f%%", 100.0 * float64(d.Overall.N) / float64(d.Community.N))
+}
+
+// }}}
+// {{{ digestStart
+
+// The digest covers [start,end); end should be a midnight.
+func digestStart(freq string, end time.Time) time.Time {
+	if freq == types.DigestMonthly { return end.AddDate(0,-1,0) }
+	return end.AddDate(0,0,-7)
+}
+
+// }}}
+// {{{ BuildDigest
+
+func BuildDigest(c appengine.Context, cp types.ComplainerProfile, freq string, end time.Time) (*Digest, error) {
+	cdb := complaintdb.ComplaintDB{C: c}
+	end = date.InPdt(end)
+	start := digestStart(freq, end)
+	prevStart := digestStart(freq, start)
+
+	d := Digest{
+		Frequency: freq,
+		Profile: cp,
+		Start: start,
+		End: end,
+		Breakdown: NewPdtBreakdown(),
+		UnsubscribeURL: unsubscribeURL(cp.EmailAddress, kListDigest),
+		PreferencesURL: preferencesURL(cp.EmailAddress),
+	}
+
+	iter := cdb.NewIter(cdb.QueryInSpanByEmailAddress(start, end, cp.EmailAddress))
+	for {
+		comp,err := iter.NextWithErr()
+		if err != nil { return nil, err }
+		if comp == nil { break }
+		d.Breakdown.Add(*comp)
+	}
+
+	count := func(s,e time.Time) (int, error) {
+		return cdb.QueryInSpanByEmailAddress(s, e, cp.EmailAddress).KeysOnly().Count(c)
+	}
+
+	prevN,err := count(prevStart, start)
+	if err != nil { return nil, err }
+	d.Overall = Trend{Start: start, N: d.Breakdown.N, PrevN: prevN}
+
+	// Week-over-week; one more week than we show, so the first one has something to compare with
+	weekly := []int{}
+	for i:=kTrendWeeks; i>=0; i-- {
+		s,e := end.AddDate(0,0,-7*(i+1)), end.AddDate(0,0,-7*i)
+		n,err := count(s,e)
+		if err != nil { return nil, err }
+		weekly = append(weekly, n)
+		if i < kTrendWeeks {
+			d.Weeks = append(d.Weeks, Trend{Start: s, N: n, PrevN: weekly[len(weekly)-2]})
+		}
+	}
+
+	if gs,err := cdb.LoadGlobalStats(); err != nil {
+		c.Errorf("BuildDigest/LoadGlobalStats: %v", err)
+	} else {
+		d.Community.Start = start
+		for _,dc := range gs.Counts {
+			t := dc.Timestamp()
+			if !t.Before(start) && t.Before(end) {
+				d.Community.N += dc.NumComplaints
+				if dc.NumComplainers > d.People { d.People = dc.NumComplainers }
+			} else if !t.Before(prevStart) && t.Before(start) {
+				d.Community.PrevN += dc.NumComplaints
+			}
+		}
+	}
+
+	return &d, nil
+}
+
+// }}}
+// {{{ GenerateDigestEmail
+
+func GenerateDigestEmail(c appengine.Context, d *Digest) (*mailer.Message, error) {
+	who := d.Profile.FullName
+	if d.Profile.CallerCode != "" { who = "[" + d.Profile.CallerCode + "]" }
+	period := "Weekly"
+	if d.Frequency == types.DigestMonthly { period = "Monthly" }
+
+	msg := &mailer.Message{
+		ReplyTo:  d.Profile.EmailAddress,
+		Sender:   kSenderEmail,
+		To:       []string{d.Profile.EmailAddress},
+		Subject:  fmt.Sprintf("%s report summary for %s", period, who),
+	}
+	if addr := inboundAddress(); addr != "" { msg.ReplyTo = addr }
+	if err := renderEmail(msg, "email-digest", d); err != nil {
+		return nil,err
+	}
+	addListHeaders(msg, d.Profile.EmailAddress, kListDigest)
+
+	return msg, nil
+}
+
+// }}}
+
+// {{{ enqueueDigests
+
+// Fans out one task per user who wants this kind of digest.
+func enqueueDigests(w http.ResponseWriter, r *http.Request, freq string) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	cps,err := cdb.GetAllProfiles()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	suppressed,err := cdb.GetSuppressedAddresses()
+	if err != nil {
+		c.Errorf("enqueueDigests/GetSuppressedAddresses: %v", err)
+	}
+
+	_,end := date.WindowForYesterday()
+	n := 0
+	for _,cp := range cps {
+		if cp.Digest() != freq { continue }
+		if suppressed[strings.ToLower(cp.EmailAddress)] { continue }
+
+		t := taskqueue.NewPOSTTask("/task/send-digest", map[string][]string{
+			"user": {cp.EmailAddress},
+			"freq": {freq},
+			"end":  {fmt.Sprintf("%d", end.Unix())},
+		})
+		if _,err := taskqueue.Add(c, t, "digests"); err != nil {
+			c.Errorf("enqueueDigests: enqueue <%s>: %v", cp.EmailAddress, err)
+			continue
+		}
+		n++
+	}
+
+	c.Infof("enqueued %d %s digests", n, freq)
+	w.Write([]byte(fmt.Sprintf("OK, enqueued %d", n)))
+}
+
+func sendEmailsForLastWeekHandler(w http.ResponseWriter, r *http.Request) {
+	enqueueDigests(w, r, types.DigestWeekly)
+}
+func sendEmailsForLastMonthHandler(w http.ResponseWriter, r *http.Request) {
+	enqueueDigests(w, r, types.DigestMonthly)
+}
+
+// }}}
+// {{{ sendDigestTaskHandler
+
+func sendDigestTaskHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+	email := r.FormValue("user")
+
+	secs,err := strconv.ParseInt(r.FormValue("end"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad end", http.StatusBadRequest)
+		return
+	}
+
+	cp,err := cdb.GetProfileByEmailAddress(email)
+	if err != nil {
+		c.Errorf("send-digest <%s>: %v", email, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	d,err := BuildDigest(c, *cp, r.FormValue("freq"), time.Unix(secs,0))
+	if err != nil {
+		c.Errorf("send-digest <%s>: %v", email, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if d.Breakdown.N == 0 {
+		w.Write([]byte("OK, nothing to send"))
+		return
+	}
+
+	msg,err := GenerateDigestEmail(c, d)
+	if err == nil {
+		err = mailer.New(c).Send(msg)
+	}
+	if err != nil {
+		c.Errorf("send-digest <%s>: %v", email, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// }}}
+// {{{ digestPreviewHandler
+
+// Renders the logged-in user's digest as it would be sent today; ?freq=monthly for monthly.
+func digestPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	session := sessions.Get(r)
+	if session.Values["email"] == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if !masqCheck(w, r, false) { return }
+	cdb := complaintdb.ComplaintDB{C: c}
+	cp,err := cdb.GetProfileByEmailAddress(session.Values["email"].(string))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	freq := types.DigestWeekly
+	if r.FormValue("freq") == types.DigestMonthly { freq = types.DigestMonthly }
+
+	_,end := date.WindowForYesterday()
+	d,err := BuildDigest(c, *cp, freq, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := templates.ExecuteTemplate(w, "email-digest", d); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
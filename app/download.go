@@ -73,6 +73,8 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !masqCheck(w, r, false) { return }
+
 	c := appengine.Timeout(appengine.NewContext(r), 60*time.Second)
 
 	cdb := complaintdb.ComplaintDB{C: c}
@@ -129,6 +131,7 @@ func personalReportHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	email := session.Values["email"].(string)
+	if !masqCheck(w, r, false) { return }
 
 	if r.FormValue("date") == "" {
 		var params = map[string]interface{}{
@@ -152,12 +155,9 @@ func personalReportHandler(w http.ResponseWriter, r *http.Request) {
 		email, start, end)
 
 	complaintStrings := []string{}
-	var countsByHour [24]int
-	countsByDate := map[string]int{}
-	countsByAirline := map[string]int{}
+	b := NewBreakdown()
 	
 	iter := cdb.NewIter(cdb.QueryInSpanByEmailAddress(start,end,email))
-	n := 0
 	for {
 		c := iter.Next();
 		if c == nil { break }
@@ -166,31 +166,25 @@ func personalReportHandler(w http.ResponseWriter, r *http.Request) {
 			c.Timestamp.Format("2006.01.02 15:04:05"), c.Loudness, c.HeardSpeedbreaks,
 			c.AircraftOverhead.FlightNumber, c.Description)
 		
-		n++
 		complaintStrings = append(complaintStrings, str)
-		
-		countsByHour[c.Timestamp.Hour()]++
-		countsByDate[c.Timestamp.Format("2006.01.02")]++
-		if airline := c.AircraftOverhead.IATAAirlineCode(); airline != "" {
-			countsByAirline[airline]++
-		}
+		b.Add(*c)
 	}
 
 	fmt.Fprintf(w, "\nTotal number of disturbance reports, over %d days:  %d\n",
-		len(countsByDate), n)
+		b.NumDays(), b.N)
 
 	fmt.Fprintf(w, "\nDisturbance reports, counted by Airline (where known):\n")
-	for _,k := range keysByIntValDesc(countsByAirline) {
-		fmt.Fprintf(w, " %s: % 4d\n", k, countsByAirline[k])
+	for _,kc := range b.Airlines() {
+		fmt.Fprintf(w, " %s: % 4d\n", kc.Key, kc.N)
 	}
 
 	fmt.Fprintf(w, "\nDisturbance reports, counted by date:\n")
-	for _,k := range keysByKeyAsc(countsByDate) {
-		fmt.Fprintf(w, " %s: % 4d\n", k, countsByDate[k])
+	for _,kc := range b.Dates() {
+		fmt.Fprintf(w, " %s: % 4d\n", kc.Key, kc.N)
 	}
 	fmt.Fprintf(w, "\nDisturbance reports, counted by hour of day (across all dates):\n")
-	for i,n := range countsByHour {
-		fmt.Fprintf(w, " %02d: % 4d\n", i, n)
+	for _,kc := range b.Hours() {
+		fmt.Fprintf(w, " %s: % 4d\n", kc.Key, kc.N)
 	}
 	fmt.Fprintf(w, "\nFull dump of all disturbance reports:\n\n")
 	for _,s := range complaintStrings {
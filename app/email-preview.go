@@ -0,0 +1,169 @@
+package complaints
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/fr24"
+)
+
+// Every email template comes in an HTML and plain text pair (see renderEmail). This page
+// renders each pair with some fixed fake data, so template changes can be eyeballed (and
+// diffed) without having to send any email, and so missing or broken pairs show up. The same
+// fixtures are rendered by TestEmailGolden, and checked against testdata/email/.
+
+func init() {
+	http.HandleFunc("/email/preview", emailPreviewHandler)
+}
+
+// {{{ emailFixtures
+
+// Data for each of the email templates, keyed by template name.
+func emailFixtures() map[string]interface{} {
+	t := time.Date(2016, time.March, 14, 6, 40, 0, 0, time.UTC)
+
+	profile := types.ComplainerProfile{
+		EmailAddress: "fixture@example.com",
+		CallerCode: "FIX001",
+		FullName: "Fiona Fixture",
+		Address: "1 Main St, Palo Alto, CA 94301, USA",
+		Lat: 37.44, Long: -122.16,
+		CcSfo: true,
+	}
+	complaints := []types.Complaint{
+		{
+			Version: 2, Timestamp: t, Loudness: 3, HeardSpeedbreaks: true, Activity: "Sleep",
+			Description: "Woke the whole house",
+			AircraftOverhead: fr24.Aircraft{FlightNumber: "UA123", EquipType: "B738",
+				Speed: 230, Altitude: 4500, Origin: "ORD", Destination: "SFO"},
+			Dist2KM: 1.2, Dist3KM: 1.9,
+		},
+		{
+			Version: 2, Timestamp: t.Add(17*time.Minute), Loudness: 1,
+		},
+	}
+
+	breakdown := NewPdtBreakdown()
+	for _,c := range complaints { breakdown.Add(c) }
+
+	return map[string]interface{}{
+		"email-bundle": map[string]interface{}{
+			"Profile": profile,
+			"Complaints": complaints,
+			"UnsubscribeURL": "https://example.com/unsubscribe",
+			"PreferencesURL": "https://example.com/preferences",
+		},
+		"email-single": map[string]interface{}{
+			"Profile": profile,
+			"Complaint": complaints[0],
+			"Operation": "Speedbrakes used",
+			"Airline": "UA",
+			"Notes": "Incredibly loud. Flight believed to be UA123. Woke the whole house",
+			"Zip": "94301",
+		},
+		"email-update": map[string]interface{}{
+			"UnsubscribeURL": "https://example.com/unsubscribe",
+			"PreferencesURL": "https://example.com/preferences",
+		},
+		"email-digest": &Digest{
+			Frequency: types.DigestWeekly,
+			Profile: profile,
+			Start: t.AddDate(0,0,-6),
+			End: t.AddDate(0,0,1),
+			Breakdown: breakdown,
+			Overall: Trend{N: 2, PrevN: 4},
+			Weeks: []Trend{{Start: t.AddDate(0,0,-13), N: 4, PrevN: 0}, {Start: t.AddDate(0,0,-6), N: 2, PrevN: 4}},
+			Community: Trend{N: 20404, PrevN: 18000},
+			People: 466,
+			UnsubscribeURL: "https://example.com/unsubscribe",
+			PreferencesURL: "https://example.com/preferences",
+		},
+		"email-inbound-confirm": map[string]interface{}{
+			"Profile": profile,
+			"Complaint": complaints[0],
+		},
+		"email-login-link": map[string]interface{}{
+			"URL": "https://example.com/login/email/verify",
+			"Expires": t.Add(kLoginLinkTTL),
+		},
+		"email-account-deletion": map[string]interface{}{
+			"URL": "https://example.com/account",
+			"Due": t.Add(kAccountDeletionGrace),
+		},
+		"email-rekey-link": map[string]interface{}{
+			"From": "fixture@example.com",
+			"URL": "https://example.com/account/email/verify",
+			"Expires": t.Add(kRekeyLinkTTL),
+		},
+		"email-rekey-done": map[string]interface{}{
+			"From": "fixture@example.com",
+			"To": "fiona@example.com",
+			"Moved": 1234,
+		},
+	}
+}
+
+// }}}
+// {{{ emailPreviewHandler
+
+// /email/preview lists the templates; ?t=email-bundle shows the HTML version, and
+// ?t=email-bundle&text=1 the plain text one.
+func emailPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	fixtures := emailFixtures()
+
+	name := r.FormValue("t")
+	if name == "" {
+		names := []string{}
+		for k,_ := range fixtures { names = append(names, k) }
+		sort.Strings(names)
+
+		// Render everything, to flush out broken or missing templates
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<html><body><ul>\n")
+		for _,k := range names {
+			html,text := new(bytes.Buffer), new(bytes.Buffer)
+			status := "OK"
+			if err := templates.ExecuteTemplate(html, k, fixtures[k]); err != nil {
+				status = "html: " + err.Error()
+			} else if err := textTemplates.ExecuteTemplate(text, k, fixtures[k]); err != nil {
+				status = "text: " + err.Error()
+			}
+			fmt.Fprintf(w, "<li>%s <a href=\"?t=%s\">html</a> <a href=\"?t=%s&text=1\">text</a> - %s</li>\n",
+				k, k, k, template.HTMLEscapeString(status))
+		}
+		fmt.Fprintf(w, "</ul></body></html>\n")
+		return
+	}
+
+	data,exists := fixtures[name]
+	if !exists {
+		http.Error(w, fmt.Sprintf("no template %q", name), http.StatusNotFound)
+		return
+	}
+
+	var err error
+	if r.FormValue("text") != "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = textTemplates.ExecuteTemplate(w, name, data)
+	} else {
+		err = templates.ExecuteTemplate(w, name, data)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
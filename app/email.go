@@ -5,22 +5,23 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
-	"net/url"
 	"regexp"
 	"sort"
 	"strings"
 	"time"
 
 	"appengine"
+	"appengine/datastore"
 	"appengine/urlfetch"
 	"appengine/taskqueue"
-	"appengine/mail"
 
 	"github.com/skypies/util/date"
 
 	"github.com/skypies/complaints/bksv"
 	"github.com/skypies/complaints/complaintdb"
 	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/mailer"
+	"github.com/skypies/complaints/rbac"
 	"github.com/skypies/complaints/sessions"
 )
 
@@ -33,17 +34,35 @@ const(
 func init() {
 	http.HandleFunc("/_ah/bounce", bounceHandler)
 	http.HandleFunc("/email", emailHandler)
+	http.HandleFunc("/email/bounces", sessions.ProtectCSRF(emailBouncesHandler))
 	//http.HandleFunc("/email-update", emailUpdateHandler)
 	http.HandleFunc("/emails-for-yesterday", sendEmailsForYesterdayHandler)
 
 	http.HandleFunc("/bksv/submit-user",    bksvSubmitUserHandler)
+	http.HandleFunc("/task/bksv-submit-complaint", bksvSubmitComplaintHandler)
+	// Tasks queued before it moved under /task/ (which app.yaml keeps to admins)
+	http.HandleFunc("/bksv/submit-complaint",
+		rbac.Require(bksvSubmitComplaintHandler, complaintdb.RoleAdmin))
 	http.HandleFunc("/bksv/scan-yesterday", bksvScanYesterdayHandler)
 }	
 
+// {{{ renderEmail
+
+// renderEmail fills in both bodies of the message from a pair of templates with the same
+// name: the HTML one from templates/, and the plain text one from text-templates/.
+func renderEmail(msg *mailer.Message, name string, data interface{}) error {
+	html,text := new(bytes.Buffer), new(bytes.Buffer)
+	if err := templates.ExecuteTemplate(html, name, data); err != nil { return err }
+	if err := textTemplates.ExecuteTemplate(text, name, data); err != nil { return err }
+	msg.HTMLBody, msg.Body = html.String(), text.String()
+	return nil
+}
+
+// }}}
 // {{{ SendEmailToAdmin
 
 func SendEmailToAdmin(c appengine.Context, subject, htmlbody string) {
-	msg := &mail.Message{
+	msg := &mailer.Message{
 
 		Sender:   kSenderEmail, // cap.Profile.EmailAddress,
 		To:       []string{kAdminEmail},
@@ -51,7 +70,7 @@ func SendEmailToAdmin(c appengine.Context, subject, htmlbody string) {
 		HTMLBody: htmlbody,
 	}
 
-	if err := mail.Send(c, msg); err != nil {
+	if err := mailer.New(c).Send(msg); err != nil {
 		c.Errorf("Could not send adminemail to <%s>: %v", kAdminEmail, err)
 	}
 }
@@ -67,26 +86,33 @@ func SendEmailToAllUsers(c appengine.Context, subject string) int {
 		return 0
 
 	} else {
-		buf := new(bytes.Buffer)	
-		params := map[string]interface{}{}
-		if err := templates.ExecuteTemplate(buf, "email-update", params); err != nil {
-			return 0
+		suppressed,err := cdb.GetSuppressedAddresses()
+		if err != nil {
+			c.Errorf("SendEmailToAllUsers/GetSuppressedAddresses: %v", err)
 		}
 
+		m := mailer.New(c)
 		n := 0
 		for _,cp := range cps {
+			if cp.NoAnnouncements { continue }
+			if suppressed[strings.ToLower(cp.EmailAddress)] { continue }
 
-			// This message update goes only to the opt-outers ...
-			if cp.CcSfo == true && cp.CallerCode != "WOR005" { continue }
-
-			msg := &mail.Message{
+			params := map[string]interface{}{
+				"UnsubscribeURL": unsubscribeURL(cp.EmailAddress, kListAnnouncements),
+				"PreferencesURL": preferencesURL(cp.EmailAddress),
+			}
+			msg := &mailer.Message{
 				Sender:   kSenderEmail,
 				ReplyTo:  kSenderEmail,
 				To:       []string{cp.EmailAddress},
 				Subject:  subject,
-				HTMLBody: buf.String(),
 			}
-			if err := mail.Send(c, msg); err != nil {
+			if err := renderEmail(msg, "email-update", params); err != nil {
+				c.Errorf("SendEmailToAllUsers/renderEmail: %v", err)
+				return n
+			}
+			addListHeaders(msg, cp.EmailAddress, kListAnnouncements)
+			if err := m.Send(msg); err != nil {
 				c.Errorf("Could not send useremail to <%s>: %v", cp.EmailAddress, err)
 			}
 			n++
@@ -99,7 +125,7 @@ func SendEmailToAllUsers(c appengine.Context, subject string) int {
 
 // {{{ GenerateSingleComplaintEmail
 
-func GenerateSingleComplaintEmail(c appengine.Context, profile types.ComplainerProfile, complaint types.Complaint) (*mail.Message, error) {
+func GenerateSingleComplaintEmail(c appengine.Context, profile types.ComplainerProfile, complaint types.Complaint) (*mailer.Message, error) {
 	if profile.CcSfo == false {
 		return nil, fmt.Errorf("singlecomplaint called, but CcSFO false")
 	}
@@ -123,7 +149,6 @@ func GenerateSingleComplaintEmail(c appengine.Context, profile types.ComplainerP
 
 	zip := regexp.MustCompile("^.*(\\d{5}(-\\d{4})?).*$").ReplaceAllString(profile.Address, "$1")
 	
-	buf := new(bytes.Buffer)	
 	params := map[string]interface{}{
 		"Profile": profile,
 		"Complaint": complaint,
@@ -132,17 +157,16 @@ func GenerateSingleComplaintEmail(c appengine.Context, profile types.ComplainerP
 		"Notes": notes,
 		"Zip": zip,
 	}
-	if err := templates.ExecuteTemplate(buf, "email-single", params); err != nil {
-		return nil,err
-	}
 
-	msg := &mail.Message{
+	msg := &mailer.Message{
 		ReplyTo:  profile.EmailAddress,
 		Sender:   kSenderEmail,
 		To:       []string{kOfficalComplaintEmail},
 //		Bcc:      []string{"complainers+bcc@serfr1.org"},
 		Subject:  fmt.Sprintf("An SFO.NOISE complaint from %s", profile.FullName),
-		HTMLBody: buf.String(),
+	}
+	if err := renderEmail(msg, "email-single", params); err != nil {
+		return nil,err
 	}
 	
 	return msg, nil
@@ -151,11 +175,7 @@ func GenerateSingleComplaintEmail(c appengine.Context, profile types.ComplainerP
 // }}}
 // {{{ GenerateEmail
 
-func GenerateEmail(c appengine.Context, cap types.ComplaintsAndProfile) (*mail.Message, error) {
-	buf := new(bytes.Buffer)	
-	err := templates.ExecuteTemplate(buf, "email-bundle", cap)
-	if err != nil { return nil,err }
-
+func GenerateEmail(c appengine.Context, cap types.ComplaintsAndProfile) (*mailer.Message, error) {
 	var bcc = []string{
 		fmt.Sprintf("complainers+bcc@serfr1.org"), //, cap.Profile.CallerCode),
 	}
@@ -169,19 +189,31 @@ func GenerateEmail(c appengine.Context, cap types.ComplaintsAndProfile) (*mail.M
 	// In ascending order
 	sort.Sort(sort.Reverse(types.ComplaintsByTimeDesc(cap.Complaints)))
 
+	params := map[string]interface{}{
+		"Profile": cap.Profile,
+		"Complaints": cap.Complaints,
+		"UnsubscribeURL": unsubscribeURL(cap.Profile.EmailAddress, kListDigest),
+		"PreferencesURL": preferencesURL(cap.Profile.EmailAddress),
+	}
+
 	subject := fmt.Sprintf("Daily report summary for %s", cap.Profile.FullName)
 	if cap.Profile.CallerCode != "" {
 		subject = fmt.Sprintf("Daily report summary for [%s]", cap.Profile.CallerCode)
 	}
 
-	msg := &mail.Message{
+	msg := &mailer.Message{
 		ReplyTo:  cap.Profile.EmailAddress,
 		Sender:   kSenderEmail, // cap.Profile.EmailAddress,
 		To:       dests,
 		Bcc:      bcc,
 		Subject:  subject,
-		HTMLBody: buf.String(),
 	}
+	if err := renderEmail(msg, "email-bundle", params); err != nil {
+		return nil,err
+	}
+	// Replies become new complaints, if we're accepting mail
+	if addr := inboundAddress(); addr != "" { msg.ReplyTo = addr }
+	addListHeaders(msg, cap.Profile.EmailAddress, kListDigest)
 
 	return msg, nil
 }
@@ -189,19 +221,22 @@ func GenerateEmail(c appengine.Context, cap types.ComplaintsAndProfile) (*mail.M
 // }}}
 // {{{ SendComplaintsWithSpan
 
-var blacklistAddrs = []string{}
-
 func SendComplaintsWithSpan(c appengine.Context, start,end time.Time) (err error) {
 	c.Infof("--- Emails, %s -> %s", start, end)
 
-	blacklist := map[string]bool{}
-	for _,e := range blacklistAddrs { blacklist[e] = true }
-	
 	cdb := complaintdb.ComplaintDB{C:c, Memcache:true}
 	var cps = []types.ComplainerProfile{}
 	cps, err = cdb.GetAllProfiles()
 	if err != nil { return }
 
+	// Addresses that have bounced or complained; don't send them anything
+	suppressed,serr := cdb.GetSuppressedAddresses()
+	if serr != nil {
+		c.Errorf("Could not get suppressed addresses: %v", serr)
+	}
+
+	m := mailer.New(c)
+
 	complaints_private,complaints_submitted,no_data,sent_ok,sent_fail := 0,0,0,0,0
 	sent_single_ok,sent_single_fail := 0,0
 	
@@ -228,10 +263,10 @@ func SendComplaintsWithSpan(c appengine.Context, start,end time.Time) (err error
 						sent_single_fail++
 						continue
 					} else {
-						if blacklist[cp.EmailAddress] {
+						if suppressed[strings.ToLower(cp.EmailAddress)] {
 							sent_single_fail++
 						} else {
-							if err := mail.Send(c, msg); err != nil {
+							if err := m.Send(msg); err != nil {
 								c.Errorf("Could not send email to <%s>: %v", cp.EmailAddress, err)
 								sent_single_fail++
 								continue
@@ -249,30 +284,22 @@ func SendComplaintsWithSpan(c appengine.Context, start,end time.Time) (err error
 			Complaints: complaints,
 		}
 
-		var msg *mail.Message
+		var msg *mailer.Message
 		if msg,err = GenerateEmail(c,cap); err != nil {
 			c.Errorf("Could not generate email to <%s>: %v", cp.EmailAddress, err)
 			sent_fail++
 			continue
 		}
 
-		useGateway := false
-		
-		if useGateway {
-			if err = sendViaHTTPGateway(c, msg); err != nil {
-				c.Errorf("Could not gateway email to <%s>: %v", cp.EmailAddress, err)
-				sent_fail++
-				continue
-			}
+		if suppressed[strings.ToLower(cp.EmailAddress)] {
+			sent_fail++
+		} else if cp.Digest() != types.DigestDaily {
+			// They get a weekly or monthly digest instead, or none at all
 		} else {
-			if blacklist[cp.EmailAddress] {
+			if err = m.Send(msg); err != nil {
+				c.Errorf("Could not send email to <%s>: %v", cp.EmailAddress, err)
 				sent_fail++
-			} else {
-				if err = mail.Send(c, msg); err != nil {
-					c.Errorf("Could not send email to <%s>: %v", cp.EmailAddress, err)
-					sent_fail++
-					continue
-				}
+				continue
 			}
 		}
 
@@ -319,12 +346,62 @@ func sendEmailsForWindow(w http.ResponseWriter, r *http.Request, start,end time.
 
 // {{{ bounceHandler
 
+// App Engine POSTs bounces here as a multipart form; the original bounce message is in the
+// raw-message field.
 func bounceHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
-	c.Errorf("Received a bounce: %v", r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	raw := r.FormValue("raw-message")
+	b,err := mailer.ParseBounce(strings.NewReader(raw), r.FormValue("original-to"))
+	if err != nil {
+		// Don't return an error; App Engine would only send it again
+		c.Errorf("Could not parse bounce (%v): %q", err, raw)
+		w.Write([]byte("OK"))
+		return
+	}
+
+	c.Infof("Received %s", b)
+	if err := cdb.RecordBounce(b.Recipient, b.Type, b.Status+" "+b.Diagnostic); err != nil {
+		c.Errorf("RecordBounce <%s>: %v", b.Recipient, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Write([]byte("OK"))
 }
 
+// }}}
+// {{{ emailBouncesHandler
+
+// Lists the addresses that have bounced; POST with action=clear&email=foo to forget one.
+func emailBouncesHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	if r.Method == "POST" && r.FormValue("action") == "clear" {
+		if err := cdb.ClearMailStatus(r.FormValue("email")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/email/bounces", http.StatusFound)
+		return
+	}
+
+	statuses,err := cdb.GetAllMailStatuses()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	params := map[string]interface{}{
+		"Statuses": statuses,
+		"CSRFToken": sessions.CSRFToken(r, w),
+	}
+	if err := templates.ExecuteTemplate(w, "email-bounces", params); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // }}}
 // {{{ emailHandler
 
@@ -332,6 +409,7 @@ func emailHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 	session := sessions.Get(r)
 	cdb := complaintdb.ComplaintDB{C: c}
+	if !masqCheck(w, r, false) { return }
 
 	cp, err := cdb.GetProfileByEmailAddress(session.Values["email"].(string))
 	if err != nil {
@@ -383,11 +461,6 @@ func emailHandler(w http.ResponseWriter, r *http.Request) {
 		"EmailSingleBody": template.HTML(msg2.HTMLBody),
 	}
 
-	/* if err4 := sendViaHTTPGateway(c, msg); err4 != nil {
-		http.Error(w, err4.Error(), http.StatusInternalServerError)
-		return
-	} */
-	
 	if err := templates.ExecuteTemplate(w, "email-debug", params); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -414,11 +487,50 @@ func emailUpdateHandler(w http.ResponseWriter, r *http.Request) {
 
 // }}}
 
+// {{{ pendingAirports
+
+// The airports this complaint still needs to go to; empty if the user doesn't want it sent.
+func pendingAirports(cp types.ComplainerProfile, complaint types.Complaint) []string {
+	airports := []string{}
+	if complaint.DoNotSubmit || cp.IsHeldForReview(complaint) { return airports }
+
+	for _,airport := range bksv.SubmitAirports(cp) {
+		if !complaint.HasBeenSubmittedTo(airport) { airports = append(airports, airport) }
+	}
+	return airports
+}
+
+// }}}
+// {{{ submitComplaint
+
+// Post the complaint to BKSV for each pending airport, and record each one that accepts it.
+func submitComplaint(c appengine.Context, cdb complaintdb.ComplaintDB, cp types.ComplainerProfile, complaint types.Complaint) (string, error) {
+	debug := ""
+	for _,airport := range pendingAirports(cp, complaint) {
+		d,err := bksv.PostComplaint(urlfetch.Client(c), cp, complaint, airport)
+		debug += d
+		if err != nil { return debug, err }
+
+		s := types.Submission{
+			Airport: airport,
+			T: time.Now(),
+			OperationType: bksv.SubmittedOperationType(complaint, airport), // What PostComplaint sent
+		}
+		if err := cdb.AddSubmission(complaint.DatastoreKey, cp.EmailAddress, s); err != nil {
+			// It went through, so don't fail; but it might get submitted again.
+			c.Errorf("BKSV submission of %s to %s not recorded: %v", complaint.DatastoreKey, airport, err)
+		}
+	}
+
+	return debug, nil
+}
+
+// }}}
 // {{{ bksvSubmitUserHandler
 
 func bksvSubmitUserHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
-	cdb := complaintdb.ComplaintDB{C:c, Memcache:true}
+	cdb := complaintdb.ComplaintDB{C:c} // No memcache; we need to see the latest submissions
 	start,end := date.WindowForYesterday()
 	bksv_ok,bksv_not_ok := 0,0
 
@@ -436,8 +548,9 @@ func bksvSubmitUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	} else {
 		for i,complaint := range complaints {
+			if len(pendingAirports(*cp, complaint)) == 0 { continue } // Sent already, or held back
 			time.Sleep(time.Millisecond * 200)
-			if debug,err := bksv.PostComplaint(urlfetch.Client(c), *cp, complaint); err != nil {
+			if debug,err := submitComplaint(c, cdb, *cp, complaint); err != nil {
 				//cdb.C.Infof("pro: %v", cp)
 				//cdb.C.Infof("comp: %#v", complaint)
 				cdb.C.Errorf("BKSV posting error: %v", err)
@@ -457,6 +570,50 @@ func bksvSubmitUserHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+// }}}
+// {{{ bksvSubmitComplaintHandler
+
+// Submits a single complaint. These tasks are enqueued as the complaint is made (for users
+// who opted in), with a delay to let any coalescing happen first.
+func bksvSubmitComplaintHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C:c}
+
+	email := r.FormValue("user")
+	key := r.FormValue("key")
+
+	cp,err := cdb.GetProfileByEmailAddress(email)
+	if err != nil {
+		c.Errorf(" /task/bksv-submit-complaint(%s): getprofile: %v", email, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	complaint,err := cdb.GetComplaintByKey(key, email)
+	if err == datastore.ErrNoSuchEntity {
+		w.Write([]byte("OK, complaint was deleted\n"))
+		return
+	} else if err != nil {
+		c.Errorf(" /task/bksv-submit-complaint(%s): getcomplaint: %v", email, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(pendingAirports(*cp, *complaint)) == 0 {
+		w.Write([]byte("OK, nothing to submit\n"))
+		return
+	}
+
+	if debug,err := submitComplaint(c, cdb, *cp, *complaint); err != nil {
+		c.Errorf(" /task/bksv-submit-complaint(%s): BKSV posting error: %v", email, err)
+		c.Infof("BKSV Debug\n------\n%s\n------\n", debug)
+		http.Error(w, err.Error(), http.StatusInternalServerError) // Let the queue retry
+		return
+	}
+
+	w.Write([]byte("OK\n"))
+}
+
 // }}}
 // {{{ bksvScanYesterdayHandler
 
@@ -485,7 +642,11 @@ func bksvScanYesterdayHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		} 
-		if len(complaints) > 0 {
+		nUnsubmitted := 0
+		for _,complaint := range complaints {
+			if len(pendingAirports(cp, complaint)) > 0 { nUnsubmitted++ }
+		}
+		if nUnsubmitted > 0 {
 			t := taskqueue.NewPOSTTask("/bksv/submit-user", map[string][]string{
 				"user": {cp.EmailAddress},
 			})
@@ -503,31 +664,6 @@ func bksvScanYesterdayHandler(w http.ResponseWriter, r *http.Request) {
 
 // }}}
 
-// {{{ sendViaHTTPGateway
-
-func sendViaHTTPGateway(c appengine.Context, msg *mail.Message) error {
-	client := urlfetch.Client(c)
-
-	gatewayUrl := "http://worrall.cc/cgi-bin/gae-bites"
-	data := url.Values{
-		"pwqiry":  {"o0ashaknjsof81boaskjal2dfpuigskguwfgl8xgfo"},
-		"to":      {strings.Join(msg.To, ",")},
-		"bcc":     {strings.Join(msg.Bcc, ",")},
-		"replyto": {msg.ReplyTo},
-		"subject": {msg.Subject},
-		"body":    {msg.HTMLBody},
-	}
-	
-	resp, err := client.PostForm(gatewayUrl, data)
-	if err != nil {	return err }
-
-	c.Infof("Mail gateway response:-\n%v", resp)
-
-	return nil
-}
-
-// }}}
-	
 // {{{ -------------------------={ E N D }=----------------------------------
 
 // Local variables:
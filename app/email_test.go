@@ -0,0 +1,54 @@
+package complaints
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/email/")
+
+// Renders every email template pair with the fixtures from email-preview.go, and compares
+// them with testdata/email/<name>.html and <name>.txt. After changing a template on purpose,
+// rerun with -update, and check the diffs of the golden files.
+func TestEmailGolden(t *testing.T) {
+	fixtures := emailFixtures()
+
+	// Every email needs a fixture, or it never gets checked. (ParseGlob also names a template
+	// after each file, e.g. "email-bundle.txt"; skip those.)
+	for _,tmpl := range textTemplates.Templates() {
+		name := tmpl.Name()
+		if strings.HasPrefix(name, "email-") && !strings.HasSuffix(name, ".txt") && fixtures[name] == nil {
+			t.Errorf("%s: no fixture in emailFixtures", name)
+		}
+	}
+
+	for name,data := range fixtures {
+		html,text := new(bytes.Buffer), new(bytes.Buffer)
+		if err := templates.ExecuteTemplate(html, name, data); err != nil {
+			t.Errorf("%s: html: %v", name, err)
+			continue
+		} else if err := textTemplates.ExecuteTemplate(text, name, data); err != nil {
+			t.Errorf("%s: text: %v", name, err)
+			continue
+		}
+
+		for ext,got := range map[string][]byte{".html": html.Bytes(), ".txt": text.Bytes()} {
+			golden := filepath.Join("testdata", "email", name+ext)
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, got, 0644); err != nil { t.Fatal(err) }
+				continue
+			}
+			want,err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Errorf("%s: %v (rerun with -update to create it)", name, err)
+			} else if !bytes.Equal(got, want) {
+				t.Errorf("%s%s doesn't match %s (rerun with -update if that's expected); got:\n%s",
+					name, ext, golden, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package complaints
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/sessions"
+)
+
+// A full export of a user's complaints, with every field, streamed straight out of a
+// ComplaintIterator rather than loaded into memory first:
+//   /export-complaints?format=ndjson   (or /api/v1/export, with a read-scope token)
+//     One complaint per line. Every kExportCheckpoint complaints, there is a line that
+//     is just {"cursor":"..."}; the last line is {"done":true}, or, if we ran out of time,
+//     {"cursor":"...","done":false}.
+//   /export-complaints?format=json
+//     {"complaints":[...], "next_cursor":"..."}; next_cursor is "" if that was everything.
+// To carry on from where an export stopped (or was cut off), repeat the request with
+// &cursor=<the last cursor seen>. Optional start= and end= (epoch secs, or RFC3339) limit
+// the span; they have to be the same when resuming.
+
+const (
+	kExportCheckpoint = 500
+	kExportTimeBudget = 45 * time.Second // Leave some room before the request deadline
+)
+
+func init() {
+	http.HandleFunc("/export-complaints", exportHandler)
+	http.HandleFunc(kApiPrefix+"/export", exportHandler)
+}
+
+// {{{ exportComplaint
+
+type exportComplaint struct {
+	types.Complaint
+	Profile *struct{} `json:",omitempty"` // Hides the copy of the profile in every complaint
+}
+
+// }}}
+// {{{ exportHandler
+
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	deadline := time.Now().Add(kExportTimeBudget)
+
+	email := ""
+	if r.URL.Path == kApiPrefix+"/export" {
+		if email = apiAuthenticate(w, r, complaintdb.ScopeRead); email == "" { return }
+	} else {
+		session := sessions.Get(r)
+		if session.Values["email"] == nil {
+			http.Error(w, "session was empty; no cookie ? is this browser in privacy mode ?",
+				http.StatusUnauthorized)
+			return
+		}
+		email = session.Values["email"].(string)
+		if !masqCheck(w, r, false) { return }
+	}
+
+	start,end := time.Unix(0,0), time.Now().Add(time.Hour)
+	var err error
+	if s := r.FormValue("start"); s != "" {
+		if start,err = apiTime(s); err != nil {
+			http.Error(w, "bad start: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := r.FormValue("end"); s != "" {
+		if end,err = apiTime(s); err != nil {
+			http.Error(w, "bad end: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	cdb := complaintdb.ComplaintDB{C: c}
+	q := cdb.QueryInSpanByEmailAddress(start, end, email)
+	if s := r.FormValue("cursor"); s != "" {
+		cur,err := datastore.DecodeCursor(s)
+		if err != nil {
+			http.Error(w, "bad cursor: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		q = q.Start(cur)
+	}
+	iter := cdb.NewIter(q)
+
+	ndjson := (r.FormValue("format") != "json")
+	filename := fmt.Sprintf("complaints-%s", time.Now().Format("20060102"))
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		filename += ".ndjson"
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		filename += ".json"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+
+	flush := func() {
+		if f,ok := w.(http.Flusher); ok { f.Flush() }
+	}
+	cursor := func() string {
+		cur,err := iter.Iter.Cursor()
+		if err != nil {
+			c.Errorf("export <%s>: cursor: %v", email, err)
+			return ""
+		}
+		return cur.String()
+	}
+
+	// From here on, the status has gone out; errors can only be reported in the body.
+	enc := json.NewEncoder(w)
+	if !ndjson { w.Write([]byte(`{"complaints":[`)) }
+
+	n := 0
+	next := ""
+	for {
+		if n > 0 && n % kExportCheckpoint == 0 {
+			if time.Now().After(deadline) {
+				next = cursor()
+				break
+			}
+			if ndjson { enc.Encode(map[string]string{"cursor": cursor()}) }
+			flush()
+		}
+
+		comp,err := iter.NextWithErr()
+		if err != nil {
+			c.Errorf("export <%s>: after %d: %v", email, n, err)
+			next = cursor()
+			break
+		} else if comp == nil {
+			break
+		}
+
+		if !ndjson && n > 0 { w.Write([]byte(",")) }
+		if err := enc.Encode(exportComplaint{Complaint: *comp}); err != nil {
+			c.Errorf("export <%s>: encode: %v", email, err)
+			return // The client has probably gone away
+		}
+		n++
+	}
+
+	if ndjson {
+		if next == "" {
+			enc.Encode(map[string]bool{"done": true})
+		} else {
+			enc.Encode(map[string]interface{}{"cursor": next, "done": false})
+		}
+	} else {
+		w.Write([]byte(`], "next_cursor":`))
+		enc.Encode(next)
+		w.Write([]byte("}\n"))
+	}
+	c.Infof("export <%s>: %d complaints, next=%q", email, n, next)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
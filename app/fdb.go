@@ -22,6 +22,9 @@ import (
 	fdb   "github.com/skypies/flightdb/gae"
 	fdbfa "github.com/skypies/flightdb/flightdbfa"
 	fdb24 "github.com/skypies/flightdb/flightdbfr24"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/rbac"
 )
 
 const (
@@ -31,21 +34,21 @@ const (
 
 func init() {
 	// Behind-the-scenes functions to populate the DB
-	http.HandleFunc("/fdb/scan", scanHandler)
-	http.HandleFunc("/fdb/addflight", addflightHandler)
-	http.HandleFunc("/fdb/addtrack", addtrackHandler)
-	http.HandleFunc("/fdb/decodetrack", decodetrackHandler)
+	http.HandleFunc("/fdb/scan", rbac.Require(scanHandler, complaintdb.RoleAdmin))
+	http.HandleFunc("/fdb/addflight", rbac.Require(addflightHandler, complaintdb.RoleAdmin))
+	http.HandleFunc("/fdb/addtrack", rbac.Require(addtrackHandler, complaintdb.RoleAdmin))
+	http.HandleFunc("/fdb/decodetrack", rbac.Require(decodetrackHandler, complaintdb.RoleAdmin))
 
 	// User-facing screens
 	// http.HandleFunc("/fdb/test", testFdbHandler)
-	http.HandleFunc("/fdb/deb", debugHandler)
-	http.HandleFunc("/fdb/lookup", lookupHandler)
-	http.HandleFunc("/fdb/query", queryHandler)
+	http.HandleFunc("/fdb/deb", rbac.Require(debugHandler, complaintdb.RoleAnalyst))
+	http.HandleFunc("/fdb/lookup", rbac.Require(lookupHandler, complaintdb.RoleAnalyst))
+	http.HandleFunc("/fdb/query", rbac.Require(queryHandler, complaintdb.RoleAnalyst))
 
 	// Main DB summary screens
-	http.HandleFunc("/fdb/recent",    flightListHandler)
-	http.HandleFunc("/fdb/today",     flightListHandler)
-	http.HandleFunc("/fdb/yesterday", flightListHandler)
+	http.HandleFunc("/fdb/recent",    rbac.Require(flightListHandler, complaintdb.RoleAnalyst))
+	http.HandleFunc("/fdb/today",     rbac.Require(flightListHandler, complaintdb.RoleAnalyst))
+	http.HandleFunc("/fdb/yesterday", rbac.Require(flightListHandler, complaintdb.RoleAnalyst))
 }
 
 // {{{ {load|save}FIFOSet
@@ -0,0 +1,431 @@
+package complaints
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/taskqueue"
+
+	"github.com/skypies/util/date"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/sessions"
+)
+
+// Bulk import of old complaints, from a CSV in the same format as /download-complaints. The
+// upload is parsed and checked, and the user gets a preview (errors, duplicates); when they
+// confirm, a task imports it in batches, and the page shows how it went.
+
+const (
+	kImportBatchSize = 200
+	kImportPreviewRows = 20
+	kImportMaxErrors = 100 // Don't list more than this many bad rows
+	kImportDupeWindow = 45 * time.Second // Only compare complaints this close together
+)
+
+func init() {
+	http.HandleFunc("/import-complaints", sessions.ProtectCSRF(importComplaintsHandler))
+	http.HandleFunc("/task/import-complaints", importComplaintsTaskHandler)
+}
+
+// {{{ importRow, parseComplaintsCSV
+
+type importRow struct {
+	Line      int
+	Complaint types.Complaint
+	Err       string
+	Duplicate bool
+}
+
+// The columns we know about; these match downloadHandler. Only the first two are required.
+var kImportColumns = []string{
+	"Date", "Time(PDT)", "Notes", "Speedbrakes", "Loudness", "Activity",
+	"Flightnumber", "Origin", "Destination", "Speed(Knots)", "Altitude(Feet)",
+	"Lat", "Long", "Registration", "Callsign",
+	"VerticalSpeed(FeetPerMin)", "Dist2(km)", "Dist3(km)",
+}
+
+// parseComplaintsCSV returns a row for every line after the header. Rows that couldn't be
+// parsed have Err set. An error is returned if the file as a whole is unusable.
+func parseComplaintsCSV(in io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = -1
+
+	header,err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("the file is empty")
+	} else if err != nil {
+		return nil, fmt.Errorf("couldn't read the header line: %v", err)
+	}
+
+	known := map[string]bool{}
+	for _,col := range kImportColumns { known[col] = true }
+	cols := map[string]int{}
+	for i,col := range header {
+		col = strings.TrimSpace(strings.TrimPrefix(col, "\ufeff")) // Excel likes a BOM
+		if !known[col] {
+			return nil, fmt.Errorf("unknown column %q; the columns should be the same as in the download", col)
+		}
+		cols[col] = i
+	}
+	for _,col := range kImportColumns[:2] {
+		if _,exists := cols[col]; !exists { return nil, fmt.Errorf("missing column %q", col) }
+	}
+
+	rows := []importRow{}
+	for line := 2; ; line++ {
+		record,err := reader.Read()
+		if err == io.EOF { break }
+		row := importRow{Line: line}
+		if err != nil {
+			row.Err = err.Error()
+		} else {
+			get := func(col string) string {
+				if i,exists := cols[col]; exists && i < len(record) { return strings.TrimSpace(record[i]) }
+				return ""
+			}
+			row.Complaint,err = csvRecordToComplaint(get)
+			if err != nil { row.Err = err.Error() }
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// }}}
+// {{{ csvRecordToComplaint
+
+func csvRecordToComplaint(get func(string) string) (types.Complaint, error) {
+	c := types.Complaint{
+		Description: get("Notes"),
+		Activity: get("Activity"),
+		Loudness: 1,
+	}
+
+	t,err := date.ParseInPdt("2006/01/02 15:04:05", get("Date") + " " + get("Time(PDT)"))
+	if err != nil {
+		return c, fmt.Errorf("bad date/time %q %q (want 2016/03/14 06:40:00)", get("Date"), get("Time(PDT)"))
+	} else if t.After(time.Now()) {
+		return c, fmt.Errorf("date/time is in the future")
+	}
+	c.Timestamp = t
+
+	switch strings.ToLower(get("Speedbrakes")) {
+	case "y", "yes", "true", "1": c.HeardSpeedbreaks = true
+	case "", "n", "no", "false", "0":
+	default: return c, fmt.Errorf("bad speedbrakes %q (want y, or nothing)", get("Speedbrakes"))
+	}
+
+	if s := get("Loudness"); s != "" {
+		if c.Loudness,err = strconv.Atoi(s); err != nil || c.Loudness < 1 || c.Loudness > 3 {
+			return c, fmt.Errorf("bad loudness %q (want 1, 2 or 3)", s)
+		}
+	}
+
+	a := &c.AircraftOverhead
+	a.FlightNumber = get("Flightnumber")
+	a.Origin = get("Origin")
+	a.Destination = get("Destination")
+	a.Registration = get("Registration")
+	a.Callsign = get("Callsign")
+
+	floats := []struct{ col string; dst *float64 }{
+		{"Speed(Knots)", &a.Speed}, {"Altitude(Feet)", &a.Altitude},
+		{"Lat", &a.Lat}, {"Long", &a.Long}, {"VerticalSpeed(FeetPerMin)", &a.VerticalSpeed},
+		{"Dist2(km)", &c.Dist2KM}, {"Dist3(km)", &c.Dist3KM},
+	}
+	for _,f := range floats {
+		if s := get(f.col); s != "" {
+			if *f.dst,err = strconv.ParseFloat(s, 64); err != nil {
+				return c, fmt.Errorf("bad %s %q", f.col, s)
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// }}}
+// {{{ markDuplicates
+
+// Marks the rows that are equivalent to an existing complaint, or to an earlier row. Only
+// complaints within kImportDupeWindow of each other are compared, else every complaint about
+// a daily flight would look the same.
+func markDuplicates(c appengine.Context, email string, rows []importRow) error {
+	var start,end time.Time
+	for _,row := range rows {
+		if row.Err != "" { continue }
+		if t := row.Complaint.Timestamp; start.IsZero() || t.Before(start) { start = t }
+		if t := row.Complaint.Timestamp; t.After(end) { end = t }
+	}
+	if start.IsZero() { return nil }
+
+	cdb := complaintdb.ComplaintDB{C: c}
+	seen := []types.Complaint{}
+	iter := cdb.NewIter(cdb.QueryInSpanByEmailAddress(start.Add(-kImportDupeWindow),
+		end.Add(kImportDupeWindow), email))
+	for {
+		comp,err := iter.NextWithErr()
+		if err != nil { return err }
+		if comp == nil { break }
+		seen = append(seen, *comp)
+	}
+
+	for i,row := range rows {
+		if row.Err != "" { continue }
+		for _,prev := range seen {
+			gap := row.Complaint.Timestamp.Sub(prev.Timestamp)
+			if gap < -kImportDupeWindow || gap > kImportDupeWindow { continue }
+			older,newer := prev, row.Complaint
+			if gap < 0 { older,newer = newer,older }
+			if complaintdb.ComplaintsAreEquivalent(older, newer) {
+				rows[i].Duplicate = true
+				break
+			}
+		}
+		if !rows[i].Duplicate { seen = append(seen, row.Complaint) }
+	}
+	return nil
+}
+
+// }}}
+// {{{ importSummary
+
+type importSummary struct {
+	Rows       int
+	New        int
+	Duplicates int
+	Errors     []string
+	Preview    []types.Complaint
+}
+
+func summarizeImport(rows []importRow) importSummary {
+	s := importSummary{Rows: len(rows)}
+	for _,row := range rows {
+		switch {
+		case row.Err != "":
+			if len(s.Errors) < kImportMaxErrors {
+				s.Errors = append(s.Errors, fmt.Sprintf("line %d: %s", row.Line, row.Err))
+			}
+		case row.Duplicate:
+			s.Duplicates++
+		default:
+			s.New++
+			if len(s.Preview) < kImportPreviewRows { s.Preview = append(s.Preview, row.Complaint) }
+		}
+	}
+	return s
+}
+
+// }}}
+
+// {{{ importComplaintsHandler
+
+// GET shows the upload form, or with ?job=<key>, how that import is going. POST with a "csv"
+// file uploads and previews it; POST with action=import&job=<key> starts the import.
+func importComplaintsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.Timeout(appengine.NewContext(r), 60*time.Second)
+	session := sessions.Get(r)
+	if session.Values["email"] == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	email := session.Values["email"].(string)
+	if !masqCheck(w, r, r.Method == "POST") { return }
+	cdb := complaintdb.ComplaintDB{C: c}
+	params := map[string]interface{}{"Email": email, "CSRFToken": sessions.CSRFToken(r, w)}
+
+	render := func() {
+		if err := templates.ExecuteTemplate(w, "import-complaints", params); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+
+	if r.Method == "POST" && r.FormValue("action") == "import" {
+		job,err := cdb.GetImportJob(r.FormValue("job"), email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !job.Started {
+			job.Started = true
+			if err := cdb.PutImportJob(*job); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := enqueueImportBatch(c, email, job.Key); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		http.Redirect(w, r, "/import-complaints?job="+job.Key, http.StatusFound)
+		return
+	}
+
+	if r.Method == "POST" {
+		file,header,err := r.FormFile("csv")
+		if err != nil {
+			params["Message"] = "Please pick a file to upload"
+			render()
+			return
+		}
+		defer file.Close()
+		b,err := ioutil.ReadAll(io.LimitReader(file, complaintdb.MaxImportBytes+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rows,err := parseComplaintsCSV(bytes.NewReader(b))
+		if err != nil {
+			params["Message"] = err.Error()
+			render()
+			return
+		}
+		if err := markDuplicates(c, email, rows); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		job,err := cdb.CreateImportJob(email, header.Filename, b)
+		if err != nil {
+			params["Message"] = err.Error()
+			render()
+			return
+		}
+
+		params["Job"] = job
+		params["Summary"] = summarizeImport(rows)
+		render()
+		return
+	}
+
+	if key := r.FormValue("job"); key != "" {
+		job,err := cdb.GetImportJob(key, email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params["Job"] = job
+	}
+	render()
+}
+
+// }}}
+// {{{ enqueueImportBatch
+
+func enqueueImportBatch(c appengine.Context, email, jobKey string) error {
+	t := taskqueue.NewPOSTTask("/task/import-complaints", map[string][]string{
+		"user": {email},
+		"job":  {jobKey},
+	})
+	_,err := taskqueue.Add(c, t, "")
+	return err
+}
+
+// }}}
+// {{{ importComplaintsTaskHandler
+
+// Imports the next batch of rows from the job, and queues up another task if there are more.
+// The duplicate check makes it safe to rerun a batch, if the task gets retried.
+func importComplaintsTaskHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.Timeout(appengine.NewContext(r), 60*time.Second)
+	cdb := complaintdb.ComplaintDB{C: c}
+	email := r.FormValue("user")
+
+	job,err := cdb.GetImportJob(r.FormValue("job"), email)
+	if err != nil {
+		c.Errorf("import-complaints <%s>: %v", email, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if job.Done {
+		w.Write([]byte("OK, already done\n"))
+		return
+	}
+	cp,err := cdb.GetProfileByEmailAddress(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows,err := parseComplaintsCSV(bytes.NewReader(job.CSV))
+	if err != nil {
+		job.Errors = append(job.Errors, err.Error())
+		job.Done = true
+		rows = nil
+	}
+	job.Rows = len(rows)
+
+	if job.Offset < len(rows) {
+		end := job.Offset + kImportBatchSize
+		if end > len(rows) { end = len(rows) }
+		batch := rows[job.Offset:end]
+
+		if err := markDuplicates(c, email, batch); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		complaints := []types.Complaint{}
+		for _,row := range batch {
+			switch {
+			case row.Err != "":
+				if len(job.Errors) < kImportMaxErrors {
+					job.Errors = append(job.Errors, fmt.Sprintf("line %d: %s", row.Line, row.Err))
+				}
+			case row.Duplicate:
+				job.Duplicates++
+			default:
+				complaints = append(complaints, row.Complaint)
+			}
+		}
+		if len(complaints) > 0 {
+			if err := cdb.AddHistoricalComplaints(*cp, complaints); err != nil {
+				c.Errorf("import-complaints <%s>: %v", email, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		job.Imported += len(complaints)
+		job.Offset = end
+	}
+
+	if job.Offset >= len(rows) {
+		job.Done = true
+		job.CSV = nil // No need to keep it around
+		if err := cdb.ResetDailyCounts(email); err != nil {
+			c.Errorf("import-complaints <%s>: ResetDailyCounts: %v", email, err)
+		}
+	}
+	if err := cdb.PutImportJob(*job); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !job.Done {
+		if err := enqueueImportBatch(c, email, job.Key); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	c.Infof("import-complaints <%s>: %d/%d rows, %d imported", email, job.Offset, job.Rows, job.Imported)
+	w.Write([]byte("OK\n"))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
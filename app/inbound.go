@@ -0,0 +1,197 @@
+package complaints
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/skypies/util/date"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/config"
+	"github.com/skypies/complaints/mailer"
+)
+
+// Complaints by email. Mail sent to anything@<appid>.appspotmail.com gets POSTed (as a raw
+// RFC 5322 message) to /_ah/mail/<address>. Only mail that the receiving server (config
+// "mail.inbound.authserv") says passed DKIM or SPF for the sender's domain is accepted. To
+// try it locally, use the dev server's "Inbound Mail" admin page, and add a header like
+//   Authentication-Results: localhost; dkim=pass header.d=example.com
+
+func init() {
+	http.HandleFunc("/_ah/mail/", inboundMailHandler)
+}
+
+// {{{ inboundAddress
+
+// Where users should send (or reply) complaints to; "" if not configured.
+func inboundAddress() string { return config.Get("mail.inbound.address") }
+
+// The server whose Authentication-Results headers we trust.
+func inboundAuthserv() string { return config.Get("mail.inbound.authserv") }
+
+// }}}
+// {{{ inboundDropReason
+
+// Why the mail shouldn't become a complaint; "" if it should. Our own emails have the inbound
+// address as their Reply-To, so out-of-office replies come back here; they must never turn
+// into complaints (or get a confirmation, which would get another reply ...).
+func inboundDropReason(in mailer.InboundMessage, authserv string) string {
+	if !in.Authenticated(authserv) {
+		return "not authenticated"
+	} else if in.IsAutomatic() {
+		return "is an automatic reply"
+	}
+	return ""
+}
+
+// }}}
+// {{{ parseEmailComplaint
+
+var (
+	// 6:40, 06:40am, 18:40, 6.40 pm
+	kEmailTimeRegexp = regexp.MustCompile(`(?i)\b([01]?\d|2[0-3])[:.]([0-5]\d)\s*([ap])?\.?m?\b`)
+	// 6am, 11 pm
+	kEmailHourRegexp = regexp.MustCompile(`(?i)\b(1[0-2]|0?[1-9])\s*([ap])\.?m\b`)
+
+	kEmailLoudnessRegexp = regexp.MustCompile(`(?i)\bloudness\s*[:=]?\s*([123])\b`)
+	kEmailLoud3Regexp    = regexp.MustCompile(`(?i)\b(too|insanely|incredibly|extremely) loud\b`)
+	kEmailLoud2Regexp    = regexp.MustCompile(`(?i)\bvery loud\b`)
+	kEmailBrakesRegexp   = regexp.MustCompile(`(?i)\bspeed ?bra(k|ke)s?\b`)
+)
+
+// parseEmailComplaint pulls a complaint out of the text of an email. Everything is optional:
+//  * a time ("6:40", "6:40am", "18:40", "6pm"), in PDT, on the day the email arrived; if
+//    that would be after it arrived, it's taken to mean the day before
+//  * a loudness ("very loud", "too loud", or "loudness 2"); the default is plain loud
+//  * "speedbrakes"
+// The text itself becomes the complaint's description.
+func parseEmailComplaint(subject, text string, sent time.Time) types.Complaint {
+	all := subject + "\n" + text
+
+	c := types.Complaint{
+		Timestamp: sent,
+		Loudness: 1,
+		HeardSpeedbreaks: kEmailBrakesRegexp.MatchString(all),
+		Description: text,
+	}
+	if c.Description == "" && !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		c.Description = subject
+	}
+
+	hour,min,found := -1,0,false
+	if m := kEmailTimeRegexp.FindStringSubmatch(all); m != nil {
+		hour,_ = strconv.Atoi(m[1])
+		min,_ = strconv.Atoi(m[2])
+		found = hour <= 12 || m[3] == ""
+		if strings.ToLower(m[3]) == "p" && hour < 12 { hour += 12 }
+		if strings.ToLower(m[3]) == "a" && hour == 12 { hour = 0 }
+	} else if m := kEmailHourRegexp.FindStringSubmatch(all); m != nil {
+		hour,_ = strconv.Atoi(m[1])
+		found = true
+		if strings.ToLower(m[2]) == "p" && hour < 12 { hour += 12 }
+		if strings.ToLower(m[2]) == "a" && hour == 12 { hour = 0 }
+	}
+	if found {
+		s := date.InPdt(sent)
+		t := time.Date(s.Year(), s.Month(), s.Day(), hour, min, 0, 0, s.Location())
+		if t.After(s.Add(time.Minute)) { t = t.AddDate(0,0,-1) }
+		c.Timestamp = t
+	}
+
+	if m := kEmailLoudnessRegexp.FindStringSubmatch(all); m != nil {
+		c.Loudness,_ = strconv.Atoi(m[1])
+	} else if kEmailLoud3Regexp.MatchString(all) {
+		c.Loudness = 3
+	} else if kEmailLoud2Regexp.MatchString(all) {
+		c.Loudness = 2
+	}
+
+	return c
+}
+
+// }}}
+// {{{ inboundMailHandler
+
+// Always returns 200 for mail we've dealt with (even if we've dropped it), else App Engine
+// keeps redelivering.
+func inboundMailHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+	defer r.Body.Close()
+
+	in,err := mailer.ParseInbound(r.Body)
+	if err != nil {
+		c.Errorf("inbound mail: %v", err)
+		w.Write([]byte("OK, unparseable"))
+		return
+	}
+	c.Infof("inbound mail from <%s>, subject %q", in.From, in.Subject)
+
+	if reason := inboundDropReason(*in, inboundAuthserv()); reason != "" {
+		c.Infof("inbound mail: <%s> %s, dropping", in.From, reason)
+		w.Write([]byte("OK, dropped"))
+		return
+	}
+
+	// Only mail from registered users counts. Don't reply to anyone else, since the From:
+	// address may well not be the real sender.
+	cp,err := cdb.GetProfileByEmailAddress(in.From)
+	if err != nil {
+		c.Infof("inbound mail: no profile for <%s> (%v), dropping", in.From, err)
+		w.Write([]byte("OK, dropped"))
+		return
+	}
+
+	// Not the Date: header, which the sender can set to anything
+	complaint := parseEmailComplaint(in.Subject, in.Text, time.Now())
+	if err := cdb.ComplainByEmailAddress(cp.EmailAddress, &complaint); err != nil {
+		c.Errorf("inbound mail: complain <%s>: %v", cp.EmailAddress, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := sendInboundConfirmation(c, *cp, in.Subject, complaint); err != nil {
+		c.Errorf("inbound mail: confirmation to <%s>: %v", cp.EmailAddress, err)
+	}
+	w.Write([]byte("OK"))
+}
+
+// }}}
+// {{{ sendInboundConfirmation
+
+func sendInboundConfirmation(c appengine.Context, cp types.ComplainerProfile, subject string, complaint types.Complaint) error {
+	params := map[string]interface{}{
+		"Profile": cp,
+		"Complaint": complaint,
+	}
+
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") { subject = "Re: " + subject }
+	msg := &mailer.Message{
+		Sender:   kSenderEmail,
+		ReplyTo:  inboundAddress(),
+		To:       []string{cp.EmailAddress},
+		Subject:  subject,
+	}
+	if msg.ReplyTo == "" { msg.ReplyTo = kSenderEmail }
+	if err := renderEmail(msg, "email-inbound-confirm", params); err != nil {
+		return err
+	}
+
+	return mailer.New(c).Send(msg)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,74 @@
+package complaints
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skypies/util/date"
+
+	"github.com/skypies/complaints/mailer"
+)
+
+func TestParseEmailComplaint(t *testing.T) {
+	arrived := date.InPdt(time.Date(2016, time.March, 14, 14, 0, 0, 0, time.UTC)) // 07:00 PDT
+
+	tests := []struct {
+		body     string
+		hour     int // PDT
+		min      int
+		day      int
+		loudness int
+		brakes   bool
+	}{
+		{"Very loud at 6:40am", 6, 40, 14, 2, false},
+		{"too loud, speedbrakes", 7, 0, 14, 3, true},
+		{"loudness 3 at 11pm", 23, 0, 13, 3, false},
+		{"18:05", 18, 5, 13, 1, false},
+	}
+
+	for _,test := range tests {
+		raw := "From: alice@example.com\r\nSubject: noise\r\nContent-Type: text/plain\r\n\r\n" +
+			test.body + "\r\n"
+		in,err := mailer.ParseInbound(strings.NewReader(raw))
+		if err != nil { t.Fatalf("%q: ParseInbound: %v", test.body, err) }
+
+		c := parseEmailComplaint(in.Subject, in.Text, arrived)
+		ts := date.InPdt(c.Timestamp)
+		if ts.Hour() != test.hour || ts.Minute() != test.min || ts.Day() != test.day {
+			t.Errorf("%q: time: got %s", test.body, ts)
+		}
+		if c.Loudness != test.loudness { t.Errorf("%q: loudness: got %d", test.body, c.Loudness) }
+		if c.HeardSpeedbreaks != test.brakes { t.Errorf("%q: speedbrakes: got %v", test.body, c.HeardSpeedbreaks) }
+		if c.Description != test.body { t.Errorf("%q: description: got %q", test.body, c.Description) }
+	}
+}
+
+func TestInboundDropReason(t *testing.T) {
+	pass := "Authentication-Results: mx.google.com; dkim=pass header.d=example.com\r\n"
+	tests := []struct {
+		name    string
+		headers string
+		drop    bool
+	}{
+		{"from a person", pass, false},
+		{"Auto-Submitted: no", pass + "Auto-Submitted: no\r\n", false},
+		{"not authenticated", "", true},
+		{"out of office", pass + "Auto-Submitted: auto-replied\r\n", true},
+		{"bulk", pass + "Precedence: bulk\r\n", true},
+		{"mailing list", pass + "Precedence: list\r\n", true},
+		{"X-Autoreply", pass + "X-Autoreply: yes\r\n", true},
+		{"X-Autorespond", pass + "X-Autorespond: Out of office\r\n", true},
+	}
+
+	for _,test := range tests {
+		raw := "From: alice@example.com\r\n" + test.headers +
+			"Subject: Out of office: Re: your complaint\r\nContent-Type: text/plain\r\n\r\n" +
+			"I'm away until Monday.\r\n"
+		in,err := mailer.ParseInbound(strings.NewReader(raw))
+		if err != nil { t.Fatalf("%s: ParseInbound: %v", test.name, err) }
+		if reason := inboundDropReason(*in, "mx.google.com"); (reason != "") != test.drop {
+			t.Errorf("%s: got reason %q, wanted drop=%v", test.name, reason, test.drop)
+		}
+	}
+}
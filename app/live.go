@@ -0,0 +1,189 @@
+package complaints
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/live"
+)
+
+// The live stream of complaints, as Server-Sent Events; see the live package for the event
+// format, and a client. Filters: ?zip=94301, ?city=Palo+Alto, or ?lat=&long=&radius_km=.
+// Each response holds the request open until there's something to send (or kLiveHoldTime
+// has passed), sends it, and ends; EventSource then reconnects with Last-Event-ID.
+
+const (
+	kLiveHoldTime = 25 * time.Second
+	kLivePollInterval = 2 * time.Second
+	kLiveMaxEvents = 200
+	kLiveRescan = 5 * time.Second
+)
+
+func init() {
+	http.HandleFunc("/live/stream", liveStreamHandler)
+	http.HandleFunc("/task/prune-live-events", pruneLiveEventsHandler)
+}
+
+// {{{ liveFilter
+
+func liveFilter(r *http.Request) (live.Filter, error) {
+	f := live.Filter{Zip: r.FormValue("zip"), City: r.FormValue("city")}
+	if s := r.FormValue("radius_km"); s != "" {
+		var err1,err2,err3 error
+		f.RadiusKM,err1 = strconv.ParseFloat(s, 64)
+		f.Lat,err2 = strconv.ParseFloat(r.FormValue("lat"), 64)
+		f.Long,err3 = strconv.ParseFloat(r.FormValue("long"), 64)
+		if err1 != nil || err2 != nil || err3 != nil || f.RadiusKM <= 0 {
+			return f, fmt.Errorf("radius_km needs a positive number, and lat and long")
+		}
+	}
+	return f, nil
+}
+
+// }}}
+// {{{ liveCursor
+
+// Where a client has got to, which is what its Last-Event-ID holds. Events are numbered by
+// when they were recorded, but can turn up in queries a little out of order (a slow commit,
+// or a lagging index); so every query looks back over the last kLiveRescan too, and the
+// cursor remembers which of those events the client already has. It looks like
+// "<newest seq>.<seq>.<seq>"; an old-style "<seq>" still works.
+type liveCursor struct {
+	Since int64
+	Seen  map[int64]bool // What was sent, out of (Since-kLiveRescan, Since]
+}
+
+func newLiveCursor(since int64) liveCursor {
+	return liveCursor{Since: since, Seen: map[int64]bool{since: true}}
+}
+
+func parseLiveCursor(s string) (liveCursor, error) {
+	cur := newLiveCursor(0)
+	for i,part := range strings.Split(s, ".") {
+		seq,err := strconv.ParseInt(part, 10, 64)
+		if err != nil { return cur, err }
+		if i == 0 { cur = newLiveCursor(seq) }
+		cur.Seen[seq] = true
+	}
+	cur.forget()
+	return cur, nil
+}
+
+func (cur liveCursor)WindowStart() int64 { return cur.Since - int64(kLiveRescan) }
+
+func (cur *liveCursor)Add(seq int64) {
+	cur.Seen[seq] = true
+	if seq > cur.Since { cur.Since = seq }
+	cur.forget()
+}
+
+// Drops the seen events that have fallen out of the window (or are nonsense).
+func (cur *liveCursor)forget() {
+	for seq,_ := range cur.Seen {
+		if seq <= cur.WindowStart() || seq > cur.Since { delete(cur.Seen, seq) }
+	}
+}
+
+func (cur liveCursor)String() string {
+	rest := []string{}
+	for seq,_ := range cur.Seen {
+		if seq != cur.Since { rest = append(rest, strconv.FormatInt(seq, 10)) }
+	}
+	sort.Strings(rest)
+	return strings.Join(append([]string{strconv.FormatInt(cur.Since, 10)}, rest...), ".")
+}
+
+// }}}
+// {{{ liveStreamHandler
+
+func liveStreamHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+	deadline := time.Now().Add(kLiveHoldTime)
+
+	f,err := liveFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Carry on from where the client got to; else start from (just before) now
+	cur := newLiveCursor(time.Now().UnixNano())
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" { lastID = r.FormValue("since") }
+	if lastID != "" {
+		if cur,err = parseLiveCursor(lastID); err != nil {
+			http.Error(w, "bad Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // It's all anonymous
+	fmt.Fprintf(w, "retry: 1000\n\n")
+
+	for {
+		if latest := cdb.LatestLiveEventSeq(); latest == 0 || latest > cur.WindowStart() {
+			// Ask for enough to get past the ones that have already been sent
+			events,err := cdb.GetLiveEventsSince(cur.WindowStart(), kLiveMaxEvents + len(cur.Seen))
+			if err != nil {
+				c.Errorf("live/stream: %v", err)
+				return
+			}
+
+			sent,fresh := 0,0
+			for _,le := range events {
+				if cur.Seen[le.Seq] { continue }
+				cur.Add(le.Seq)
+				fresh++
+				e := le.Event()
+				if !f.Matches(e) { continue }
+				b,_ := json.Marshal(e)
+				fmt.Fprintf(w, "id: %s\ndata: %s\n\n", cur, b)
+				sent++
+			}
+			if sent > 0 { return }
+			if fresh > 0 {
+				// Nothing the client wanted; just move its Last-Event-ID along
+				fmt.Fprintf(w, "id: %s\n\n", cur)
+			}
+		}
+
+		if time.Now().After(deadline) { return }
+		time.Sleep(kLivePollInterval)
+	}
+}
+
+// }}}
+// {{{ pruneLiveEventsHandler
+
+func pruneLiveEventsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	n,err := cdb.PruneLiveEvents()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(fmt.Sprintf("OK, pruned %d\n", n)))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,214 @@
+package complaints
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/mailer"
+	"github.com/skypies/complaints/sessions"
+	"github.com/skypies/complaints/signing"
+)
+
+// Logging in without Google or Facebook: we email a link, and following it logs you in. Links
+// are signed, expire, and can only be used once; and we limit how many get sent, per address
+// and per IP address, so the form can't be used to flood someone's inbox.
+
+const (
+	kLoginLinkTTL = 20 * time.Minute
+	kLoginLinkLimitPerAddress = 5
+	kLoginLinkLimitPerIP = 20
+	kLoginLinkLimitWindow = time.Hour
+	kLoginLinkKeepFor = 7 * 24 * time.Hour
+)
+
+func init() {
+	http.HandleFunc("/login/email", loginEmailHandler)
+	// Else another site could log people in as someone else (e.g. with its own link)
+	http.HandleFunc("/login/email/verify", sessions.ProtectCSRF(loginEmailVerifyHandler))
+	http.HandleFunc("/task/prune-login-links", pruneLoginLinksHandler)
+}
+
+// {{{ loginLinkURL
+
+func loginLinkURL(email, token string, expires time.Time) string {
+	x := strconv.FormatInt(expires.Unix(), 10)
+	v := url.Values{}
+	v.Set("e", email)
+	v.Set("x", x)
+	v.Set("t", token)
+	v.Set("s", signing.Sign("login", email, x, token))
+	return siteURL() + "/login/email/verify?" + v.Encode()
+}
+
+// }}}
+// {{{ sendLoginLink
+
+// Returns an error only for things the user can do something about; everything else is
+// logged, so the page doesn't give away whether the address has an account.
+func sendLoginLink(r *http.Request, email string) error {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+	ip := r.RemoteAddr
+
+	// The address goes into the signed link, and from there into the session; so however it
+	// was typed, it has to match the one on the profile.
+	email = loginAddress(email)
+
+	for _,key := range []string{"login-email:" + email, "login-ip:" + ip} {
+		limit := kLoginLinkLimitPerAddress
+		if strings.HasPrefix(key, "login-ip:") { limit = kLoginLinkLimitPerIP }
+		if ok,err := cdb.UnderRateLimit(key, limit, kLoginLinkLimitWindow); err != nil {
+			c.Errorf("login-email: rate limit %s: %v", key, err)
+		} else if !ok {
+			c.Infof("login-email: rate limited: %s", key)
+			return fmt.Errorf("Too many login emails have been asked for; please try again later")
+		}
+	}
+
+	if suppressed,err := cdb.GetSuppressedAddresses(); err != nil {
+		c.Errorf("login-email: GetSuppressedAddresses: %v", err)
+	} else if suppressed[email] {
+		c.Infof("login-email: <%s> is suppressed (bounced or complained)", email)
+		return nil
+	}
+
+	token,expires,err := cdb.CreateLoginLink(email, ip, kLoginLinkTTL)
+	if err != nil {
+		c.Errorf("login-email: CreateLoginLink <%s>: %v", email, err)
+		return nil
+	}
+
+	if err := mailLoginLink(mailer.New(c), email, token, expires); err != nil {
+		c.Errorf("login-email: send to <%s>: %v", email, err)
+	}
+	return nil
+}
+
+// }}}
+// {{{ loginAddress
+
+// Profiles are keyed by the exact address, so a login link has to use one form of it; the
+// same lowercased one that Google and most other providers hand back.
+func loginAddress(s string) string { return strings.ToLower(strings.TrimSpace(s)) }
+
+// }}}
+// {{{ mailLoginLink
+
+func mailLoginLink(m mailer.Mailer, email, token string, expires time.Time) error {
+	msg := &mailer.Message{
+		Sender:  kSenderEmail,
+		To:      []string{email},
+		Subject: "Your login link for stop.jetnoise.net",
+	}
+	params := map[string]interface{}{
+		"URL": loginLinkURL(email, token, expires),
+		"Expires": expires,
+	}
+	if err := renderEmail(msg, "email-login-link", params); err != nil {
+		return err
+	}
+	return m.Send(msg)
+}
+
+// }}}
+
+// {{{ loginEmailHandler
+
+// GET shows the form; POST (e) sends the link.
+func loginEmailHandler(w http.ResponseWriter, r *http.Request) {
+	params := map[string]interface{}{"Message": r.FormValue("msg")}
+
+	if r.Method == "POST" {
+		addr,err := mail.ParseAddress(strings.TrimSpace(r.FormValue("e")))
+		if err != nil {
+			params["Message"] = "That doesn't look like an email address"
+		} else if err := sendLoginLink(r, addr.Address); err != nil {
+			params["Message"] = err.Error()
+		} else {
+			params["Sent"] = addr.Address
+			params["TTL"] = int(kLoginLinkTTL.Minutes())
+		}
+	}
+
+	if err := templates.ExecuteTemplate(w, "login-email", params); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// }}}
+// {{{ loginEmailVerifyHandler
+
+// GET shows a button (link scanners follow GETs, so they mustn't use up the link); POST
+// logs in.
+func loginEmailVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	email,x,token,sig := r.FormValue("e"), r.FormValue("x"), r.FormValue("t"), r.FormValue("s")
+
+	expires,_ := strconv.ParseInt(x, 10, 64)
+	if !signing.Verify(sig, "login", email, x, token) {
+		http.Error(w, "This link is not valid.", http.StatusForbidden)
+		return
+	} else if time.Now().After(time.Unix(expires, 0)) {
+		http.Redirect(w, r, "/login/email?msg="+url.QueryEscape("That link has expired; "+
+			"please ask for another one"), http.StatusFound)
+		return
+	}
+
+	if r.Method != "POST" {
+		params := map[string]interface{}{"Confirm": true, "E": email, "X": x, "T": token, "S": sig,
+			"CSRFToken": sessions.CSRFToken(r, w)}
+		if err := templates.ExecuteTemplate(w, "login-email", params); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	cdb := complaintdb.ComplaintDB{C: c}
+	if err := cdb.UseLoginLink(email, token); err != nil {
+		c.Infof("login-email: <%s>: %v", email, err)
+		http.Redirect(w, r, "/login/email?msg="+url.QueryEscape("That link has already been "+
+			"used, or has expired; please ask for another one"), http.StatusFound)
+		return
+	}
+
+	session := sessions.Get(r)
+	sessions.StopImpersonation(session) // A real login ends any impersonation
+	session.Values["email"] = loginAddress(email) // Links sent before addresses were lowercased
+	sessions.ResetCSRF(session)
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// }}}
+// {{{ pruneLoginLinksHandler
+
+func pruneLoginLinksHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	n,err := cdb.PruneLoginLinks(time.Now().Add(-kLoginLinkKeepFor))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(fmt.Sprintf("OK, pruned %d\n", n)))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,51 @@
+package complaints
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/skypies/complaints/config"
+	"github.com/skypies/complaints/mailer"
+	"github.com/skypies/complaints/signing"
+)
+
+// However the address was typed, the emailed link (and so the session it logs into) has the
+// normalised one.
+func TestLoginLinkEmail(t *testing.T) {
+	config.Set("signing.secret", "test-secret")
+	dir,err := ioutil.TempDir("", "login-email")
+	if err != nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	spool := mailer.SpoolMailer{Dir: dir}
+
+	email := loginAddress("  Alice@Example.COM ")
+	if email != "alice@example.com" { t.Fatalf("loginAddress: got %q", email) }
+	if err := mailLoginLink(spool, email, "tok123", time.Now().Add(kLoginLinkTTL)); err != nil {
+		t.Fatalf("mailLoginLink: %v", err)
+	}
+
+	paths,err := spool.Spooled()
+	if err != nil || len(paths) != 1 { t.Fatalf("Spooled: %v, %v", paths, err) }
+	f,err := os.Open(paths[0])
+	if err != nil { t.Fatal(err) }
+	defer f.Close()
+	in,err := mailer.ParseInbound(f) // Undoes the quoted-printable
+	if err != nil { t.Fatalf("ParseInbound: %v", err) }
+	if got := in.Header.Get("X-Envelope-To"); got != "alice@example.com" {
+		t.Errorf("envelope: got %q", got)
+	}
+
+	m := regexp.MustCompile(`/login/email/verify\?\S+`).FindString(in.Text)
+	if m == "" { t.Fatalf("no link in:\n%s", in.Text) }
+	u,err := url.Parse(m)
+	if err != nil { t.Fatalf("link: %v", err) }
+	v := u.Query()
+	if v.Get("e") != "alice@example.com" { t.Errorf("link: e=%q", v.Get("e")) }
+	if !signing.Verify(v.Get("s"), "login", v.Get("e"), v.Get("x"), v.Get("t")) {
+		t.Errorf("link: signature doesn't verify")
+	}
+}
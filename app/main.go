@@ -6,10 +6,10 @@ import (
 	"html/template"
 	"net/http"
 	"regexp"
+	texttemplate "text/template"
 	"time"
 	
 	"appengine"
-	"appengine/user"
 
 	"github.com/skypies/util/date"
 	
@@ -17,6 +17,8 @@ import (
 	"github.com/skypies/complaints/complaintdb/types"
 	"github.com/skypies/complaints/fb"
 	"github.com/skypies/complaints/g"
+	oidcgae "github.com/skypies/complaints/oidc/gae"
+	"github.com/skypies/complaints/rbac"
 	"github.com/skypies/complaints/sessions"
 
 
@@ -29,13 +31,18 @@ import (
 )
 
 var (
-	templates = template.Must(template.New("").Funcs(template.FuncMap{
+	templateFuncs = map[string]interface{}{
 		"add": templateAdd,
 		"km2feet": templateKM2Feet,
 		"spacify": templateSpacifyFlightNumber,
 		"dict": templateDict,
 		"formatPdt": templateFormatPdt,
-	}).ParseGlob("templates/*"))
+	}
+	templates = template.Must(template.New("").Funcs(templateFuncs).ParseGlob("templates/*"))
+
+	// Plain text versions of the email templates, with the same names; see renderEmail
+	textTemplates = texttemplate.Must(texttemplate.New("").Funcs(templateFuncs).
+		ParseGlob("text-templates/*"))
 )
 func templateAdd(a int, b int) int { return a + b }
 func templateKM2Feet(x float64) float64 { return x * 3280.84 }
@@ -64,7 +71,6 @@ func init() {
 	http.HandleFunc("/logout", logoutHandler)
 	http.HandleFunc("/faq", faqHandler)
 	http.HandleFunc("/intro", gettingStartedHandler)
-	http.HandleFunc("/masq", masqueradeHandler)
 
 	http.HandleFunc("/report",                  makeRedirectHandler("/report/"))
 	http.HandleFunc("/zip",                     makeRedirectHandler("/report/zip"))
@@ -87,7 +93,7 @@ type HintedComplaint struct {
 	Omit bool
 }
 
-func hintComplaints(in []types.Complaint, isSuperHinter bool) []HintedComplaint {
+func hintComplaints(in []types.Complaint, cp types.ComplainerProfile, isSuperHinter bool) []HintedComplaint {
 	out := []HintedComplaint{}
 	
 	for _,c := range in {
@@ -108,6 +114,15 @@ func hintComplaints(in []types.Complaint, isSuperHinter bool) []HintedComplaint
 				hc.Notes = append(hc.Notes,fmt.Sprintf("Activity disturbed: %s", c.Activity))
 			}	
 		}
+		if c.DoNotSubmit {
+			hc.Notes = append(hc.Notes, "Will not be submitted")
+		} else if cp.IsHeldForReview(c) {
+			hc.Notes = append(hc.Notes, "Held for your review; use UPDATE to approve it")
+		}
+		for _,s := range c.Submissions {
+			hc.Notes = append(hc.Notes, fmt.Sprintf("Submitted to %s at %s", s.Airport,
+				date.InPdt(s.T).Format("15:04")))
+		}
 
 		out = append(out, hc)
 	}
@@ -127,10 +142,11 @@ func rootHandler (w http.ResponseWriter, r *http.Request) {
 	if session.Values["email"] == nil {
 		fb.AppId = kFacebookAppId
 		fb.AppSecret = kFacebookAppSecret
-		loginUrls := map[string]string{
+		loginUrls := map[string]interface{}{
 			"googlefromscratch": g.GetLoginUrl(r, true),
 			"google": g.GetLoginUrl(r, false),
 			"facebook": fb.GetLoginUrl(r),
+			"oidc": oidcgae.LoginLinks(),
 		}
 
 		if err := templates.ExecuteTemplate(w, "landing", loginUrls); err != nil {
@@ -139,6 +155,8 @@ func rootHandler (w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !masqCheck(w, r, false) { return }
+
 	modes := map[string]bool{}
 
 	// The rootHandler is the URL wildcard. Except Fragments, which are broken.
@@ -165,8 +183,9 @@ func rootHandler (w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	modes["admin"] = user.Current(c)!=nil && user.Current(c).Admin
-	modes["superuser"] = modes["admin"] || cap.Profile.EmailAddress == "meekGee@gmail.com"
+	roles := rbac.Roles(r)
+	modes["admin"] = rbac.HasRole(roles, complaintdb.RoleAdmin)
+	modes["superuser"] = rbac.HasRole(roles, complaintdb.RoleAnalyst, complaintdb.RoleCommunityLead)
 
 	// Default to "", unless we had a complaint in the past hour.
 	lastActivity := ""
@@ -179,6 +198,7 @@ func rootHandler (w http.ResponseWriter, r *http.Request) {
 		"DefaultActivity": lastActivity,
 		"DefaultLoudness": 1,
 		"NewForm": true,
+		"CSRFToken": sessions.CSRFToken(r, w),
 	}
 
 	message := ""
@@ -198,11 +218,12 @@ func rootHandler (w http.ResponseWriter, r *http.Request) {
 	var params = map[string]interface{}{
 		//"Message": template.HTML("Hi!"),
 		"Cap": *cap,
-		"Complaints": hintComplaints(cap.Complaints, modes["superuser"]),
+		"Complaints": hintComplaints(cap.Complaints, cap.Profile, modes["superuser"]),
 		"Now": date.NowInPdt(),
 		"Modes": modes,
 		"ComplaintDefaults": complaintDefaults,
 		"Message": template.HTML(message),
+		"CSRFToken": complaintDefaults["CSRFToken"],
 	}
 	
 	if err := templates.ExecuteTemplate(w, "main", params); err != nil {
@@ -216,29 +237,13 @@ func rootHandler (w http.ResponseWriter, r *http.Request) {
 
 func logoutHandler (w http.ResponseWriter, r *http.Request) {
 	session := sessions.Get(r)
-	session.Values["email"] = nil
-	session.Save(r, w)	
-	http.Redirect(w, r, "/", http.StatusFound)
-}
-
-// }}}
-// {{{ masqueradeHandler
-
-func masqueradeHandler (w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	email := r.FormValue("e")
-	if email == "" {
-		http.Error(w, "masq needs 'e'", http.StatusInternalServerError)
+	if sessions.GetImpersonation(session) != nil {
+		http.Redirect(w, r, "/masq/exit", http.StatusFound)
 		return
 	}
-
-	c.Infof("masq into [%s]", email)
-
-	session := sessions.Get(r)
-	session.Values["email"] = email
-	session.Save(r,w)
-	
+	if err := sessions.End(r, w); err != nil {
+		appengine.NewContext(r).Errorf("logout: %v", err)
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
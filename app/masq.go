@@ -0,0 +1,240 @@
+package complaints
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/user"
+
+	"github.com/skypies/util/date"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/rbac"
+	"github.com/skypies/complaints/sessions"
+)
+
+// Admins can look at the site as another user, to help them out. Impersonation is time-boxed,
+// read-only unless the admin asks otherwise, and shows a banner (with a way out) on every
+// page. Each one is logged as a complaintdb.Impersonation, with an event for every page the
+// admin looks at or change they make; see masqCheck, which handlers call for that.
+
+const (
+	kMasqDefaultDuration = 30 * time.Minute
+	kMasqMaxDuration = 2 * time.Hour
+	kMasqBannerCookie = "masq" // Only tells the header to show the banner; the session is what counts
+	kMasqLogSize = 100
+)
+
+func init() {
+	http.HandleFunc("/masq", rbac.Require(oldMasqHandler, complaintdb.RoleAdmin))
+	http.HandleFunc("/masq/exit", masqExitHandler)
+	http.HandleFunc("/admin/masq", rbac.Require(sessions.ProtectCSRF(masqHandler), complaintdb.RoleAdmin))
+}
+
+// {{{ masqCheck
+
+// Handlers that use the session call this once they know who the user is; change says
+// whether the request is going to alter anything. For an impersonation, it logs the request,
+// and refuses changes unless the admin asked to be allowed them. If it returns false, it has
+// already responded.
+func masqCheck(w http.ResponseWriter, r *http.Request, change bool) bool {
+	imp := sessions.GetImpersonation(sessions.Get(r))
+	if imp == nil { return true }
+
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	// The admin has to still be logged in as themselves, too
+	if u := user.Current(c); u == nil || u.Email != imp.Admin || !rbac.Has(r, complaintdb.RoleAdmin) {
+		c.Errorf("masq: session for <%s> as <%s>, but current user is %v", imp.Admin, imp.Email, u)
+		http.Error(w, "This impersonation session isn't yours; go to /masq/exit", http.StatusForbidden)
+		return false
+	}
+
+	ev := complaintdb.ImpersonationEvent{
+		Time: time.Now(),
+		Method: r.Method,
+		Path: r.URL.RequestURI(),
+		Change: change,
+		Denied: change && !imp.Write,
+	}
+	if err := cdb.RecordImpersonationEvent(imp.AuditID, ev); err != nil {
+		c.Errorf("masq: audit %d: %v", imp.AuditID, err)
+	}
+
+	if ev.Denied {
+		http.Error(w, fmt.Sprintf("You're viewing as %s read-only, so can't change anything. "+
+			"Exit at /masq/exit, and start again allowing changes.", imp.Email), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// }}}
+// {{{ masqBanner
+
+// The text for the banner cookie; see the "masq-banner" template.
+func masqBanner(imp sessions.Impersonation) string {
+	mode := "read-only"
+	if imp.Write { mode = "CHANGES ALLOWED" }
+	return fmt.Sprintf("Viewing as %s (%s) until %s", imp.Email, mode,
+		date.InPdt(imp.Expires).Format("15:04"))
+}
+
+func setMasqBannerCookie(w http.ResponseWriter, text string, expires time.Time) {
+	maxAge := int(expires.Sub(time.Now()).Seconds())
+	if text == "" { maxAge = -1 }
+	http.SetCookie(w, &http.Cookie{
+		Name: kMasqBannerCookie,
+		Value: url.QueryEscape(text),
+		Path: "/",
+		Expires: expires,
+		MaxAge: maxAge,
+	})
+}
+
+// }}}
+
+// {{{ masqHandler
+
+// GET shows the form (?e= fills in the email), the recent impersonations, and with ?log=<id>
+// what happened in one of them. POST (e, reason, minutes, write) starts impersonating.
+func masqHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+	params := map[string]interface{}{
+		"Email": r.FormValue("e"),
+		"Message": r.FormValue("msg"),
+		"DefaultMinutes": int(kMasqDefaultDuration.Minutes()),
+		"MaxMinutes": int(kMasqMaxDuration.Minutes()),
+		"CSRFToken": sessions.CSRFToken(r, w),
+	}
+
+	if r.Method == "POST" {
+		if msg := startMasq(w, r); msg != "" {
+			params["Message"] = msg
+		} else {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+	}
+
+	if id,err := strconv.ParseInt(r.FormValue("log"), 10, 64); err == nil {
+		evs,err := cdb.GetImpersonationEvents(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		params["LogID"] = id
+		params["Events"] = evs
+	}
+
+	imps,err := cdb.GetImpersonations(kMasqLogSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	params["Impersonations"] = imps
+
+	if err := templates.ExecuteTemplate(w, "masq", params); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Returns a message for the admin if it didn't start.
+func startMasq(w http.ResponseWriter, r *http.Request) string {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+	session := sessions.Get(r)
+
+	email := strings.TrimSpace(r.FormValue("e"))
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if user.Current(c) == nil {
+		// The session is about to become someone else's, so we need another way to know who you are
+		return "Sign in with your Google account first"
+	} else if email == "" || reason == "" {
+		return "Say who to view the site as, and why"
+	} else if sessions.GetImpersonation(session) != nil {
+		return "You're already impersonating someone; exit that first"
+	}
+	if cp,err := cdb.GetProfileByEmailAddress(email); err != nil || cp == nil {
+		return fmt.Sprintf("No profile for %s", email)
+	}
+
+	d := kMasqDefaultDuration
+	if mins,err := strconv.Atoi(r.FormValue("minutes")); err == nil && mins > 0 {
+		d = time.Duration(mins) * time.Minute
+	}
+	if d > kMasqMaxDuration { d = kMasqMaxDuration }
+
+	imp := sessions.Impersonation{
+		Admin: user.Current(c).Email,
+		Email: email,
+		Expires: time.Now().Add(d),
+		Write: FormValueCheckbox(r, "write"),
+	}
+	id,err := cdb.CreateImpersonation(complaintdb.Impersonation{
+		Admin: imp.Admin,
+		EmailAddress: imp.Email,
+		Reason: reason,
+		Write: imp.Write,
+		Start: time.Now(),
+		Expires: imp.Expires,
+	})
+	if err != nil {
+		return err.Error()
+	}
+	imp.AuditID = id
+
+	c.Infof("masq: <%s> is viewing as <%s> (write=%v) for %s: %s", imp.Admin, email, imp.Write,
+		d, reason)
+	sessions.StartImpersonation(session, imp)
+	session.Save(r, w)
+	setMasqBannerCookie(w, masqBanner(imp), imp.Expires)
+	return ""
+}
+
+// }}}
+// {{{ oldMasqHandler
+
+// /masq?e= used to switch straight into the user; now it just fills in the form.
+func oldMasqHandler(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/admin/masq?e="+url.QueryEscape(r.FormValue("e")), http.StatusFound)
+}
+
+// }}}
+// {{{ masqExitHandler
+
+// Goes back to being the admin. An impersonation that has expired has already been dropped
+// by sessions.Get, so there's nothing to end; this just tidies up the cookies.
+func masqExitHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	session := sessions.Get(r)
+
+	if imp := sessions.StopImpersonation(session); imp != nil {
+		cdb := complaintdb.ComplaintDB{C: c}
+		if err := cdb.EndImpersonation(imp.AuditID); err != nil {
+			c.Errorf("masq: end %d: %v", imp.AuditID, err)
+		}
+		c.Infof("masq: <%s> stopped viewing as <%s>", imp.Admin, imp.Email)
+	}
+	session.Save(r, w)
+	setMasqBannerCookie(w, "", time.Now())
+
+	http.Redirect(w, r, "/admin/masq?msg="+url.QueryEscape("Back to being yourself"), http.StatusFound)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,153 @@
+package complaints
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/urlfetch"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/sessions"
+	"github.com/skypies/complaints/sms"
+)
+
+// Verifying the phone number on a profile. A new number isn't saved when the profile is; we
+// text it a code, and only once that's typed in on /profile/phone does the number go into the
+// profile (and so get to complain by text). See complaintdb/phoneverify.go.
+
+const (
+	kPhoneCodeTTL = 15 * time.Minute
+	kPhoneCodeLimitPerAddress = 5
+	kPhoneCodeLimitWindow = time.Hour
+	kPhoneCodeKeepFor = 24 * time.Hour
+)
+
+func init() {
+	http.HandleFunc("/profile/phone", sessions.ProtectCSRF(profilePhoneHandler))
+	http.HandleFunc("/task/prune-phone-verifications", prunePhoneVerificationsHandler)
+}
+
+// {{{ sendPhoneVerification
+
+func sendPhoneVerification(r *http.Request, email, phone string) error {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	p := sms.New()
+	if p == nil {
+		return fmt.Errorf("Sorry, we can't send text messages right now")
+	}
+
+	if ok,err := cdb.UnderRateLimit("phone-verify:"+strings.ToLower(email), kPhoneCodeLimitPerAddress,
+		kPhoneCodeLimitWindow); err != nil {
+		c.Errorf("phone: rate limit: %v", err)
+	} else if !ok {
+		return fmt.Errorf("Too many codes have been asked for; please try again later")
+	}
+
+	code,err := cdb.CreatePhoneVerification(email, phone, kPhoneCodeTTL)
+	if err != nil { return err }
+
+	text := fmt.Sprintf("Your stop.jetnoise.net code is %s. It works for the next %d minutes.",
+		code, int(kPhoneCodeTTL.Minutes()))
+	if err := p.Send(urlfetch.Client(c), phone, text); err != nil {
+		c.Errorf("phone: send to %s: %v", phone, err)
+		return fmt.Errorf("We couldn't send a text to %s; please check the number", phone)
+	}
+	c.Infof("phone: <%s> sent a code to %s", email, phone)
+	return nil
+}
+
+// }}}
+// {{{ profilePhoneHandler
+
+// GET shows the form for the code; POST (code) checks it, and saves the number.
+func profilePhoneHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	session := sessions.Get(r)
+	if session.Values["email"] == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	email := session.Values["email"].(string)
+	if !masqCheck(w, r, r.Method == "POST") { return }
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	params := map[string]interface{}{
+		"Message": r.FormValue("msg"),
+		"TTL": int(kPhoneCodeTTL.Minutes()),
+	}
+
+	if r.Method == "POST" {
+		phone,err := cdb.UsePhoneVerification(email, strings.TrimSpace(r.FormValue("code")))
+		if err != nil {
+			c.Infof("phone: <%s>: %v", email, err)
+			params["Message"] = "That code isn't right, or has expired"
+		} else if other,err := cdb.GetProfileByPhoneNumber(phone); err != nil {
+			c.Errorf("phone: lookup %s: %v", phone, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if other != nil && other.EmailAddress != email {
+			params["Message"] = "That phone number is already in use"
+		} else if cp,err := cdb.GetProfileByEmailAddress(email); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else {
+			cp.PhoneNumber = phone
+			if err := cdb.PutProfile(*cp); err != nil {
+				c.Errorf("phone: PutProfile: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			c.Infof("phone: <%s> verified %s", email, phone)
+			http.Redirect(w, r, "/profile?msg="+url.QueryEscape("Your phone number is verified"),
+				http.StatusFound)
+			return
+		}
+	}
+
+	v,err := cdb.GetPhoneVerification(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if v == nil || v.IsExpired() {
+		http.Redirect(w, r, "/profile?msg="+url.QueryEscape("There's no phone number waiting to be "+
+			"verified; enter it again to get a new code"), http.StatusFound)
+		return
+	}
+	params["PhoneNumber"] = v.PhoneNumber
+	params["CSRFToken"] = sessions.CSRFToken(r, w)
+
+	if err := templates.ExecuteTemplate(w, "profile-phone", params); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// }}}
+// {{{ prunePhoneVerificationsHandler
+
+func prunePhoneVerificationsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	n,err := cdb.PrunePhoneVerifications(time.Now().Add(-kPhoneCodeKeepFor))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(fmt.Sprintf("OK, pruned %d\n", n)))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -2,20 +2,24 @@ package complaints
 
 import (
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	
 	"appengine"
+	"appengine/datastore"
 
+	"github.com/skypies/complaints/bksv"
 	"github.com/skypies/complaints/complaintdb"
 	"github.com/skypies/complaints/complaintdb/types"
 	"github.com/skypies/complaints/sessions"
+	"github.com/skypies/complaints/sms"
 )
 //import "fmt"
 
 func init() {
 	http.HandleFunc("/profile", profileFormHandler)
-	http.HandleFunc("/profile-update", profileUpdateHandler)
+	http.HandleFunc("/profile-update", sessions.RequireCSRF(profileUpdateHandler))
 }
 
 // {{{ profileFormHandler
@@ -41,6 +45,7 @@ func profileFormHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	email := session.Values["email"].(string)
+	if !masqCheck(w, r, false) { return }
 
 	cdb := complaintdb.ComplaintDB{C: c}
 	cp, _ := cdb.GetProfileByEmailAddress(email)
@@ -51,11 +56,31 @@ func profileFormHandler(w http.ResponseWriter, r *http.Request) {
 		cp.CcSfo = true
 	}
 
+	// Default the review window to overnight, if it hasn't been set
+	if cp.ReviewFromHour == cp.ReviewToHour {
+		cp.ReviewFromHour, cp.ReviewToHour = 22, 7
+	}
+
+	selected := map[string]bool{}
+	for _,a := range bksv.SubmitAirports(*cp) { selected[a] = true }
+	airports := []map[string]interface{}{}
+	for _,a := range bksv.KnownAirports {
+		airports = append(airports, map[string]interface{}{
+			"Code": a.Code, "Name": a.Name, "Selected": selected[a.Code],
+		})
+	}
+
+	hours := []int{}
+	for i:=0; i<24; i++ { hours = append(hours, i) }
+
 	var params = map[string]interface{}{
 		"Profile": cp,
+		"Airports": airports,
+		"Hours": hours,
 		"MapsAPIKey": kGoogleMapsAPIKey, // For autocomplete & latlong goodness
 	}
 	params["Message"] = r.FormValue("msg")
+	params["CSRFToken"] = sessions.CSRFToken(r, w)
 	
 	if err := templates.ExecuteTemplate(w, "profile-edit", params); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -75,6 +100,7 @@ func profileUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	email := session.Values["email"].(string)
+	if !masqCheck(w, r, true) { return }
 
 	r.ParseForm()
 	
@@ -91,6 +117,13 @@ func profileUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	airports := []string{}
+	for _,a := range bksv.KnownAirports {
+		for _,code := range r.Form["SubmitAirports"] {
+			if code == a.Code { airports = append(airports, code) }
+		}
+	}
+
 	// Maybe make a call to fetch the elevation ??
 	// https://developers.google.com/maps/documentation/elevation/intro
 	
@@ -107,12 +140,49 @@ func profileUpdateHandler(w http.ResponseWriter, r *http.Request) {
 			Zip: r.FormValue("AddrZip"),
 			Country: r.FormValue("AddrCountry"),
 		},
-		CcSfo: true, //FormValueCheckbox(r, "CcSfo"),
+		CcSfo: len(airports) > 0,
+		SubmitPromptly: FormValueCheckbox(r, "SubmitPromptly"),
+		SubmitAirports: airports,
+		HoldForReview: FormValueCheckbox(r, "HoldForReview"),
+		ReviewFromHour: formValueHour(r, "ReviewFromHour"),
+		ReviewToHour: formValueHour(r, "ReviewToHour"),
 		Lat: lat,
 		Long: long,
 	}
 	
 	cdb := complaintdb.ComplaintDB{C: c}
+
+	// Fields that aren't on this form are carried over from the stored profile; if we can't
+	// read it, saving would quietly reset them
+	if orig,err := cdb.GetProfileByEmailAddress(email); err == nil {
+		cp.DigestFrequency = orig.DigestFrequency
+		cp.NoAnnouncements = orig.NoAnnouncements
+		cp.PhoneNumber = orig.PhoneNumber
+	} else if err != datastore.ErrNoSuchEntity {
+		c.Errorf("profileUpdate: GetProfileByEmailAddress <%s>: %v", email, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A number can be removed straight away, but a new one has to be verified first (see
+	// phone.go); until then, the profile keeps the old one.
+	newPhone := ""
+	if phone := strings.TrimSpace(r.FormValue("PhoneNumber")); phone == "" {
+		cp.PhoneNumber = ""
+	} else if newPhone,err = sms.NormalizePhone(phone); err != nil {
+		http.Redirect(w, r, "/profile?msg="+url.QueryEscape(err.Error()), http.StatusFound)
+		return
+	} else if newPhone == cp.PhoneNumber {
+		newPhone = ""
+	} else if other,err := cdb.GetProfileByPhoneNumber(newPhone); err != nil {
+		c.Errorf("profileUpdate: lookup %s: %v", newPhone, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if other != nil && other.EmailAddress != email {
+		http.Redirect(w, r, "/profile?msg="+url.QueryEscape("That phone number is already in use"), http.StatusFound)
+		return
+	}
+
 	err = cdb.PutProfile(cp)
 	if err != nil {
 		c.Errorf("profileUpdate: cdb.Put: %v", err)
@@ -120,11 +190,30 @@ func profileUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if newPhone != "" {
+		if err := sendPhoneVerification(r, email, newPhone); err != nil {
+			http.Redirect(w, r, "/profile?msg="+url.QueryEscape(err.Error()), http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/profile/phone", http.StatusFound)
+		return
+	}
+
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 // }}}
 
+// {{{ formValueHour
+
+func formValueHour(r *http.Request, name string) int {
+	h := int(FormValueInt64(r, name))
+	if h < 0 || h > 23 { return 0 }
+	return h
+}
+
+// }}}
+
 // {{{ -------------------------={ E N D }=----------------------------------
 
 // Local variables:
@@ -0,0 +1,328 @@
+package complaints
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/taskqueue"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/mailer"
+	"github.com/skypies/complaints/sessions"
+	"github.com/skypies/complaints/signing"
+)
+
+// Moving an account to another email address (e.g. from a Facebook login to a Google one),
+// merging it into the account there if there is one. Someone logged in as the old address
+// asks; we email a link to the new address, and following it (while still logged in as the
+// old one) proves they have both. Then a task moves everything; see complaintdb/rekey.go.
+// The links reuse the emailed login links' records, so they are single use too.
+
+const (
+	kRekeyLinkTTL = time.Hour
+	kRekeyLimitPerAddress = 5
+	kRekeyLimitWindow = time.Hour
+	kRekeyBatchSize = 100
+)
+
+func init() {
+	http.HandleFunc("/account/email", sessions.ProtectCSRF(accountEmailHandler))
+	http.HandleFunc("/account/email/verify", sessions.ProtectCSRF(accountEmailVerifyHandler))
+	http.HandleFunc("/task/rekey-account", rekeyAccountTaskHandler)
+}
+
+// {{{ rekeyLinkURL
+
+func rekeyLinkURL(from, to, token string, expires time.Time) string {
+	x := strconv.FormatInt(expires.Unix(), 10)
+	v := url.Values{}
+	v.Set("from", from)
+	v.Set("to", to)
+	v.Set("x", x)
+	v.Set("t", token)
+	v.Set("s", signing.Sign("rekey", from, to, x, token))
+	return siteURL() + "/account/email/verify?" + v.Encode()
+}
+
+// }}}
+// {{{ accountEmailHandler
+
+// GET shows the form, and how any move is getting on; POST (to) emails the link.
+func accountEmailHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	session := sessions.Get(r)
+	if session.Values["email"] == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	from := session.Values["email"].(string)
+	if !masqCheck(w, r, r.Method == "POST") { return }
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	params := map[string]interface{}{
+		"Email": from,
+		"Message": r.FormValue("msg"),
+	}
+
+	if r.Method == "POST" {
+		// The new address gets normalised the same way as at login, since that's how it'll come back
+		if addr,err := mail.ParseAddress(strings.TrimSpace(r.FormValue("to"))); err != nil {
+			params["Message"] = "That doesn't look like an email address"
+		} else if to := loginAddress(addr.Address); to == loginAddress(from) {
+			params["Message"] = "That's the address you already have"
+		} else if err := sendRekeyLink(r, from, to); err != nil {
+			params["Message"] = err.Error()
+		} else {
+			params["Sent"] = to
+			params["TTL"] = int(kRekeyLinkTTL.Minutes())
+		}
+	}
+
+	rk,err := cdb.GetRekey(from)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	params["Rekey"] = rk
+	params["Moving"] = rk != nil && !rk.IsDone()
+	params["CSRFToken"] = sessions.CSRFToken(r, w)
+
+	if err := templates.ExecuteTemplate(w, "account-email", params); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// }}}
+// {{{ sendRekeyLink
+
+func sendRekeyLink(r *http.Request, from, to string) error {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	if ok,err := cdb.UnderRateLimit("rekey:"+strings.ToLower(from), kRekeyLimitPerAddress,
+		kRekeyLimitWindow); err != nil {
+		c.Errorf("rekey: rate limit: %v", err)
+	} else if !ok {
+		return fmt.Errorf("Too many emails have been asked for; please try again later")
+	}
+
+	token,expires,err := cdb.CreateLoginLink(to, r.RemoteAddr, kRekeyLinkTTL)
+	if err != nil { return err }
+
+	msg := &mailer.Message{
+		Sender:  kSenderEmail,
+		To:      []string{to},
+		Subject: "Confirm your new email address for stop.jetnoise.net",
+	}
+	params := map[string]interface{}{
+		"From": from,
+		"URL": rekeyLinkURL(from, to, token, expires),
+		"Expires": expires,
+	}
+	if err := renderEmail(msg, "email-rekey-link", params); err != nil {
+		return err
+	} else if err := mailer.New(c).Send(msg); err != nil {
+		return err
+	}
+	c.Infof("rekey: <%s> sent a link to <%s>", from, to)
+	return nil
+}
+
+// }}}
+// {{{ accountEmailVerifyHandler
+
+// GET shows a button (link scanners follow GETs); POST starts the move. Either way, they
+// have to be logged in as the old address.
+func accountEmailVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	from,to := r.FormValue("from"), r.FormValue("to")
+	x,token,sig := r.FormValue("x"), r.FormValue("t"), r.FormValue("s")
+
+	expires,_ := strconv.ParseInt(x, 10, 64)
+	if !signing.Verify(sig, "rekey", from, to, x, token) {
+		http.Error(w, "This link is not valid.", http.StatusForbidden)
+		return
+	} else if time.Now().After(time.Unix(expires, 0)) {
+		http.Redirect(w, r, "/account/email?msg="+url.QueryEscape("That link has expired; "+
+			"please ask for another one"), http.StatusFound)
+		return
+	}
+
+	session := sessions.Get(r)
+	if email,_ := session.Values["email"].(string); email != from {
+		http.Redirect(w, r, "/?msg="+url.QueryEscape("Please log in as "+from+", and then "+
+			"follow the link in the email again"), http.StatusFound)
+		return
+	}
+	if !masqCheck(w, r, r.Method == "POST") { return }
+
+	if r.Method != "POST" {
+		params := map[string]interface{}{
+			"Email": from,
+			"Confirm": true,
+			"To": to, "X": x, "T": token, "S": sig,
+			"CSRFToken": sessions.CSRFToken(r, w),
+		}
+		if err := templates.ExecuteTemplate(w, "account-email", params); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	cdb := complaintdb.ComplaintDB{C: c}
+	if err := cdb.UseLoginLink(to, token); err != nil {
+		c.Infof("rekey: <%s> -> <%s>: %v", from, to, err)
+		http.Redirect(w, r, "/account/email?msg="+url.QueryEscape("That link has already been "+
+			"used, or has expired; please ask for another one"), http.StatusFound)
+		return
+	}
+
+	for _,email := range []string{from, to} {
+		if d,err := cdb.GetAccountDeletion(email); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if d != nil && !d.IsDone() {
+			http.Redirect(w, r, "/account/email?msg="+url.QueryEscape(email+" is going to be "+
+				"deleted; cancel that first"), http.StatusFound)
+			return
+		}
+	}
+
+	if _,err := cdb.CreateRekey(from, to); err != nil {
+		http.Redirect(w, r, "/account/email?msg="+url.QueryEscape(err.Error()), http.StatusFound)
+		return
+	} else if err := enqueueRekey(c, from); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.Infof("rekey: <%s> -> <%s> started", from, to)
+	http.Redirect(w, r, "/account/email", http.StatusFound)
+}
+
+// }}}
+
+// {{{ enqueueRekey
+
+func enqueueRekey(c appengine.Context, from string) error {
+	t := taskqueue.NewPOSTTask("/task/rekey-account", map[string][]string{"from": {from}})
+	_,err := taskqueue.Add(c, t, "")
+	return err
+}
+
+// }}}
+// {{{ rekeyAccountTaskHandler
+
+// First moves the profile and credentials, so nothing new gets filed under the old address;
+// then moves complaints in batches until it runs low on time, queueing itself up to carry
+// on; once there are none left, it tidies up. Every step is safe to rerun.
+func rekeyAccountTaskHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.Timeout(appengine.NewContext(r), 60*time.Second)
+	cdb := complaintdb.ComplaintDB{C: c}
+	from := r.FormValue("from")
+	deadline := time.Now().Add(kAccountTimeBudget)
+
+	rk,err := cdb.GetRekey(from)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if rk == nil || rk.IsDone() {
+		w.Write([]byte("OK, nothing to do\n"))
+		return
+	}
+
+	if !rk.IsStarted() {
+		if err := cdb.StartRekey(rk.From, rk.To); err != nil {
+			c.Errorf("rekey <%s>: %v", from, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rk.Started = time.Now()
+		if err := cdb.PutRekey(*rk); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	for {
+		n,err := cdb.MoveComplaints(rk.From, rk.To, kRekeyBatchSize)
+		if err != nil {
+			c.Errorf("rekey <%s>: %v", from, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rk.Moved += n
+		if n == 0 { break }
+
+		if time.Now().After(deadline) {
+			if err := cdb.PutRekey(*rk); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			} else if err := enqueueRekey(c, from); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			c.Infof("rekey <%s>: %d complaints moved so far", from, rk.Moved)
+			w.Write([]byte("OK, more to do\n"))
+			return
+		}
+	}
+
+	if err := cdb.FinishRekey(rk.From, rk.To); err != nil {
+		c.Errorf("rekey <%s>: %v", from, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Anything filed by a request that was already under way when the credentials moved
+	if n,err := cdb.MoveComplaints(rk.From, rk.To, kRekeyBatchSize); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if n > 0 {
+		rk.Moved += n
+		if err := cdb.PutRekey(*rk); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if err := enqueueRekey(c, from); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("OK, more turned up\n"))
+		return
+	}
+	rk.Done = time.Now()
+	if err := cdb.PutRekey(*rk); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	msg := &mailer.Message{
+		Sender:  kSenderEmail,
+		To:      []string{rk.From, rk.To},
+		Subject: "Your stop.jetnoise.net account has moved",
+	}
+	params := map[string]interface{}{"From": rk.From, "To": rk.To, "Moved": rk.Moved}
+	if err := renderEmail(msg, "email-rekey-done", params); err != nil {
+		c.Errorf("rekey <%s>: renderEmail: %v", from, err)
+	} else if err := mailer.New(c).Send(msg); err != nil {
+		c.Errorf("rekey <%s>: send: %v", from, err)
+	}
+
+	c.Infof("rekey <%s>: done; %d complaints moved to <%s>", from, rk.Moved, rk.To)
+	w.Write([]byte("OK, done\n"))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,73 @@
+package complaints
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"appengine"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/rbac"
+	"github.com/skypies/complaints/sessions"
+)
+
+// The page where admins grant roles; see the rbac package for what they let people do.
+
+func init() {
+	http.HandleFunc("/admin/roles", rbac.Require(sessions.ProtectCSRF(rolesHandler), complaintdb.RoleAdmin))
+}
+
+// {{{ rolesHandler
+
+// GET lists everyone with a role; POST (e, role) sets someone's roles, where no roles at all
+// takes them all away.
+func rolesHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+	message := r.FormValue("msg")
+
+	if r.Method == "POST" {
+		r.ParseForm()
+		email := strings.TrimSpace(r.FormValue("e"))
+		me := rbac.Identify(r)
+
+		if email == "" {
+			message = "Whose roles ?"
+		} else if email == me && !rbac.HasRole(r.Form["role"], complaintdb.RoleAdmin) {
+			message = "You can't take away your own admin role"
+		} else if err := cdb.SetRoles(email, r.Form["role"], me); err != nil {
+			message = err.Error()
+		} else {
+			c.Infof("roles: <%s> gave <%s> %v", me, email, r.Form["role"])
+			http.Redirect(w, r, "/admin/roles?msg="+url.QueryEscape("Updated "+email), http.StatusFound)
+			return
+		}
+	}
+
+	grants,err := cdb.GetRoleGrants()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	params := map[string]interface{}{
+		"Grants": grants,
+		"Roles": complaintdb.GrantableRoles,
+		"Message": message,
+		"CSRFToken": sessions.CSRFToken(r, w),
+	}
+	if err := templates.ExecuteTemplate(w, "roles", params); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
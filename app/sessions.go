@@ -0,0 +1,127 @@
+package complaints
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/rbac"
+	"github.com/skypies/complaints/sessions"
+)
+
+// Users can see where they're logged in, and log out any of those sessions; admins can log
+// someone out everywhere (e.g. if their account has been taken over).
+
+func init() {
+	http.HandleFunc("/sessions", sessions.ProtectCSRF(sessionsHandler))
+	http.HandleFunc("/admin/sessions",
+		rbac.Require(sessions.ProtectCSRF(sessionsHandler), complaintdb.RoleAdmin))
+	http.HandleFunc("/task/prune-sessions", pruneSessionsHandler)
+}
+
+// {{{ sessionsHandler
+
+// GET lists the sessions. On /sessions, POST with action=revoke (k) ends one of the user's
+// sessions, and action=others ends all but this one. On /admin/sessions, ?e= picks the user,
+// and POST with action=all ends all of their sessions.
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	// init makes sure only admins get to /admin/sessions
+	session := sessions.Get(r)
+	email,self := strings.TrimSpace(r.FormValue("e")),r.URL.Path
+	if self != "/admin/sessions" {
+		if session.Values["email"] == nil {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		email = session.Values["email"].(string)
+		if !masqCheck(w, r, r.Method == "POST") { return }
+	}
+	current := sessions.Key(session)
+
+	list := []complaintdb.Session{}
+	if email != "" {
+		var err error
+		if list,err = cdb.GetSessionsByEmailAddress(email); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if r.Method == "POST" {
+		keys := []string{}
+		for _,s := range list {
+			switch r.FormValue("action") {
+			case "revoke":
+				if s.Key == r.FormValue("k") { keys = append(keys, s.Key) }
+			case "others":
+				if s.Key != current { keys = append(keys, s.Key) }
+			case "all":
+				if self == "/admin/sessions" { keys = append(keys, s.Key) }
+			}
+		}
+		if err := cdb.DeleteSessions(keys); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c.Infof("sessions: <%s> ended %d of <%s>'s sessions", rbac.Identify(r), len(keys), email)
+
+		redir := self + "?msg=" + url.QueryEscape(fmt.Sprintf("Logged out %d session(s)", len(keys)))
+		if self == "/admin/sessions" {
+			redir += "&e=" + url.QueryEscape(email)
+		}
+		for _,k := range keys {
+			if k == current {
+				sessions.End(r, w) // They logged themselves out
+				redir = "/"
+			}
+		}
+		http.Redirect(w, r, redir, http.StatusFound)
+		return
+	}
+
+	params := map[string]interface{}{
+		"Self": self,
+		"Admin": self == "/admin/sessions",
+		"Email": email,
+		"Sessions": list,
+		"Current": current,
+		"Message": r.FormValue("msg"),
+		"CSRFToken": sessions.CSRFToken(r, w),
+	}
+	if err := templates.ExecuteTemplate(w, "sessions", params); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// }}}
+// {{{ pruneSessionsHandler
+
+func pruneSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	n,err := cdb.PruneSessions(time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(fmt.Sprintf("OK, pruned %d\n", n)))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
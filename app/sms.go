@@ -0,0 +1,182 @@
+package complaints
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/skypies/util/date"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/sms"
+)
+
+// Complaints by text message, and by phone. The user is found by the phone number on their
+// profile; the provider (see the sms package) is picked in config.
+
+const kSMSHelp = "Text LOUD, VERY LOUD or TOO LOUD (or 1, 2, 3) when a plane bothers you; " +
+	"add SPEEDBRAKES if you heard them. Anything else you write is kept as a note."
+
+// Messages made only of these words don't need keeping as a note
+var kSMSKeywordsOnlyRegexp = regexp.MustCompile(`(?i)^(\s|[,.!+&]|\band\b|\b[123]\b|` +
+	`\b(very|too|insanely|incredibly|extremely)\b|\bloud\b|\bspeed ?bra(k|ke)s?\b|\bbrakes\b)*$`)
+
+func init() {
+	http.HandleFunc("/sms/inbound", smsInboundHandler)
+	http.HandleFunc("/voice/inbound", voiceInboundHandler)
+}
+
+// {{{ parseSMSComplaint
+
+// Texts are parsed like emails (see parseEmailComplaint), with a couple of extras: a bare
+// digit is a loudness, and texts that are just keywords don't become the description.
+func parseSMSComplaint(text string, sent time.Time) types.Complaint {
+	text = strings.TrimSpace(text)
+	c := parseEmailComplaint("", text, sent)
+
+	switch text {
+	case "1", "2", "3": c.Loudness = int(text[0] - '0')
+	}
+	if kSMSKeywordsOnlyRegexp.MatchString(text) { c.Description = "" }
+	return c
+}
+
+// }}}
+// {{{ describeComplaint
+
+// A one-liner about what we found overhead, short enough for a text message or to be read out.
+func describeComplaint(c types.Complaint) string {
+	t := date.InPdt(c.Timestamp).Format("3:04pm")
+	a := c.AircraftOverhead
+	if a.FlightNumber == "" {
+		return fmt.Sprintf("Complaint logged at %s, but we couldn't tell which flight it was.", t)
+	}
+
+	s := fmt.Sprintf("Complaint logged at %s: flight %s", t, a.FlightNumber)
+	if a.EquipType != "" { s += fmt.Sprintf(" (%s)", a.EquipType) }
+	if a.Origin != "" && a.Destination != "" { s += fmt.Sprintf(", %s to %s", a.Origin, a.Destination) }
+	if a.Altitude > 0 { s += fmt.Sprintf(", at %.0f feet", a.Altitude) }
+	return s + "."
+}
+
+// }}}
+// {{{ smsProfile
+
+// Sets up the provider, parses the request and finds the user. If it returns a nil profile,
+// it has already responded.
+func smsProfile(w http.ResponseWriter, r *http.Request, voice bool) (sms.Provider, *sms.Inbound, *types.ComplainerProfile) {
+	c := appengine.NewContext(r)
+	p := sms.New()
+	if p == nil {
+		http.Error(w, "not configured", http.StatusNotFound)
+		return nil, nil, nil
+	}
+
+	in,err := p.Parse(r)
+	if err != nil {
+		c.Errorf("sms: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, nil, nil
+	}
+
+	cdb := complaintdb.ComplaintDB{C: c}
+	cp,err := cdb.GetProfileByPhoneNumber(in.From)
+	if err != nil {
+		c.Errorf("sms: lookup %s: %v", in.From, err)
+	}
+	if cp == nil {
+		c.Infof("sms: unknown number %s", in.From)
+		replyUnknownNumber(p, w, voice)
+		return nil, nil, nil
+	}
+
+	return p, in, cp
+}
+
+func replyUnknownNumber(p sms.Provider, w http.ResponseWriter, voice bool) {
+	if voice {
+		p.Say(w, "Sorry, we don't recognise the number you're calling from. Please add it to " +
+			"your profile on the website.")
+	} else {
+		p.Reply(w, "We don't know this phone number. Add it to your profile at " + siteURL() +
+			"/profile")
+	}
+}
+
+// }}}
+// {{{ smsInboundHandler
+
+func smsInboundHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	p,in,cp := smsProfile(w, r, false)
+	if cp == nil { return }
+
+	if strings.EqualFold(strings.TrimSpace(in.Body), "help") {
+		p.Reply(w, kSMSHelp)
+		return
+	}
+
+	cdb := complaintdb.ComplaintDB{C: c}
+	complaint := parseSMSComplaint(in.Body, time.Now())
+	if err := cdb.ComplainByEmailAddress(cp.EmailAddress, &complaint); err != nil {
+		c.Errorf("sms: complain <%s>: %v", cp.EmailAddress, err)
+		p.Reply(w, "Sorry, something went wrong; please try again in a minute.")
+		return
+	}
+
+	p.Reply(w, describeComplaint(complaint))
+}
+
+// }}}
+// {{{ voiceInboundHandler
+
+// The first request of a call gets asked for a loudness; pressing a key brings the call back
+// here with Digits, which makes the complaint.
+func voiceInboundHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	p,in,cp := smsProfile(w, r, true)
+	if cp == nil { return }
+
+	complaint := types.Complaint{ Timestamp: time.Now() }
+	switch in.Digits {
+	case "":
+		p.Gather(w, "Press 1 if it's loud, 2 if it's very loud, or 3 if it's insanely loud.",
+			"/voice/inbound")
+		return
+	case "1", "2", "3":
+		complaint.Loudness = int(in.Digits[0] - '0')
+	default:
+		complaint.Loudness = 1
+	}
+
+	cdb := complaintdb.ComplaintDB{C: c}
+	if err := cdb.ComplainByEmailAddress(cp.EmailAddress, &complaint); err != nil {
+		c.Errorf("voice: complain <%s>: %v", cp.EmailAddress, err)
+		p.Say(w, "Sorry, something went wrong; please try again in a minute.")
+		return
+	}
+
+	p.Say(w, spacifyForSpeech(describeComplaint(complaint)) + " Thank you.")
+}
+
+// Read flight numbers out letter by letter ("U A 1 2 3"), rather than as words.
+func spacifyForSpeech(s string) string {
+	return regexp.MustCompile(`\b([A-Z]{2,3})(\d+)\b`).ReplaceAllStringFunc(s, func(fn string) string {
+		return strings.Join(strings.Split(fn, ""), " ")
+	})
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
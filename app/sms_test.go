@@ -0,0 +1,71 @@
+package complaints
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skypies/complaints/config"
+	"github.com/skypies/complaints/sms"
+)
+
+func TestParseSMSComplaint(t *testing.T) {
+	sent := time.Date(2016, time.March, 14, 14, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		text     string
+		loudness int
+		brakes   bool
+		desc     string
+	}{
+		{"3", 3, false, ""},
+		{" 2 ", 2, false, ""},
+		{"loud", 1, false, ""},
+		{"very loud speedbrakes", 2, true, ""},
+		{"TOO LOUD and speed brakes!", 3, true, ""},
+		{"rattled the windows again", 1, false, "rattled the windows again"},
+		{"very loud, woke the baby", 2, false, "very loud, woke the baby"},
+	}
+
+	for _,test := range tests {
+		c := parseSMSComplaint(test.text, sent)
+		if !c.Timestamp.Equal(sent) { t.Errorf("%q: time: got %s", test.text, c.Timestamp) }
+		if c.Loudness != test.loudness { t.Errorf("%q: loudness: got %d", test.text, c.Loudness) }
+		if c.HeardSpeedbreaks != test.brakes { t.Errorf("%q: speedbrakes: got %v", test.text, c.HeardSpeedbreaks) }
+		if c.Description != test.desc { t.Errorf("%q: description: got %q", test.text, c.Description) }
+	}
+}
+
+// A text or call from a number that isn't on any profile, through the local provider
+func TestReplyUnknownNumber(t *testing.T) {
+	config.Set("site.url", "https://stop.jetnoise.net")
+	p := sms.LocalProvider{}
+
+	for _,test := range []struct {
+		voice bool
+		want  string
+	}{
+		{false, "SMS: We don't know this phone number. Add it to your profile at " +
+			"https://stop.jetnoise.net/profile\n"},
+		{true, "SAY: Sorry, we don't recognise the number you're calling from. Please add it " +
+			"to your profile on the website.\n"},
+	} {
+		form := url.Values{"from": {"(650) 555-1234"}, "body": {"very loud"}}
+		r,err := http.NewRequest("POST", "/sms/inbound", strings.NewReader(form.Encode()))
+		if err != nil { t.Fatal(err) }
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		in,err := p.Parse(r)
+		if err != nil { t.Fatalf("Parse: %v", err) }
+		if in.From != "+16505551234" || in.Body != "very loud" { t.Errorf("Parse: got %+v", in) }
+
+		w := httptest.NewRecorder()
+		replyUnknownNumber(p, w, test.voice)
+		if got := w.Body.String(); got != test.want {
+			t.Errorf("voice=%v: got %q, wanted %q", test.voice, got, test.want)
+		}
+	}
+}
@@ -6,11 +6,12 @@ import (
 	"appengine"
 
 	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/rbac"
 )
 
 func init() {
 	http.HandleFunc("/stats", statsHandler)
-	http.HandleFunc("/stats-reset", statsResetHandler)
+	http.HandleFunc("/stats-reset", rbac.Require(statsResetHandler, complaintdb.RoleAdmin))
 }
 
 // {{{ statsResetHandler
@@ -0,0 +1,124 @@
+package complaints
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"appengine"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/sessions"
+)
+
+// Users can make personal access tokens for the API, and for buttons; each has a name (so
+// they can remember which gizmo it went into) and some scopes (see complaintdb.Scope*).
+
+func init() {
+	http.HandleFunc("/tokens", sessions.ProtectCSRF(tokensHandler))
+}
+
+// {{{ requestToken
+
+// Pulls an access token out of the "Authorization: Bearer" header. Tokens in URLs end up in
+// logs and Referer headers, so params aren't looked at. Returns "" if there isn't one.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return ""
+}
+
+// }}}
+// {{{ tokenUser
+
+// Looks up the token in the request, and checks it has the scope. Returns the owner's email
+// address; or "" and an HTTP status if there was no token, or it wasn't good enough.
+func tokenUser(c appengine.Context, r *http.Request, scope string) (string, int) {
+	token := requestToken(r)
+	if token == "" { return "", http.StatusUnauthorized }
+
+	cdb := complaintdb.ComplaintDB{C: c}
+	t,err := cdb.LookupAccessToken(token)
+	if err != nil {
+		c.Infof("tokenUser: lookup: %v", err)
+		return "", http.StatusUnauthorized
+	} else if !t.HasScope(scope) {
+		c.Infof("tokenUser: token %s (%s) lacks scope %s", t.Hint, t.EmailAddress, scope)
+		return "", http.StatusForbidden
+	}
+	return t.EmailAddress, http.StatusOK
+}
+
+// }}}
+
+// {{{ tokensHandler
+
+// GET lists the user's tokens; POST with action=create (name, scope) makes a new one, and
+// action=revoke (id) deletes one.
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	session := sessions.Get(r)
+	if session.Values["email"] == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	email := session.Values["email"].(string)
+	if !masqCheck(w, r, r.Method == "POST") { return }
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	newToken := ""
+	message := r.FormValue("msg")
+
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "create":
+			name := strings.TrimSpace(r.FormValue("name"))
+			if name == "" { name = "unnamed" }
+			token,err := cdb.CreateAccessToken(email, name, r.Form["scope"])
+			if err != nil {
+				message = err.Error()
+			} else {
+				newToken = token
+				c.Infof("created access token %q for %s", name, email)
+			}
+
+		case "revoke":
+			if err := cdb.RevokeAccessToken(email, r.FormValue("id")); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/tokens?msg="+url.QueryEscape("Token revoked"), http.StatusFound)
+			return
+		}
+	}
+
+	tokens,err := cdb.GetAccessTokens(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	params := map[string]interface{}{
+		"Email": email,
+		"Tokens": tokens,
+		"Scopes": complaintdb.AllScopes,
+		"NewToken": newToken,
+		"SiteURL": siteURL(),
+		"Message": message,
+		"CSRFToken": sessions.CSRFToken(r, w),
+	}
+	if err := templates.ExecuteTemplate(w, "tokens", params); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,211 @@
+package complaints
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"appengine"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/config"
+	"github.com/skypies/complaints/mailer"
+	"github.com/skypies/complaints/sessions"
+	"github.com/skypies/complaints/signing"
+)
+
+// Every email we send carries links that let the recipient unsubscribe, or change their
+// email preferences, without logging in. The links are signed, so they can't be forged
+// for someone else's address.
+
+// The kinds of email someone can unsubscribe from
+const (
+	kListDigest        = "digest"
+	kListAnnouncements = "announcements"
+	kListAll           = "all"
+)
+
+func init() {
+	http.HandleFunc("/unsubscribe", unsubscribeHandler)
+	http.HandleFunc("/email-preferences", emailPreferencesHandler)
+}
+
+// {{{ siteURL
+
+func siteURL() string {
+	if u := config.Get("site.url"); u != "" { return u }
+	return "https://stop.jetnoise.net"
+}
+
+// }}}
+// {{{ unsubscribeURL, preferencesURL
+
+func unsubscribeURL(email, list string) string {
+	v := url.Values{}
+	v.Set("e", email)
+	v.Set("l", list)
+	v.Set("s", signing.Sign("unsubscribe", email, list))
+	return siteURL() + "/unsubscribe?" + v.Encode()
+}
+
+func preferencesURL(email string) string {
+	v := url.Values{}
+	v.Set("e", email)
+	v.Set("s", signing.Sign("preferences", email))
+	return siteURL() + "/email-preferences?" + v.Encode()
+}
+
+// }}}
+// {{{ addListHeaders
+
+// Adds the RFC 2369 & RFC 8058 headers, so that mail clients can offer one-click unsubscribe.
+func addListHeaders(msg *mailer.Message, email, list string) {
+	if msg.Headers == nil { msg.Headers = map[string][]string{} }
+	msg.Headers["List-Unsubscribe"] = []string{"<" + unsubscribeURL(email, list) + ">"}
+	msg.Headers["List-Unsubscribe-Post"] = []string{"List-Unsubscribe=One-Click"}
+}
+
+// }}}
+
+// {{{ unsubscribe
+
+func unsubscribe(cp *types.ComplainerProfile, list string) {
+	switch list {
+	case kListDigest:
+		cp.DigestFrequency = types.DigestNone
+	case kListAnnouncements:
+		cp.NoAnnouncements = true
+	case kListAll:
+		cp.DigestFrequency = types.DigestNone
+		cp.NoAnnouncements = true
+	}
+}
+
+// }}}
+// {{{ unsubscribeHandler
+
+// GET shows a confirmation page (link scanners follow GETs, so they mustn't unsubscribe
+// anyone); POST does the unsubscribing. A POST from a mail client's one-click unsubscribe
+// gets a bare 200.
+func unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	email,list,sig := r.FormValue("e"), r.FormValue("l"), r.FormValue("s")
+
+	if !signing.Verify(sig, "unsubscribe", email, list) {
+		http.Error(w, "This unsubscribe link is not valid.", http.StatusForbidden)
+		return
+	}
+
+	params := map[string]interface{}{
+		"Email": email,
+		"List": list,
+		"Sig": sig,
+		"PreferencesURL": preferencesURL(email),
+	}
+
+	if r.Method == "POST" {
+		cdb := complaintdb.ComplaintDB{C: c}
+		cp,err := cdb.GetProfileByEmailAddress(email)
+		if err != nil {
+			c.Errorf("unsubscribe <%s>: %v", email, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		unsubscribe(cp, list)
+		if err := cdb.PutProfile(*cp); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c.Infof("unsubscribed <%s> from %s", email, list)
+
+		if r.FormValue("List-Unsubscribe") == "One-Click" {
+			w.Write([]byte("OK"))
+			return
+		}
+		params["Done"] = true
+	}
+
+	if err := templates.ExecuteTemplate(w, "email-unsubscribe", params); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// }}}
+// {{{ emailPreferencesHandler
+
+// Works from a signed link, or for a logged-in user.
+func emailPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	email,sig := r.FormValue("e"), r.FormValue("s")
+	csrfToken := "" // Signed links don't need one; the signature is proof enough
+
+	if email != "" {
+		if !signing.Verify(sig, "preferences", email) {
+			http.Error(w, "This link is not valid.", http.StatusForbidden)
+			return
+		}
+	} else if session := sessions.Get(r); session.Values["email"] != nil {
+		email = session.Values["email"].(string)
+		sig = ""
+		if !masqCheck(w, r, r.Method == "POST") { return }
+		if r.Method == "POST" && !sessions.CheckCSRF(r) {
+			http.Error(w, "Forbidden: bad or missing CSRF token", http.StatusForbidden)
+			return
+		}
+		csrfToken = sessions.CSRFToken(r, w)
+	} else {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	cdb := complaintdb.ComplaintDB{C: c}
+	cp,err := cdb.GetProfileByEmailAddress(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "POST" {
+		switch freq := r.FormValue("DigestFrequency"); freq {
+		case types.DigestNone, types.DigestDaily, types.DigestWeekly, types.DigestMonthly:
+			cp.DigestFrequency = freq
+		}
+		cp.NoAnnouncements = !FormValueCheckbox(r, "Announcements")
+		if err := cdb.PutProfile(*cp); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		redir := "/email-preferences?msg=Saved"
+		if sig != "" {
+			redir = fmt.Sprintf("%s&e=%s&s=%s", redir, url.QueryEscape(email), url.QueryEscape(sig))
+		}
+		http.Redirect(w, r, redir, http.StatusFound)
+		return
+	}
+
+	params := map[string]interface{}{
+		"Profile": cp,
+		"Digest": cp.Digest(),
+		"Frequencies": []string{types.DigestDaily, types.DigestWeekly, types.DigestMonthly,
+			types.DigestNone},
+		"Email": email,
+		"Sig": sig,
+		"Message": r.FormValue("msg"),
+		"CSRFToken": csrfToken,
+	}
+	if err := templates.ExecuteTemplate(w, "email-preferences", params); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -11,14 +11,17 @@ import(
 	oldfgae "github.com/skypies/flightdb/gae"
 	newfdb  "github.com/skypies/flightdb2"
 	newui   "github.com/skypies/flightdb2/ui"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/rbac"
 )
 
 func init() {
-	http.HandleFunc("/fdb/track2", v2TrackHandler)
-	http.HandleFunc("/fdb/trackset2", v2TracksetHandler)
-	http.HandleFunc("/fdb/approach2", v2ApproachHandler)
-	http.HandleFunc("/fdb/json2", v2JsonHandler)
-	http.HandleFunc("/fdb/map2", newui.MapHandler)
+	http.HandleFunc("/fdb/track2", rbac.Require(v2TrackHandler, complaintdb.RoleAnalyst))
+	http.HandleFunc("/fdb/trackset2", rbac.Require(v2TracksetHandler, complaintdb.RoleAnalyst))
+	http.HandleFunc("/fdb/approach2", rbac.Require(v2ApproachHandler, complaintdb.RoleAnalyst))
+	http.HandleFunc("/fdb/json2", rbac.Require(v2JsonHandler, complaintdb.RoleAnalyst))
+	http.HandleFunc("/fdb/map2", rbac.Require(newui.MapHandler, complaintdb.RoleAnalyst))
 }
 
 // Provides thin wrappers to do DB lookup & data model upgrade, and then passes over
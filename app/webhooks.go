@@ -0,0 +1,262 @@
+package complaints
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/urlfetch"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/rbac"
+	"github.com/skypies/complaints/sessions"
+	"github.com/skypies/complaints/webhook"
+)
+
+// Pages for managing webhooks, and the task that delivers events to them. Users manage their
+// own hooks on /webhooks; admins manage global hooks (that see everyone's complaints) on
+// /admin/webhooks.
+
+const (
+	kWebhookLogSize = 50
+	kWebhookLogKeepFor = 7 * 24 * time.Hour
+)
+
+func init() {
+	http.HandleFunc("/webhooks", sessions.ProtectCSRF(webhooksHandler))
+	http.HandleFunc("/admin/webhooks",
+		rbac.Require(sessions.ProtectCSRF(webhooksHandler), complaintdb.RoleAdmin))
+	http.HandleFunc("/task/deliver-webhook", deliverWebhookTaskHandler)
+	http.HandleFunc("/task/prune-webhook-deliveries", pruneWebhookDeliveriesHandler)
+}
+
+// {{{ webhooksHandler
+
+// GET lists the hooks, or with ?log=<id>, the recent deliveries for one. POST with
+// action=create (url, event) registers a new hook, and action=delete (id) removes one.
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	// init makes sure only admins get to /admin/webhooks
+	email,self := "",r.URL.Path
+	if self != "/admin/webhooks" {
+		session := sessions.Get(r)
+		if session.Values["email"] == nil {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		email = session.Values["email"].(string)
+		if !masqCheck(w, r, r.Method == "POST") { return }
+	}
+
+	var newHook *complaintdb.Webhook
+	message := r.FormValue("msg")
+
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "create":
+			u,err := checkWebhookURL(r.FormValue("url"), siteURL())
+			if err != nil {
+				message = err.Error()
+				break
+			}
+			if newHook,err = cdb.CreateWebhook(email, u, r.Form["event"]); err != nil {
+				message = err.Error()
+			}
+
+		case "delete":
+			id,_ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+			if err := cdb.DeleteWebhook(email, id); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, self+"?msg="+url.QueryEscape("Webhook removed"), http.StatusFound)
+			return
+		}
+	}
+
+	params := map[string]interface{}{
+		"Self": self,
+		"Email": email,
+		"Events": webhook.AllEvents,
+		"NewHook": newHook,
+		"Message": message,
+		"CSRFToken": sessions.CSRFToken(r, w),
+	}
+
+	if id,err := strconv.ParseInt(r.FormValue("log"), 10, 64); err == nil {
+		h,err := cdb.GetWebhook(id)
+		if err != nil || h.EmailAddress != email {
+			http.Error(w, "no such webhook", http.StatusNotFound)
+			return
+		}
+		deliveries,err := cdb.GetWebhookDeliveries(id, kWebhookLogSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		params["Hook"] = h
+		params["Deliveries"] = deliveries
+	}
+
+	hooks,err := cdb.GetWebhooks(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	params["Hooks"] = hooks
+
+	if err := templates.ExecuteTemplate(w, "webhooks", params); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// }}}
+// {{{ checkWebhookURL
+
+// Webhooks are fetched by us, from inside Google's network, so they mustn't point back at this
+// app, or at anything that's only reachable from in here. Host names that resolve to private
+// addresses can't be caught here; urlfetch won't fetch those anyway. Returns the URL, tidied.
+func checkWebhookURL(raw, site string) (string, error) {
+	u,err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("That doesn't look like a URL")
+	} else if u.Scheme != "https" {
+		return "", fmt.Errorf("Webhook URLs have to be https")
+	}
+
+	host := urlHost(u)
+	if s,err := url.Parse(site); err == nil && host == urlHost(s) {
+		return "", fmt.Errorf("Webhooks can't point back at this site")
+	} else if host == "appspot.com" || strings.HasSuffix(host, ".appspot.com") {
+		return "", fmt.Errorf("Webhooks can't point at App Engine apps")
+	} else if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return "", fmt.Errorf("Webhooks can't point at localhost")
+	} else if ip := net.ParseIP(host); ip != nil && !isPublicIP(ip) {
+		return "", fmt.Errorf("Webhooks can't point at private or loopback addresses")
+	}
+	return u.String(), nil
+}
+
+// The host, without any port or trailing dot
+func urlHost(u *url.URL) string {
+	host := u.Host
+	if h,_,err := net.SplitHostPort(host); err == nil { host = h }
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+}
+
+var kNonPublicNets = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10",
+}
+
+func isPublicIP(ip net.IP) bool {
+	for _,cidr := range kNonPublicNets {
+		if _,n,err := net.ParseCIDR(cidr); err == nil && n.Contains(ip) { return false }
+	}
+	return !ip.IsMulticast()
+}
+
+// }}}
+// {{{ deliverWebhookTaskHandler
+
+// Enqueued by complaintdb. A non-2xx response from the hook makes us return an error, so that
+// the queue retries (with backoff; see queue.yaml).
+func deliverWebhookTaskHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	id,err := strconv.ParseInt(r.FormValue("hook"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad hook", http.StatusBadRequest)
+		return
+	}
+	h,err := cdb.GetWebhook(id)
+	if err == datastore.ErrNoSuchEntity {
+		w.Write([]byte("OK, hook was deleted\n"))
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Hooks made before the URL was checked could still point somewhere they shouldn't
+	if _,err := checkWebhookURL(h.URL, siteURL()); err != nil {
+		c.Errorf("deliver-webhook %d (%s): %v; not delivering", id, h.URL, err)
+		w.Write([]byte("OK, URL not allowed\n"))
+		return
+	}
+
+	body := []byte(r.FormValue("body"))
+	d := complaintdb.WebhookDelivery{
+		DeliveryID: r.FormValue("delivery"),
+		Event: r.FormValue("event"),
+		Time: time.Now(),
+	}
+	d.Attempt,_ = strconv.Atoi(r.Header.Get("X-AppEngine-TaskRetryCount"))
+
+	req,err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "complaints-webhook/1")
+	req.Header.Set(webhook.HeaderEvent, d.Event)
+	req.Header.Set(webhook.HeaderDelivery, d.DeliveryID)
+	req.Header.Set(webhook.HeaderSignature, webhook.Sign(h.Secret, body))
+
+	client := urlfetch.Client(c)
+	if resp,err := client.Do(req); err != nil {
+		d.Error = err.Error()
+	} else {
+		resp.Body.Close()
+		d.StatusCode = resp.StatusCode
+		if !d.OK() { d.Error = resp.Status }
+	}
+	d.Duration = time.Since(d.Time)
+
+	if err := cdb.RecordWebhookDelivery(id, d); err != nil {
+		c.Errorf("deliver-webhook %d: record: %v", id, err)
+	}
+
+	if !d.OK() {
+		c.Infof("deliver-webhook %d (%s) attempt %d: %s", id, h.URL, d.Attempt, d.Error)
+		http.Error(w, fmt.Sprintf("delivery failed: %s", d.Error), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("OK\n"))
+}
+
+// }}}
+// {{{ pruneWebhookDeliveriesHandler
+
+func pruneWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	n,err := cdb.PruneWebhookDeliveries(time.Now().Add(-kWebhookLogKeepFor))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(fmt.Sprintf("OK, pruned %d\n", n)))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,42 @@
+package complaints
+
+import "testing"
+
+func TestCheckWebhookURL(t *testing.T) {
+	const site = "https://stop.jetnoise.net"
+
+	tests := []struct {
+		url  string
+		want string // "" if it should be rejected
+	}{
+		{" https://hooks.example.com/complaints ", "https://hooks.example.com/complaints"},
+		{"https://hooks.example.com:8443/x", "https://hooks.example.com:8443/x"},
+		{"https://8.8.8.8/x", "https://8.8.8.8/x"},
+		{"http://hooks.example.com/complaints", ""},
+		{"ftp://hooks.example.com/", ""},
+		{"hooks.example.com/complaints", ""},
+		{"https://stop.jetnoise.net/api/complaints", ""},
+		{"https://STOP.jetnoise.net./x", ""},
+		{"https://complaints.appspot.com/task/rekey", ""},
+		{"https://other-app.appspot.com/", ""},
+		{"https://localhost/", ""},
+		{"https://localhost:8080/", ""},
+		{"https://127.0.0.1/", ""},
+		{"https://10.1.2.3/", ""},
+		{"https://172.20.0.1/", ""},
+		{"https://192.168.1.1/", ""},
+		{"https://169.254.169.254/computeMetadata/v1/", ""},
+		{"https://[::1]:8443/", ""},
+		{"https://[fd00::1]/", ""},
+		{"https://[::ffff:127.0.0.1]/", ""},
+	}
+
+	for _,test := range tests {
+		got,err := checkWebhookURL(test.url, site)
+		if test.want == "" && err == nil {
+			t.Errorf("%q: accepted, as %q", test.url, got)
+		} else if test.want != "" && (err != nil || got != test.want) {
+			t.Errorf("%q: got %q, %v; wanted %q", test.url, got, err, test.want)
+		}
+	}
+}
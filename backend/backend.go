@@ -9,12 +9,22 @@ import (
 	"time"
 
 	"github.com/skypies/util/date"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/config"
+	"github.com/skypies/complaints/sessions"
 )
 
+// Who gets to see the reports; see the rbac package
+var reportRoles = []string{complaintdb.RoleAnalyst, complaintdb.RoleCommunityLead}
+
 func init() {
 	http.HandleFunc("/", noopHandler)
 	http.HandleFunc("/_ah/start", noopHandler)
 	http.HandleFunc("/_ah/stop", noopHandler)
+
+	// rbac needs the session, to know who non-Google users are
+	sessions.Init(config.Get("sessions.key"), config.Get("sessions.prevkey"))
 }
 
 var (
@@ -23,13 +23,16 @@ import (
 	"github.com/skypies/util/widget"
 	oldfdb "github.com/skypies/flightdb"
 	oldfgae "github.com/skypies/flightdb/gae"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/rbac"
 )
 
 // }}}
 
 func init() {
-	http.HandleFunc("/backend/fdb-batch", batchFlightScanHandler)
-	http.HandleFunc("/backend/fdb-batch/flight", batchSingleFlightHandler)
+	http.HandleFunc("/backend/fdb-batch", rbac.Require(batchFlightScanHandler, complaintdb.RoleAdmin))
+	http.HandleFunc("/backend/fdb-batch/flight", rbac.Require(batchSingleFlightHandler, complaintdb.RoleAdmin))
 }
 
 // To add a new batch handler, clone a jobFoo routine, and then add it into the switch{}
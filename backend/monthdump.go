@@ -16,10 +16,11 @@ import (
 	"github.com/skypies/util/gcs"
 
 	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/rbac"
 )
 
 func init() {
-	http.HandleFunc("/backend/monthdump", monthTaskHandler)
+	http.HandleFunc("/backend/monthdump", rbac.Require(monthTaskHandler, complaintdb.RoleAdmin))
 }
 
 // {{{ monthTaskHandler
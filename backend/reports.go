@@ -29,18 +29,19 @@ import (
 	"github.com/skypies/flightdb2/metar"
 
 	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/rbac"
 )
 
 func init() {
-	http.HandleFunc("/report", reportHandler)
-	http.HandleFunc("/report/", reportHandler)
+	http.HandleFunc("/report", rbac.Require(reportHandler, reportRoles...))
+	http.HandleFunc("/report/", rbac.Require(reportHandler, reportRoles...))
 
 	// Canned reports
-	http.HandleFunc("/report/serfr1", cannedSerfr1Handler)
-	http.HandleFunc("/report/discrep", cannedDiscrepHandler)
-	http.HandleFunc("/report/classb", cannedClassBHandler)
-	http.HandleFunc("/report/adsb", cannedAdsbClassBHandler)
-	http.HandleFunc("/report/yesterday", cannedSerfr1ComplaintsHandler)
+	http.HandleFunc("/report/serfr1", rbac.Require(cannedSerfr1Handler, reportRoles...))
+	http.HandleFunc("/report/discrep", rbac.Require(cannedDiscrepHandler, reportRoles...))
+	http.HandleFunc("/report/classb", rbac.Require(cannedClassBHandler, reportRoles...))
+	http.HandleFunc("/report/adsb", rbac.Require(cannedAdsbClassBHandler, reportRoles...))
+	http.HandleFunc("/report/yesterday", rbac.Require(cannedSerfr1ComplaintsHandler, reportRoles...))
 }
 
 func bool2string(b bool) string { if b { return "1" } else { return "" } }
@@ -20,11 +20,13 @@ import (
 	"github.com/skypies/flightdb2/report"
 	"github.com/skypies/flightdb2/metar"
 	_ "github.com/skypies/flightdb2/analysis" // populate the reports registry
+
+	"github.com/skypies/complaints/rbac"
 )
 
 func init() {
-	http.HandleFunc("/report3", report3Handler)
-	http.HandleFunc("/report3/", report3Handler)
+	http.HandleFunc("/report3", rbac.Require(report3Handler, reportRoles...))
+	http.HandleFunc("/report3/", rbac.Require(report3Handler, reportRoles...))
 }
 
 // {{{ tagList
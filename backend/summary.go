@@ -16,11 +16,12 @@ import (
 	
 	"github.com/skypies/complaints/complaintdb"
 	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/rbac"
 )
 
 func init() {
-	http.HandleFunc("/report/summary", summaryReportHandler)
-	http.HandleFunc("/report/month", monthHandler)
+	http.HandleFunc("/report/summary", rbac.Require(summaryReportHandler, reportRoles...))
+	http.HandleFunc("/report/month", rbac.Require(monthHandler, reportRoles...))
 }
 
 // {{{ monthHandler
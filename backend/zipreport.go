@@ -10,12 +10,13 @@ import (
 	"appengine"
 
 	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/rbac"
 	"github.com/skypies/util/date"
 	"github.com/skypies/util/widget"
 )
 
 func init() {
-	http.HandleFunc("/report/zip", zipHandler)
+	http.HandleFunc("/report/zip", rbac.Require(zipHandler, reportRoles...))
 }
 
 func zipHandler(w http.ResponseWriter, r *http.Request) {
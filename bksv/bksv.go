@@ -21,6 +21,36 @@ import (
 const bksvHost = "complaints-staging.bksv.com"
 const bksvPath = "/sfo2"
 
+// The airport that complaints are submitted to, unless the user picks others
+const DefaultAirport = "KSFO"
+
+type Airport struct {
+	Code string // ICAO
+	Name string
+}
+
+// The airports that BKSV will take complaints for (see the ?json=1 output in the notes)
+var KnownAirports = []Airport{
+	{"KSFO", "San Francisco International (SFO)"},
+	{"KOAK", "Oakland International (OAK)"},
+	{"KSJC", "Mineta San José International (SJC)"},
+	{"KSAN", "San Diego International (SAN)"},
+}
+
+// {{{ SubmitAirports
+
+// The airports that this user's complaints should be submitted to.
+func SubmitAirports(p types.ComplainerProfile) []string {
+	if !p.CcSfo {
+		return []string{}
+	} else if len(p.SubmitAirports) == 0 {
+		return []string{DefaultAirport}
+	}
+	return p.SubmitAirports
+}
+
+// }}}
+
 // {{{ GetSubmitkey
 
 // Should really get this from the ?json=1 version of the URL and extract it.
@@ -69,11 +99,15 @@ func GetSubmitkey(client *http.Client) (string, string, error) {
 //  "title":"Complaint Received",
 //  "body":"Thank you. We have received your complaint."}
 
-func PostComplaint(client *http.Client, p types.ComplainerProfile, c types.Complaint) (string,error) {
+func PostComplaint(client *http.Client, p types.ComplainerProfile, c types.Complaint, airport string) (string,error) {
 	first,last := p.SplitName()
 	addr := p.GetStructuredAddress()
 	if c.Activity == "" { c.Activity = "Loud noise" }
 
+	category := c.AircraftCategory
+	if category == CategoryUnknown { category = AircraftCategory(c.AircraftOverhead.EquipType) }
+	if category == CategoryUnknown { category = CategoryJet } // What we always used to send
+
 	debug, submitkey, err := GetSubmitkey(client)
 	if err != nil { return debug,err }
 	debug += fmt.Sprintf("We got submitkey=%s\n", submitkey)
@@ -96,14 +130,14 @@ func PostComplaint(client *http.Client, p types.ComplainerProfile, c types.Compl
 		"state":            {addr.State},
 		"email":            {p.EmailAddress},
 
-		"airports":         {"KSFO"},  // KOAK, KSJC, KSAN
+		"airports":         {airport},  // KSFO, KOAK, KSJC, KSAN
 		"month":            {date.InPdt(c.Timestamp).Format("1")},
 		"day":              {date.InPdt(c.Timestamp).Format("2")},
 		"year":             {date.InPdt(c.Timestamp).Format("2006")},
 		"hour":             {date.InPdt(c.Timestamp).Format("15")},
 		"min":              {date.InPdt(c.Timestamp).Format("4")},
 		
-		"aircraftcategory": {"J"},
+		"aircraftcategory": {category},
 		"eventtype":        {"Loud noise"}, // perhaps map c.Activity to something ?
 		"comments":         {c.Description},
 		"responserequired": {"N"},
@@ -126,9 +160,13 @@ func PostComplaint(client *http.Client, p types.ComplainerProfile, c types.Compl
 		vals.Add("aacode", c.AircraftOverhead.Id2)
 		vals.Add("tailnumber", c.AircraftOverhead.Registration)
 		vals.Add("aircrafttype", c.AircraftOverhead.EquipType)
-			
-		//vals.Add("adflag", "??") // Operation type (A, D or O for Arr, Dept or Overflight)
-		//vals.Add("beacon", "??") // SSR code (eg 210)
+
+		if op := SubmittedOperationType(c, airport); op != OperationUnknown {
+			vals.Add("adflag", op) // Operation type (A, D or O for Arr, Dept or Overflight)
+		}
+		if c.AircraftOverhead.Squawk != "" {
+			vals.Add("beacon", c.AircraftOverhead.Squawk) // SSR code (eg 210)
+		}
 	}
 
 	// }}}
@@ -0,0 +1,148 @@
+package bksv
+
+// Routines for deriving the aircraft category & operation type fields that BKSV wants
+
+import (
+	"strings"
+
+	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/fr24"
+)
+
+// Aircraft categories, as BKSV's aircraftcategory codes
+const (
+	CategoryJet        = "J"
+	CategoryTurboprop  = "T"
+	CategoryHelicopter = "H"
+	CategoryGA         = "G" // Piston-engined general aviation
+	CategoryUnknown    = ""
+)
+
+// Operation types, as BKSV's adflag codes
+const (
+	OperationArrival    = "A"
+	OperationDeparture  = "D"
+	OperationOverflight = "O"
+	OperationUnknown    = ""
+)
+
+// {{{ kEquipTypeCategories
+
+// ICAO aircraft type designators (as seen in fr24.Aircraft.EquipType), for the aircraft we
+// tend to see around the bay area. Anything not listed is CategoryUnknown.
+var kEquipTypeCategories = map[string]string{
+	// Airliners & regional jets
+	"A306": CategoryJet, "A30B": CategoryJet, "A310": CategoryJet,
+	"A318": CategoryJet, "A319": CategoryJet, "A320": CategoryJet, "A321": CategoryJet,
+	"A19N": CategoryJet, "A20N": CategoryJet, "A21N": CategoryJet,
+	"A332": CategoryJet, "A333": CategoryJet, "A339": CategoryJet,
+	"A343": CategoryJet, "A346": CategoryJet, "A359": CategoryJet, "A35K": CategoryJet,
+	"A388": CategoryJet,
+	"B712": CategoryJet, "B717": CategoryJet,
+	"B733": CategoryJet, "B734": CategoryJet, "B735": CategoryJet, "B736": CategoryJet,
+	"B737": CategoryJet, "B738": CategoryJet, "B739": CategoryJet,
+	"B37M": CategoryJet, "B38M": CategoryJet, "B39M": CategoryJet,
+	"B744": CategoryJet, "B748": CategoryJet, "B74F": CategoryJet,
+	"B752": CategoryJet, "B753": CategoryJet,
+	"B762": CategoryJet, "B763": CategoryJet, "B764": CategoryJet,
+	"B772": CategoryJet, "B773": CategoryJet, "B77L": CategoryJet, "B77W": CategoryJet,
+	"B788": CategoryJet, "B789": CategoryJet, "B78X": CategoryJet,
+	"CRJ1": CategoryJet, "CRJ2": CategoryJet, "CRJ7": CategoryJet, "CRJ9": CategoryJet,
+	"CRJX": CategoryJet,
+	"E135": CategoryJet, "E145": CategoryJet, "E170": CategoryJet, "E175": CategoryJet,
+	"E75L": CategoryJet, "E75S": CategoryJet, "E190": CategoryJet, "E195": CategoryJet,
+	"DC10": CategoryJet, "MD11": CategoryJet,
+	"MD82": CategoryJet, "MD83": CategoryJet, "MD88": CategoryJet, "MD90": CategoryJet,
+
+	// Business jets
+	"BE40": CategoryJet, "C25A": CategoryJet, "C25B": CategoryJet, "C25C": CategoryJet,
+	"C510": CategoryJet, "C525": CategoryJet, "C550": CategoryJet, "C560": CategoryJet,
+	"C56X": CategoryJet, "C680": CategoryJet, "C68A": CategoryJet, "C750": CategoryJet,
+	"CL30": CategoryJet, "CL35": CategoryJet, "CL60": CategoryJet,
+	"E50P": CategoryJet, "E55P": CategoryJet,
+	"F2TH": CategoryJet, "F900": CategoryJet, "FA7X": CategoryJet,
+	"G280": CategoryJet, "GLEX": CategoryJet, "GLF4": CategoryJet, "GLF5": CategoryJet,
+	"GLF6": CategoryJet, "H25B": CategoryJet, "HDJT": CategoryJet,
+	"LJ35": CategoryJet, "LJ45": CategoryJet, "LJ60": CategoryJet,
+	"PC24": CategoryJet, "PRM1": CategoryJet,
+
+	// Turboprops
+	"AT43": CategoryTurboprop, "AT45": CategoryTurboprop, "AT72": CategoryTurboprop,
+	"AT76": CategoryTurboprop, "B190": CategoryTurboprop, "BE20": CategoryTurboprop,
+	"BE30": CategoryTurboprop, "BE9L": CategoryTurboprop, "BE99": CategoryTurboprop,
+	"C208": CategoryTurboprop, "D328": CategoryTurboprop, "DH8A": CategoryTurboprop,
+	"DH8B": CategoryTurboprop, "DH8C": CategoryTurboprop, "DH8D": CategoryTurboprop,
+	"DHC6": CategoryTurboprop, "E120": CategoryTurboprop, "JS41": CategoryTurboprop,
+	"P180": CategoryTurboprop, "PAY3": CategoryTurboprop, "PC12": CategoryTurboprop,
+	"SF34": CategoryTurboprop, "SW4":  CategoryTurboprop, "TBM7": CategoryTurboprop,
+	"TBM8": CategoryTurboprop, "TBM9": CategoryTurboprop,
+
+	// Helicopters
+	"A109": CategoryHelicopter, "A139": CategoryHelicopter, "AS50": CategoryHelicopter,
+	"AS55": CategoryHelicopter, "AS65": CategoryHelicopter, "B06":  CategoryHelicopter,
+	"B407": CategoryHelicopter, "B412": CategoryHelicopter, "B429": CategoryHelicopter,
+	"B505": CategoryHelicopter, "EC20": CategoryHelicopter, "EC30": CategoryHelicopter,
+	"EC35": CategoryHelicopter, "EC45": CategoryHelicopter, "H60":  CategoryHelicopter,
+	"R22":  CategoryHelicopter, "R44":  CategoryHelicopter, "R66":  CategoryHelicopter,
+	"S76":  CategoryHelicopter,
+
+	// Piston GA
+	"BE35": CategoryGA, "BE36": CategoryGA, "BE58": CategoryGA, "BE76": CategoryGA,
+	"C150": CategoryGA, "C152": CategoryGA, "C172": CategoryGA, "C182": CategoryGA,
+	"C206": CategoryGA, "C210": CategoryGA, "C310": CategoryGA, "C340": CategoryGA,
+	"DA40": CategoryGA, "DA42": CategoryGA, "M20P": CategoryGA, "M20T": CategoryGA,
+	"P28A": CategoryGA, "P28R": CategoryGA, "P32R": CategoryGA, "PA28": CategoryGA,
+	"PA32": CategoryGA, "PA34": CategoryGA, "PA44": CategoryGA, "PA46": CategoryGA,
+	"SR20": CategoryGA, "SR22": CategoryGA,
+}
+
+// }}}
+
+// {{{ AircraftCategory
+
+// Returns one of the Category* constants, based on the equipment type (e.g. "B738").
+func AircraftCategory(equipType string) string {
+	if cat,exists := kEquipTypeCategories[strings.ToUpper(strings.TrimSpace(equipType))]; exists {
+		return cat
+	}
+	return CategoryUnknown
+}
+
+// }}}
+// {{{ OperationType
+
+// Returns one of the Operation* constants, by comparing the aircraft's origin and
+// destination (IATA codes, e.g. "SFO") with the airport (ICAO code, e.g. "KSFO").
+func OperationType(a fr24.Aircraft, airport string) string {
+	if a.Origin == "" && a.Destination == "" { return OperationUnknown }
+
+	// fr24 gives us IATA codes; US ICAO codes are just those with a K in front.
+	iata := strings.TrimPrefix(strings.ToUpper(airport), "K")
+
+	if strings.ToUpper(a.Destination) == iata {
+		return OperationArrival
+	} else if strings.ToUpper(a.Origin) == iata {
+		return OperationDeparture
+	}
+	return OperationOverflight
+}
+
+// }}}
+// {{{ SubmittedOperationType
+
+// The operation type that PostComplaint sends to the airport for the complaint; unknown if
+// there's no flight.
+func SubmittedOperationType(c types.Complaint, airport string) string {
+	if c.AircraftOverhead.FlightNumber == "" { return OperationUnknown }
+	return OperationType(c.AircraftOverhead, airport)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,71 @@
+package bksv
+
+import (
+	"testing"
+
+	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/fr24"
+)
+
+func TestAircraftCategory(t *testing.T) {
+	tests := []struct {
+		equipType string
+		want      string
+	}{
+		{"B738", CategoryJet},
+		{" b738 ", CategoryJet},
+		{"CRJ9", CategoryJet},
+		{"GLF5", CategoryJet},
+		{"DH8D", CategoryTurboprop},
+		{"C208", CategoryTurboprop},
+		{"R44", CategoryHelicopter},
+		{"EC35", CategoryHelicopter},
+		{"C172", CategoryGA},
+		{"SR22", CategoryGA},
+		{"ZZZZ", CategoryUnknown},
+		{"", CategoryUnknown},
+	}
+	for _,test := range tests {
+		if got := AircraftCategory(test.equipType); got != test.want {
+			t.Errorf("AircraftCategory(%q): got %q, wanted %q", test.equipType, got, test.want)
+		}
+	}
+}
+
+func TestOperationType(t *testing.T) {
+	tests := []struct {
+		origin, destination string
+		airport             string
+		want                string
+	}{
+		{"LAX", "SFO", "KSFO", OperationArrival},
+		{"lax", "sfo", "ksfo", OperationArrival},
+		{"SFO", "LAX", "KSFO", OperationDeparture},
+		{"LAX", "SEA", "KSFO", OperationOverflight},
+		{"SFO", "SJC", "KSJC", OperationArrival},    // Depends on the airport asked about
+		{"SFO", "SJC", "KOAK", OperationOverflight},
+		{"", "SFO", "KSFO", OperationArrival},
+		{"", "", "KSFO", OperationUnknown},
+	}
+	for _,test := range tests {
+		a := fr24.Aircraft{Origin: test.origin, Destination: test.destination}
+		if got := OperationType(a, test.airport); got != test.want {
+			t.Errorf("OperationType(%s->%s, %s): got %q, wanted %q", test.origin, test.destination,
+				test.airport, got, test.want)
+		}
+	}
+}
+
+func TestSubmittedOperationType(t *testing.T) {
+	c := types.Complaint{AircraftOverhead: fr24.Aircraft{Origin: "LAX", Destination: "SFO"}}
+	if got := SubmittedOperationType(c, "KSFO"); got != OperationUnknown {
+		t.Errorf("no flight number: got %q", got)
+	}
+	c.AircraftOverhead.FlightNumber = "UA123"
+	if got := SubmittedOperationType(c, "KSFO"); got != OperationArrival {
+		t.Errorf("KSFO: got %q", got)
+	}
+	if got := SubmittedOperationType(c, "KOAK"); got != OperationOverflight {
+		t.Errorf("KOAK: got %q", got)
+	}
+}
@@ -0,0 +1,148 @@
+// Package button is the signed request format for hardware complaint buttons, and a client
+// for it. Each button (a "device") has an ID and a secret, which the user gets from the
+// /buttons page. A press is a POST to /button with these form fields:
+//   d   - the device ID
+//   ts  - the time of the press, in epoch seconds
+//   n   - a nonce; random, never reused, and at most MaxNonceLen bytes
+//   sig - Signature(secret, d, ts, n)
+// The server rejects requests whose timestamp is more than MaxSkew away from its clock, and
+// any nonce it has already seen for that device. A retry of a request the server already
+// got gets a 409 (Conflict), which the client treats as success.
+//
+// This package has no App Engine dependencies, so it can be used on the devices (or a hub
+// in front of them); the server uses it too, to check signatures.
+package button
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How far the timestamp on a request can be from the server's clock
+const MaxSkew = 5 * time.Minute
+
+// The longest nonce the server will take (NewNonce's are 22 bytes)
+const MaxNonceLen = 64
+
+// {{{ Signature
+
+// Signature is the HMAC-SHA256 over the device ID, timestamp and nonce, as URL-safe base64.
+func Signature(secret, deviceID string, ts int64, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{deviceID, strconv.FormatInt(ts,10), nonce}, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// }}}
+// {{{ Verify
+
+// Verify checks the signature, and that the timestamp is within MaxSkew of now. It doesn't
+// know about nonces; the caller has to check those.
+func Verify(secret, deviceID string, ts int64, nonce, sig string, now time.Time) error {
+	if secret == "" || nonce == "" { return fmt.Errorf("missing secret or nonce") }
+
+	if !hmac.Equal([]byte(sig), []byte(Signature(secret, deviceID, ts, nonce))) {
+		return fmt.Errorf("bad signature")
+	}
+	if skew := now.Sub(time.Unix(ts,0)); skew > MaxSkew || skew < -MaxSkew {
+		return fmt.Errorf("timestamp is %s away from now", skew)
+	}
+	return nil
+}
+
+// }}}
+// {{{ NewNonce
+
+func NewNonce() (string, error) {
+	b := make([]byte, 16)
+	if _,err := rand.Read(b); err != nil { return "", err }
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// }}}
+
+// {{{ Client
+
+type Client struct {
+	URL        string // e.g. "https://stop.jetnoise.net/button"
+	DeviceID   string
+	Secret     string
+	Retries    int    // How many more times to try, if the network lets us down
+	HTTPClient *http.Client
+}
+
+func NewClient(url, deviceID, secret string) *Client {
+	return &Client{
+		URL: url,
+		DeviceID: deviceID,
+		Secret: secret,
+		Retries: 3,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// }}}
+// {{{ c.Form
+
+// Form builds the signed form values for a press at time t.
+func (c Client)Form(t time.Time) (url.Values, error) {
+	nonce,err := NewNonce()
+	if err != nil { return nil, err }
+
+	ts := t.Unix()
+	return url.Values{
+		"d":   {c.DeviceID},
+		"ts":  {strconv.FormatInt(ts,10)},
+		"n":   {nonce},
+		"sig": {Signature(c.Secret, c.DeviceID, ts, nonce)},
+	}, nil
+}
+
+// }}}
+// {{{ c.Press
+
+// Press sends a complaint. Retries resend the very same request, so the server won't count
+// the press twice.
+func (c Client)Press() error {
+	form,err := c.Form(time.Now())
+	if err != nil { return err }
+
+	for i:=0; ; i++ {
+		resp,err := c.HTTPClient.PostForm(c.URL, form)
+		if err == nil {
+			body,_ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode == http.StatusOK:
+				return nil
+			case resp.StatusCode == http.StatusConflict && i > 0:
+				return nil // An earlier attempt got through after all
+			case resp.StatusCode < 500:
+				return fmt.Errorf("button: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+			}
+			err = fmt.Errorf("button: %s", resp.Status)
+		}
+
+		if i >= c.Retries { return err }
+		time.Sleep(time.Duration(i+1) * time.Second)
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,241 @@
+package complaintdb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"appengine/datastore"
+
+	"github.com/skypies/complaints/complaintdb/types"
+)
+
+// Users can delete their accounts. They ask, and after a grace period (during which they can
+// change their minds) a task deletes their profile and everything else keyed by their email
+// address. Their complaints aren't deleted, as they're part of the reports, and many have
+// already been submitted; instead they are anonymized, and moved out from under the profile's
+// root key (whose name is the email address) to a random one.
+
+const (
+	kAccountDeletionKind = "AccountDeletion"
+	kAnonymousPrefix = "deleted-"
+)
+
+// {{{ AccountDeletion
+
+type AccountDeletion struct {
+	EmailAddress string    `datastore:"-"` // The datastore key name
+	Requested    time.Time `datastore:",noindex"`
+	Due          time.Time
+	Done         time.Time // Zero until the deletion has finished
+	AnonymousID  string    `datastore:",noindex"` // Where the complaints go; forgotten once Done
+
+	Anonymized   int       `datastore:",noindex"` // How many complaints were anonymized
+	Deleted      int       `datastore:",noindex"` // How many other records were deleted
+}
+
+func (d AccountDeletion)IsDone() bool { return !d.Done.IsZero() }
+
+// Pending ones first, soonest due first; then the done ones, most recent first.
+type AccountDeletionsByRecent []AccountDeletion
+func (a AccountDeletionsByRecent) Len() int      { return len(a) }
+func (a AccountDeletionsByRecent) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a AccountDeletionsByRecent) Less(i, j int) bool {
+	if a[i].IsDone() != a[j].IsDone() { return !a[i].IsDone() }
+	if !a[i].IsDone() { return a[i].Due.Before(a[j].Due) }
+	return a[i].Done.After(a[j].Done)
+}
+
+// }}}
+
+func (cdb ComplaintDB) accountDeletionKey(email string) *datastore.Key {
+	return datastore.NewKey(cdb.C, kAccountDeletionKind, email, 0, nil)
+}
+
+// {{{ cdb.RequestAccountDeletion
+
+func (cdb ComplaintDB) RequestAccountDeletion(email string, grace time.Duration) (*AccountDeletion, error) {
+	b := make([]byte, 12)
+	if _,err := rand.Read(b); err != nil { return nil, err }
+
+	d := AccountDeletion{
+		EmailAddress: email,
+		Requested: time.Now(),
+		Due: time.Now().Add(grace),
+		AnonymousID: kAnonymousPrefix + hex.EncodeToString(b),
+	}
+	if _,err := datastore.Put(cdb.C, cdb.accountDeletionKey(email), &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// }}}
+// {{{ cdb.GetAccountDeletion
+
+// Returns nil (and no error) if there isn't one.
+func (cdb ComplaintDB) GetAccountDeletion(email string) (*AccountDeletion, error) {
+	d := AccountDeletion{}
+	if err := datastore.Get(cdb.C, cdb.accountDeletionKey(email), &d); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	d.EmailAddress = email
+	return &d, nil
+}
+
+// }}}
+// {{{ cdb.CancelAccountDeletion
+
+func (cdb ComplaintDB) CancelAccountDeletion(email string) error {
+	if d,err := cdb.GetAccountDeletion(email); err != nil {
+		return err
+	} else if d == nil || d.IsDone() {
+		return nil
+	}
+	return datastore.Delete(cdb.C, cdb.accountDeletionKey(email))
+}
+
+// }}}
+// {{{ cdb.PutAccountDeletion
+
+func (cdb ComplaintDB) PutAccountDeletion(d AccountDeletion) error {
+	_,err := datastore.Put(cdb.C, cdb.accountDeletionKey(d.EmailAddress), &d)
+	return err
+}
+
+// }}}
+// {{{ cdb.GetAccountDeletions
+
+// Every deletion, pending or done.
+func (cdb ComplaintDB) GetAccountDeletions() ([]AccountDeletion, error) {
+	ds := []AccountDeletion{}
+	keys,err := datastore.NewQuery(kAccountDeletionKind).GetAll(cdb.C, &ds)
+	if err != nil { return nil, err }
+	for i,k := range keys { ds[i].EmailAddress = k.StringID() }
+	sort.Sort(AccountDeletionsByRecent(ds))
+	return ds, nil
+}
+
+// }}}
+// {{{ cdb.GetDueAccountDeletions
+
+func (cdb ComplaintDB) GetDueAccountDeletions(now time.Time) ([]AccountDeletion, error) {
+	ds := []AccountDeletion{}
+	q := datastore.NewQuery(kAccountDeletionKind).Filter("Done =", time.Time{}).Filter("Due <", now)
+	keys,err := q.GetAll(cdb.C, &ds)
+	if err != nil { return nil, err }
+	for i,k := range keys { ds[i].EmailAddress = k.StringID() }
+	return ds, nil
+}
+
+// }}}
+
+// {{{ AnonymizeComplaint
+
+// Keeps what the reports need: the zip code, and a stand-in for who. No lat/long, not even
+// rounded; all of a user's complaints share the anonymous root, so they'd still add up to
+// roughly where one household is. The text fields go too.
+func AnonymizeComplaint(c *types.Complaint, anonymousID string) {
+	c.Profile = types.ComplainerProfile{
+		EmailAddress: anonymousID,
+		StructuredAddress: types.PostalAddress{
+			City: c.Profile.StructuredAddress.City,
+			State: c.Profile.StructuredAddress.State,
+			Zip: c.Profile.StructuredAddress.Zip,
+		},
+	}
+	c.Description = ""
+	c.Activity = ""
+	c.Debug = ""
+}
+
+// }}}
+// {{{ cdb.AnonymizeComplaints
+
+// Moves up to n of the user's complaints under the anonymous root, anonymizing them on the
+// way, and returns how many it moved; zero means they're all done. The new keys have the same
+// IDs as the old, so if it fails half way through, rerunning it is harmless.
+func (cdb ComplaintDB) AnonymizeComplaints(email, anonymousID string, n int) (int, error) {
+	complaints := []types.Complaint{}
+	q := datastore.NewQuery(kComplaintKind).Ancestor(cdb.emailToRootKey(email)).Limit(n)
+	keys,err := q.GetAll(cdb.C, &complaints)
+	if err != nil || len(keys) == 0 { return 0, err }
+
+	root := cdb.emailToRootKey(anonymousID)
+	newKeys := []*datastore.Key{}
+	for i,k := range keys {
+		AnonymizeComplaint(&complaints[i], anonymousID)
+		newKeys = append(newKeys, datastore.NewKey(cdb.C, kComplaintKind, k.StringID(), k.IntID(), root))
+	}
+
+	if _,err := datastore.PutMulti(cdb.C, newKeys, complaints); err != nil { return 0, err }
+	if err := datastore.DeleteMulti(cdb.C, keys); err != nil { return 0, err }
+	return len(keys), nil
+}
+
+// }}}
+// {{{ cdb.DeleteAccountRecords
+
+// Deletes the profile, and everything else that belongs to the email address. Anonymize the
+// complaints first; any still under the root key get deleted. Returns how many records it
+// deleted.
+func (cdb ComplaintDB) DeleteAccountRecords(email string) (int, error) {
+	n := 0
+
+	tokens,err := cdb.GetAccessTokens(email)
+	if err != nil { return n, err }
+	for _,t := range tokens {
+		if err := cdb.RevokeAccessToken(email, t.ID); err != nil { return n, err }
+		n++
+	}
+
+	devices,err := cdb.GetButtonDevices(email)
+	if err != nil { return n, err }
+	for _,d := range devices {
+		if err := cdb.DeleteButtonDevice(email, d.ID); err != nil { return n, err }
+		n++
+	}
+
+	hooks,err := cdb.GetWebhooks(email)
+	if err != nil { return n, err }
+	for _,h := range hooks {
+		if err := cdb.DeleteWebhook(email, h.ID); err != nil { return n, err }
+		n++
+	}
+
+	sessions,err := cdb.GetSessionsByEmailAddress(email)
+	if err != nil { return n, err }
+	for _,s := range sessions {
+		if err := cdb.DeleteSessions([]string{s.Key}); err != nil { return n, err }
+		n++
+	}
+
+	if err := cdb.SetRoles(email, nil, ""); err != nil { return n, err }
+	if err := cdb.DeletePhoneVerification(email); err != nil { return n, err }
+	if err := cdb.ClearMailStatus(email); err != nil && err != datastore.ErrNoSuchEntity {
+		return n, err
+	}
+
+	// Whatever is left under the root key (e.g. import jobs), and the profile itself; in
+	// batches, as there may be more than DeleteMulti will take
+	root := cdb.emailToRootKey(email)
+	deleted,err := cdb.deleteAllInBatches(datastore.NewQuery("").Ancestor(root))
+	n += deleted
+	if err != nil { return n, err }
+
+	if err := cdb.ResetDailyCounts(email); err != nil { cdb.C.Errorf("ResetDailyCounts: %v", err) }
+	return n, nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,47 @@
+package complaintdb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/skypies/complaints/complaintdb/types"
+)
+
+func TestAnonymizeComplaint(t *testing.T) {
+	t0 := time.Date(2016, 3, 14, 6, 40, 0, 0, time.UTC)
+	subs := []types.Submission{{Airport: "KSFO", T: t0}}
+
+	c := types.Complaint{
+		Timestamp: t0,
+		Description: "right over 12 Elm St again",
+		Activity: "Sleeping",
+		Debug: "lookup near 37.4419,-122.1430",
+		Loudness: 3,
+		Submissions: subs,
+		Profile: types.ComplainerProfile{
+			EmailAddress: "alice@example.com",
+			FullName: "Alice Example",
+			Address: "12 Elm St, Palo Alto, CA 94301",
+			StructuredAddress: types.PostalAddress{
+				Number: "12", Street: "Elm St", City: "Palo Alto", State: "CA", Zip: "94301",
+			},
+			Lat: 37.4419,
+			Long: -122.1430,
+		},
+	}
+	AnonymizeComplaint(&c, "anon-1234")
+
+	want := types.Complaint{
+		Timestamp: t0,
+		Loudness: 3,
+		Submissions: subs,
+		Profile: types.ComplainerProfile{
+			EmailAddress: "anon-1234",
+			StructuredAddress: types.PostalAddress{City: "Palo Alto", State: "CA", Zip: "94301"},
+		},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got  %+v\nwant %+v", c, want)
+	}
+}
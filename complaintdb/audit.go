@@ -0,0 +1,107 @@
+package complaintdb
+
+import (
+	"time"
+
+	"appengine/datastore"
+)
+
+// The audit log of admin impersonation: one Impersonation per session, recording who looked
+// at whose account and why, with an ImpersonationEvent child for each page they viewed or
+// thing they changed.
+
+const (
+	kImpersonationKind = "Impersonation"
+	kImpersonationEventKind = "ImpersonationEvent" // Child of the Impersonation
+)
+
+// {{{ Impersonation, ImpersonationEvent
+
+type Impersonation struct {
+	ID           int64     `datastore:"-"`
+	Admin        string
+	EmailAddress string    // Who was impersonated
+	Reason       string    `datastore:",noindex"`
+	Write        bool      `datastore:",noindex"` // Whether changes were allowed
+	Start        time.Time
+	Expires      time.Time `datastore:",noindex"`
+	End          time.Time `datastore:",noindex"` // Zero until the admin exits
+}
+
+type ImpersonationEvent struct {
+	Time   time.Time
+	Method string `datastore:",noindex"`
+	Path   string `datastore:",noindex"`
+	Change bool   `datastore:",noindex"` // A write, rather than just a view
+	Denied bool   `datastore:",noindex"` // A write that was refused, as the session was read-only
+}
+
+// }}}
+
+func (cdb ComplaintDB) impersonationKey(id int64) *datastore.Key {
+	return datastore.NewKey(cdb.C, kImpersonationKind, "", id, nil)
+}
+
+// {{{ cdb.CreateImpersonation
+
+func (cdb ComplaintDB) CreateImpersonation(imp Impersonation) (int64, error) {
+	k,err := datastore.Put(cdb.C, datastore.NewIncompleteKey(cdb.C, kImpersonationKind, nil), &imp)
+	if err != nil { return 0, err }
+	return k.IntID(), nil
+}
+
+// }}}
+// {{{ cdb.EndImpersonation
+
+func (cdb ComplaintDB) EndImpersonation(id int64) error {
+	imp := Impersonation{}
+	if err := datastore.Get(cdb.C, cdb.impersonationKey(id), &imp); err != nil {
+		return err
+	}
+	imp.End = time.Now()
+	_,err := datastore.Put(cdb.C, cdb.impersonationKey(id), &imp)
+	return err
+}
+
+// }}}
+// {{{ cdb.GetImpersonations
+
+// The most recent n, newest first.
+func (cdb ComplaintDB) GetImpersonations(n int) ([]Impersonation, error) {
+	imps := []Impersonation{}
+	q := datastore.NewQuery(kImpersonationKind).Order("-Start").Limit(n)
+	keys,err := q.GetAll(cdb.C, &imps)
+	if err != nil { return nil, err }
+	for i,k := range keys { imps[i].ID = k.IntID() }
+	return imps, nil
+}
+
+// }}}
+// {{{ cdb.RecordImpersonationEvent
+
+func (cdb ComplaintDB) RecordImpersonationEvent(id int64, ev ImpersonationEvent) error {
+	k := datastore.NewIncompleteKey(cdb.C, kImpersonationEventKind, cdb.impersonationKey(id))
+	_,err := datastore.Put(cdb.C, k, &ev)
+	return err
+}
+
+// }}}
+// {{{ cdb.GetImpersonationEvents
+
+// Everything that happened in the impersonation, in order.
+func (cdb ComplaintDB) GetImpersonationEvents(id int64) ([]ImpersonationEvent, error) {
+	evs := []ImpersonationEvent{}
+	q := datastore.NewQuery(kImpersonationEventKind).Ancestor(cdb.impersonationKey(id)).Order("Time")
+	if _,err := q.GetAll(cdb.C, &evs); err != nil { return nil, err }
+	return evs, nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -8,12 +8,14 @@ import (
 	"github.com/skypies/util/date"
 
 	"github.com/skypies/geo"
+	"github.com/skypies/complaints/bksv"
 	"github.com/skypies/complaints/complaintdb/types"
 )
 
 const (
 	kComplaintVersion = 2
 	kComplaintCoalesceThreshold = 45
+	kLiveLookupWindow = 10 * time.Minute // Older complaints can't use fr24's live view of the sky
 )
 
 // {{{ ComplaintsAreEquivalent
@@ -71,6 +73,15 @@ func FixupComplaint(c *types.Complaint, key *datastore.Key) {
 	}
 }
 
+// }}}
+// {{{ ClassifyAircraft
+
+// Fill out the fields that describe the aircraft overhead in BKSV's terms. The operation type
+// depends on the airport, so it's worked out when submitting, and kept in the Submission.
+func ClassifyAircraft(c *types.Complaint) {
+	c.AircraftCategory = bksv.AircraftCategory(c.AircraftOverhead.EquipType)
+}
+
 // }}}
 // {{{ Overwrite
 
@@ -81,6 +92,11 @@ func Overwrite(this, from *types.Complaint) {
 
 	// Restore a few key fields from the original
 	this.DatastoreKey = orig.DatastoreKey
+	this.Submissions = orig.Submissions // Don't let a coalesce cause a resubmission
+	this.ReviewedOK = orig.ReviewedOK
+
+	// If either one was to be kept private, the merged one is too
+	this.DoNotSubmit = orig.DoNotSubmit || from.DoNotSubmit
 
 	// If the orig had a description but new doesn't, don't lose it
 	if this.Description == "" && orig.Description != "" {
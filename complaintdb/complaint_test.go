@@ -0,0 +1,67 @@
+package complaintdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skypies/complaints/complaintdb/types"
+)
+
+func TestOverwrite(t *testing.T) {
+	t0 := time.Date(2016, 3, 14, 6, 40, 0, 0, time.UTC)
+	subs := []types.Submission{{Airport: "KSFO", T: t0}}
+
+	tests := []struct {
+		name string
+		orig types.Complaint
+		next types.Complaint
+		want types.Complaint
+	}{
+		{
+			"newer fields win",
+			types.Complaint{DatastoreKey: "k1", Timestamp: t0, Loudness: 1, Description: "loud"},
+			types.Complaint{Timestamp: t0.Add(time.Minute), Loudness: 3, Description: "louder"},
+			types.Complaint{DatastoreKey: "k1", Timestamp: t0.Add(time.Minute), Loudness: 3,
+				Description: "louder"},
+		},
+		{
+			"description and submissions are kept",
+			types.Complaint{DatastoreKey: "k1", Description: "loud", Submissions: subs},
+			types.Complaint{DatastoreKey: "k2", Loudness: 2},
+			types.Complaint{DatastoreKey: "k1", Description: "loud", Submissions: subs, Loudness: 2},
+		},
+		{
+			"private stays private",
+			types.Complaint{DatastoreKey: "k1", DoNotSubmit: true},
+			types.Complaint{Loudness: 2},
+			types.Complaint{DatastoreKey: "k1", DoNotSubmit: true, Loudness: 2},
+		},
+		{
+			"a private follow-up makes it private",
+			types.Complaint{DatastoreKey: "k1"},
+			types.Complaint{DoNotSubmit: true},
+			types.Complaint{DatastoreKey: "k1", DoNotSubmit: true},
+		},
+		{
+			"review approval is kept",
+			types.Complaint{DatastoreKey: "k1", ReviewedOK: true},
+			types.Complaint{Loudness: 1},
+			types.Complaint{DatastoreKey: "k1", ReviewedOK: true, Loudness: 1},
+		},
+	}
+
+	for _,test := range tests {
+		got := test.orig
+		Overwrite(&got, &test.next)
+		switch {
+		case got.DatastoreKey != test.want.DatastoreKey,
+			!got.Timestamp.Equal(test.want.Timestamp),
+			got.Loudness != test.want.Loudness,
+			got.Description != test.want.Description,
+			len(got.Submissions) != len(test.want.Submissions),
+			got.DoNotSubmit != test.want.DoNotSubmit,
+			got.ReviewedOK != test.want.ReviewedOK:
+			t.Errorf("%s: got %+v, wanted %+v", test.name, got, test.want)
+		}
+	}
+}
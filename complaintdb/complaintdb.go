@@ -19,8 +19,7 @@ import (
 
 	"github.com/skypies/complaints/complaintdb/types"
 	"github.com/skypies/complaints/fr24"
-	
-	// "github.com/skypies/complaints/bksv"
+	"github.com/skypies/complaints/webhook"
 )
 
 var(
@@ -111,7 +110,30 @@ func (cdb ComplaintDB) DeleteComplaints(keyStrings []string, ownerEmail string)
 		}
 		keys = append(keys, k)
 	}
-	return datastore.DeleteMulti(cdb.C, keys)
+	if err := datastore.DeleteMulti(cdb.C, keys); err != nil { return err }
+
+	for _,s := range keyStrings {
+		cdb.emitWebhookEvent(webhook.EventDeleted, ownerEmail, types.Complaint{DatastoreKey:s}, "")
+	}
+	return nil
+}
+
+// }}}
+// {{{ cdb.deleteAllInBatches
+
+// The datastore won't delete more than 500 keys in one call.
+const kDeleteBatchSize = 500
+
+// Deletes everything the query finds, a batch at a time, and returns how many it deleted.
+func (cdb ComplaintDB) deleteAllInBatches(q *datastore.Query) (int, error) {
+	n := 0
+	for {
+		keys,err := q.KeysOnly().Limit(kDeleteBatchSize).GetAll(cdb.C, nil)
+		if err != nil || len(keys) == 0 { return n, err }
+		if err := datastore.DeleteMulti(cdb.C, keys); err != nil { return n, err }
+		n += len(keys)
+		if len(keys) < kDeleteBatchSize { return n, nil }
+	}
 }
 
 // }}}
@@ -136,6 +158,23 @@ func (cdb ComplaintDB) GetProfileByCallerCode(cc string) (cp *types.ComplainerPr
 	return 
 }
 
+// }}}
+// {{{ cdb.GetProfileByPhoneNumber
+
+// Returns nil (and no error) if nobody has that number.
+func (cdb ComplaintDB) GetProfileByPhoneNumber(phone string) (*types.ComplainerProfile, error) {
+	q := datastore.NewQuery(kComplainerKind).Filter("PhoneNumber =", phone)
+	results := []types.ComplainerProfile{}
+	if _,err := q.GetAll(cdb.C, &results); err != nil {
+		return nil, err
+	} else if len(results) == 0 {
+		return nil, nil
+	} else if len(results) > 1 {
+		return nil, fmt.Errorf("lookup(%s) found %d results", phone, len(results))
+	}
+	return &results[0], nil
+}
+
 // }}}
 // {{{ cdb.GetProfileByEmailAddress
 
@@ -457,10 +496,32 @@ func (cdb ComplaintDB) GetComplaintByKey(keyString string, ownerEmail string) (*
 	return &complaint, nil
 }
 
+// }}}
+// {{{ ComplaintOwner
+
+// The email address of the user who owns the complaint with this key.
+func ComplaintOwner(keyString string) (string, error) {
+	k,err := datastore.DecodeKey(keyString)
+	if err != nil { return "", err }
+	if k.Kind() != kComplaintKind || k.Parent() == nil {
+		return "", fmt.Errorf("key <%v> is not a complaint", k)
+	}
+	return k.Parent().StringID(), nil
+}
+
 // }}}
 // {{{ cdb.UpdateComplaint
 
 func (cdb ComplaintDB) UpdateComplaint(complaint types.Complaint, ownerEmail string) error {
+	if err := cdb.updateComplaint(complaint, ownerEmail); err != nil { return err }
+	cdb.emitWebhookEvent(webhook.EventUpdated, ownerEmail, complaint, "")
+	return nil
+}
+
+// }}}
+// {{{ cdb.updateComplaint
+
+func (cdb ComplaintDB) updateComplaint(complaint types.Complaint, ownerEmail string) error {
 	k,err := datastore.DecodeKey(complaint.DatastoreKey)
 	if err != nil { return err }
 
@@ -534,10 +595,15 @@ func (cdb ComplaintDB) complainByProfile(cp types.ComplainerProfile, c *types.Co
 
 	// abw hack hack
 	grabAnything := (cp.CallerCode == "QWERTY")
-	c.Debug,_ = fr.FindOverhead(geo.Latlong{cp.Lat,cp.Long}, &overhead, grabAnything)	
+	if time.Since(c.Timestamp) < kLiveLookupWindow {
+		c.Debug,_ = fr.FindOverhead(geo.Latlong{cp.Lat,cp.Long}, &overhead, grabAnything)	
+	} else {
+		c.Debug = fmt.Sprintf("complaint is from %s; too old for a live lookup", c.Timestamp)
+	}
 
 	if overhead.Id != "" {
 		c.AircraftOverhead = overhead
+		ClassifyAircraft(c)
 	}
 
 	c.Version = kComplaintVersion
@@ -547,14 +613,31 @@ func (cdb ComplaintDB) complainByProfile(cp types.ComplainerProfile, c *types.Co
 	// Too much like the last complaint by this user ? Just update that one.
 	if prev, err := cdb.GetNewestComplaintByEmailAddress(cp.EmailAddress); err != nil {
 		cdb.C.Errorf("complainByProfile/GetNewest: %v", err)
-	} else if prev != nil && ComplaintsAreEquivalent(*prev, *c) {
+	} else if prev != nil && !c.Timestamp.Before(prev.Timestamp) && ComplaintsAreEquivalent(*prev, *c) {
 		// The two complaints are in fact one complaint. Overwrite the old one with data from new one.
 		Overwrite(prev, c)
-		return cdb.UpdateComplaint(*prev, cp.EmailAddress)
+		c.DatastoreKey = prev.DatastoreKey
+		if err := cdb.updateComplaint(*prev, cp.EmailAddress); err != nil { return err }
+		cdb.emitWebhookEvent(webhook.EventCoalesced, cp.EmailAddress, *prev, "")
+		return nil
 	}
 
 	key := datastore.NewIncompleteKey(cdb.C, kComplaintKind, cdb.emailToRootKey(cp.EmailAddress))	
-	_, err := datastore.Put(cdb.C, key, c)
+	key, err := datastore.Put(cdb.C, key, c)
+	if err != nil { return err }
+	c.DatastoreKey = key.Encode() // So the caller can find it again
+	cdb.emitWebhookEvent(webhook.EventCreated, cp.EmailAddress, *c, "")
+	// Only complaints the user is letting us pass on get streamed, anonymised or not
+	if time.Since(c.Timestamp) < kLiveLookupWindow && cp.CcSfo && !c.DoNotSubmit {
+		cdb.recordLiveEvent(cp, *c)
+	}
+
+	// Opted into prompt submission ? Queue it up; if that fails, the nightly scan will get it.
+	if cp.CcSfo && cp.SubmitPromptly && !cp.IsHeldForReview(*c) {
+		if err := cdb.EnqueueSubmission(cp.EmailAddress, key.Encode(), kSubmitSettleDelay); err != nil {
+			cdb.C.Errorf("complainByProfile/EnqueueSubmission: %v", err)
+		}
+	}
 
 	// TEMP
 /*
@@ -565,7 +648,7 @@ func (cdb ComplaintDB) complainByProfile(cp types.ComplainerProfile, c *types.Co
 		cdb.C.Infof("BKSV Debug\n------\n%s\n------\n", debug)
 	}
 */
-	return err
+	return nil
 }
 
 // }}}
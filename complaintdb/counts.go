@@ -106,6 +106,17 @@ func (cdb *ComplaintDB) GetDailyCounts(email string) ([]DailyCount, error) {
 	return c,nil
 }
 
+// }}}
+// {{{ ResetDailyCounts
+
+// Throws away the cached counts, so they get recomputed; needed when complaints are added
+// for days in the past (e.g. by an import).
+func (cdb *ComplaintDB) ResetDailyCounts(email string) error {
+	err := memcache.Delete(cdb.C, fmt.Sprintf("%s:daily", email))
+	if err == memcache.ErrCacheMiss { return nil }
+	return err
+}
+
 // }}}
 
 // {{{ -------------------------={ E N D }=----------------------------------
@@ -0,0 +1,180 @@
+package complaintdb
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Hardware buttons that make signed requests (see the button package). Unlike access
+// tokens, we have to keep the secret itself, since we need it to check signatures.
+
+const (
+	kButtonDeviceKind = "ButtonDevice"
+	kButtonNonceKind = "ButtonNonce" // Keyed by "<deviceID>:<nonce>"
+)
+
+// {{{ ButtonDevice
+
+type ButtonDevice struct {
+	ID           string    `datastore:"-"` // The datastore key name
+	EmailAddress string
+	Name         string    `datastore:",noindex"`
+	Secret       string    `datastore:",noindex"`
+	Created      time.Time `datastore:",noindex"`
+	LastUsed     time.Time `datastore:",noindex"`
+}
+
+type ButtonDevicesByCreatedDesc []ButtonDevice
+func (a ButtonDevicesByCreatedDesc) Len() int      { return len(a) }
+func (a ButtonDevicesByCreatedDesc) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ButtonDevicesByCreatedDesc) Less(i, j int) bool { return a[i].Created.After(a[j].Created) }
+
+// }}}
+// {{{ ButtonNonce
+
+type ButtonNonce struct {
+	Created time.Time
+}
+
+// }}}
+
+func (cdb ComplaintDB) buttonDeviceKey(id string) *datastore.Key {
+	return datastore.NewKey(cdb.C, kButtonDeviceKind, id, 0, nil)
+}
+
+func (cdb ComplaintDB) buttonNonceKey(deviceID, nonce string) *datastore.Key {
+	return datastore.NewKey(cdb.C, kButtonNonceKind, deviceID+":"+nonce, 0, nil)
+}
+
+// {{{ cdb.CreateButtonDevice
+
+func (cdb ComplaintDB) CreateButtonDevice(email, name string) (*ButtonDevice, error) {
+	id,secret := make([]byte, 8), make([]byte, 32)
+	if _,err := rand.Read(id); err != nil { return nil, err }
+	if _,err := rand.Read(secret); err != nil { return nil, err }
+
+	d := ButtonDevice{
+		ID: "btn_" + hex.EncodeToString(id),
+		EmailAddress: email,
+		Name: name,
+		Secret: base64.RawURLEncoding.EncodeToString(secret),
+		Created: time.Now(),
+	}
+	if _,err := datastore.Put(cdb.C, cdb.buttonDeviceKey(d.ID), &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// }}}
+// {{{ cdb.GetButtonDevice
+
+func (cdb ComplaintDB) GetButtonDevice(id string) (*ButtonDevice, error) {
+	d := ButtonDevice{ID: id}
+	if err := datastore.Get(cdb.C, cdb.buttonDeviceKey(id), &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// }}}
+// {{{ cdb.GetButtonDevices
+
+func (cdb ComplaintDB) GetButtonDevices(email string) ([]ButtonDevice, error) {
+	devices := []ButtonDevice{}
+	q := datastore.NewQuery(kButtonDeviceKind).Filter("EmailAddress =", email)
+	keys,err := q.GetAll(cdb.C, &devices)
+	if err != nil { return nil, err }
+
+	for i,k := range keys { devices[i].ID = k.StringID() }
+	sort.Sort(ButtonDevicesByCreatedDesc(devices))
+	return devices, nil
+}
+
+// }}}
+// {{{ cdb.DeleteButtonDevice
+
+func (cdb ComplaintDB) DeleteButtonDevice(email, id string) error {
+	d,err := cdb.GetButtonDevice(id)
+	if err != nil {
+		return err
+	} else if d.EmailAddress != email {
+		return fmt.Errorf("DeleteButtonDevice: device not owned by %s", email)
+	}
+	return datastore.Delete(cdb.C, cdb.buttonDeviceKey(id))
+}
+
+// }}}
+// {{{ cdb.TouchButtonDevice
+
+func (cdb ComplaintDB) TouchButtonDevice(d ButtonDevice) error {
+	if time.Since(d.LastUsed) < kLastUsedGranularity { return nil }
+	d.LastUsed = time.Now()
+	_,err := datastore.Put(cdb.C, cdb.buttonDeviceKey(d.ID), &d)
+	return err
+}
+
+// }}}
+// {{{ cdb.ClaimButtonNonce
+
+// Returns false if the nonce has been seen before for this device. This has to be a datastore
+// transaction, not memcache, since memcache can forget it, and let a captured press replay.
+func (cdb ComplaintDB) ClaimButtonNonce(deviceID, nonce string) (bool, error) {
+	k := cdb.buttonNonceKey(deviceID, nonce)
+	fresh := false
+	err := datastore.RunInTransaction(cdb.C, func(c appengine.Context) error {
+		n := ButtonNonce{}
+		if err := datastore.Get(c, k, &n); err == nil {
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		n.Created = time.Now()
+		if _,err := datastore.Put(c, k, &n); err != nil { return err }
+		fresh = true
+		return nil
+	}, nil)
+
+	if err != nil { return false, err }
+	return fresh, nil
+}
+
+// }}}
+// {{{ cdb.ReleaseButtonNonce
+
+// Forgets a claimed nonce, for when the press it came with couldn't be recorded; the device
+// will retry with the same nonce, and that has to be let through.
+func (cdb ComplaintDB) ReleaseButtonNonce(deviceID, nonce string) error {
+	err := datastore.Delete(cdb.C, cdb.buttonNonceKey(deviceID, nonce))
+	if err == datastore.ErrNoSuchEntity { err = nil }
+	return err
+}
+
+// }}}
+// {{{ cdb.PruneButtonNonces
+
+// Deletes nonces claimed before the time; they only need keeping for as long as their
+// timestamps would be accepted.
+func (cdb ComplaintDB) PruneButtonNonces(before time.Time) (int, error) {
+	q := datastore.NewQuery(kButtonNonceKind).Filter("Created <", before).KeysOnly().Limit(500)
+	keys,err := q.GetAll(cdb.C, nil)
+	if err != nil { return 0, err }
+	return len(keys), datastore.DeleteMulti(cdb.C, keys)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,107 @@
+package complaintdb
+
+import (
+	"fmt"
+	"time"
+
+	"appengine/datastore"
+
+	"github.com/skypies/complaints/complaintdb/types"
+)
+
+// Bulk imports of old complaints. The uploaded CSV is kept in an ImportJob (a child of the
+// user's root entity) while a task works through it in batches; the job also holds the tally,
+// for the results page.
+
+const (
+	kImportJobKind = "ImportJob"
+	MaxImportBytes = 900 * 1024 // Has to fit in a datastore entity
+)
+
+// {{{ ImportJob
+
+type ImportJob struct {
+	Key        string    `datastore:"-"`
+	Filename   string    `datastore:",noindex"`
+	CSV        []byte    `datastore:",noindex"`
+	Created    time.Time `datastore:",noindex"`
+
+	Offset     int       `datastore:",noindex"` // Next data row to look at
+	Rows       int       `datastore:",noindex"` // How many data rows there are in total
+	Imported   int       `datastore:",noindex"`
+	Duplicates int       `datastore:",noindex"`
+	Errors     []string  `datastore:",noindex"` // One per bad row
+	Started    bool      `datastore:",noindex"`
+	Done       bool      `datastore:",noindex"`
+}
+
+// }}}
+
+// {{{ cdb.CreateImportJob
+
+func (cdb ComplaintDB) CreateImportJob(email, filename string, csv []byte) (*ImportJob, error) {
+	if len(csv) > MaxImportBytes {
+		return nil, fmt.Errorf("file is too big (%d bytes); please split it up into files smaller than %dKB",
+			len(csv), MaxImportBytes/1024)
+	}
+
+	job := ImportJob{Filename: filename, CSV: csv, Created: time.Now()}
+	k := datastore.NewIncompleteKey(cdb.C, kImportJobKind, cdb.emailToRootKey(email))
+	k,err := datastore.Put(cdb.C, k, &job)
+	if err != nil { return nil, err }
+	job.Key = k.Encode()
+	return &job, nil
+}
+
+// }}}
+// {{{ cdb.GetImportJob
+
+func (cdb ComplaintDB) GetImportJob(keyString, ownerEmail string) (*ImportJob, error) {
+	k,err := datastore.DecodeKey(keyString)
+	if err != nil { return nil, err }
+	if k.Kind() != kImportJobKind || k.Parent() == nil || k.Parent().StringID() != ownerEmail {
+		return nil, fmt.Errorf("GetImportJob: key <%v> not owned by %s", k, ownerEmail)
+	}
+
+	job := ImportJob{}
+	if err := datastore.Get(cdb.C, k, &job); err != nil { return nil, err }
+	job.Key = keyString
+	return &job, nil
+}
+
+// }}}
+// {{{ cdb.PutImportJob
+
+func (cdb ComplaintDB) PutImportJob(job ImportJob) error {
+	k,err := datastore.DecodeKey(job.Key)
+	if err != nil { return err }
+	_,err = datastore.Put(cdb.C, k, &job)
+	return err
+}
+
+// }}}
+
+// {{{ cdb.AddHistoricalComplaints
+
+// Stores a batch of old complaints in one go. Like AddHistoricalComplaintByEmailAddress, this
+// skips the flight lookup, coalescing, submission and webhooks.
+func (cdb ComplaintDB) AddHistoricalComplaints(cp types.ComplainerProfile, complaints []types.Complaint) error {
+	keys := []*datastore.Key{}
+	for i,_ := range complaints {
+		complaints[i].Profile = cp
+		complaints[i].Version = kComplaintVersion
+		keys = append(keys, datastore.NewIncompleteKey(cdb.C, kComplaintKind, cdb.emailToRootKey(cp.EmailAddress)))
+	}
+	_,err := datastore.PutMulti(cdb.C, keys, complaints)
+	return err
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -46,3 +46,27 @@ func (cdb ComplaintDB)NewIter(q *datastore.Query) *ComplaintIterator {
 	}
 	return &ci
 }
+
+// Returns up to limit complaints from the query, starting from the cursor ("" means from the
+// beginning), and a cursor for the next page ("" if there are definitely no more).
+func (cdb ComplaintDB)GetComplaintsPage(q *datastore.Query, cursor string, limit int) ([]types.Complaint, string, error) {
+	if cursor != "" {
+		cur,err := datastore.DecodeCursor(cursor)
+		if err != nil { return nil, "", err }
+		q = q.Start(cur)
+	}
+
+	ci := cdb.NewIter(q.Limit(limit))
+	complaints := []types.Complaint{}
+	for {
+		c,err := ci.NextWithErr()
+		if err != nil { return nil, "", err }
+		if c == nil { break }
+		complaints = append(complaints, *c)
+	}
+
+	if len(complaints) < limit { return complaints, "", nil }
+	next,err := ci.Iter.Cursor()
+	if err != nil { return nil, "", err }
+	return complaints, next.String(), nil
+}
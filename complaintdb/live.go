@@ -0,0 +1,118 @@
+package complaintdb
+
+import (
+	"strconv"
+	"time"
+
+	"appengine/datastore"
+	"appengine/memcache"
+
+	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/live"
+)
+
+// A short-lived log of anonymised complaint events, for the live stream. Each event has no
+// link back to the user; just a rough location. The newest event's ID is kept in memcache,
+// so that waiting subscribers can check for news without a datastore query.
+
+const (
+	kLiveEventKind = "LiveEvent"
+	kMemcacheLiveLatestKey = "live-latest"
+	kLiveEventLifetime = 24 * time.Hour
+)
+
+// {{{ LiveEvent
+
+type LiveEvent struct {
+	Seq          int64     // UnixNano of when it was recorded; this is the event ID
+	Time         time.Time `datastore:",noindex"`
+	Lat,Long     float64   `datastore:",noindex"` // The middle of a live.CellSize grid cell
+	Zip          string    `datastore:",noindex"`
+	City         string    `datastore:",noindex"`
+	FlightNumber string    `datastore:",noindex"`
+	Loudness     int       `datastore:",noindex"`
+}
+
+func (le LiveEvent)Event() live.Event {
+	return live.Event{
+		ID: strconv.FormatInt(le.Seq, 10),
+		Time: le.Time,
+		Lat: le.Lat,
+		Long: le.Long,
+		Zip: le.Zip,
+		City: le.City,
+		FlightNumber: le.FlightNumber,
+		Loudness: le.Loudness,
+	}
+}
+
+// }}}
+
+// {{{ cdb.recordLiveEvent
+
+// Failures are only logged; the live stream is a nice-to-have.
+func (cdb ComplaintDB) recordLiveEvent(cp types.ComplainerProfile, c types.Complaint) {
+	addr := cp.GetStructuredAddress()
+	le := LiveEvent{
+		Seq: time.Now().UnixNano(),
+		Time: c.Timestamp,
+		Zip: addr.Zip,
+		City: addr.City,
+		FlightNumber: c.AircraftOverhead.FlightNumber,
+		Loudness: c.Loudness,
+	}
+	le.Lat,le.Long = live.Cell(cp.Lat, cp.Long)
+
+	k := datastore.NewIncompleteKey(cdb.C, kLiveEventKind, nil)
+	if _,err := datastore.Put(cdb.C, k, &le); err != nil {
+		cdb.C.Errorf("recordLiveEvent: %v", err)
+		return
+	}
+
+	item := memcache.Item{Key: kMemcacheLiveLatestKey, Value: []byte(strconv.FormatInt(le.Seq,10))}
+	if err := memcache.Set(cdb.C, &item); err != nil {
+		cdb.C.Errorf("recordLiveEvent: memcache: %v", err)
+	}
+}
+
+// }}}
+// {{{ cdb.LatestLiveEventSeq
+
+// Returns 0 if memcache doesn't know; callers should then go and look in the datastore.
+func (cdb ComplaintDB) LatestLiveEventSeq() int64 {
+	item,err := memcache.Get(cdb.C, kMemcacheLiveLatestKey)
+	if err != nil { return 0 }
+	seq,_ := strconv.ParseInt(string(item.Value), 10, 64)
+	return seq
+}
+
+// }}}
+// {{{ cdb.GetLiveEventsSince
+
+// Events recorded after the one with sequence number seq, oldest first. Ones that took a
+// while to commit can still turn up after later ones have been seen; see app/live.go.
+func (cdb ComplaintDB) GetLiveEventsSince(seq int64, limit int) ([]LiveEvent, error) {
+	events := []LiveEvent{}
+	q := datastore.NewQuery(kLiveEventKind).Filter("Seq >", seq).Order("Seq").Limit(limit)
+	if _,err := q.GetAll(cdb.C, &events); err != nil { return nil, err }
+	return events, nil
+}
+
+// }}}
+// {{{ cdb.PruneLiveEvents
+
+// Deletes events older than kLiveEventLifetime; returns how many went.
+func (cdb ComplaintDB) PruneLiveEvents() (int, error) {
+	cutoff := time.Now().Add(-kLiveEventLifetime).UnixNano()
+	return cdb.deleteAllInBatches(datastore.NewQuery(kLiveEventKind).Filter("Seq <", cutoff))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
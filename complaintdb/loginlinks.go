@@ -0,0 +1,98 @@
+package complaintdb
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Emailed login links. The link itself is signed (see the app's login-email.go); we keep a
+// record of each one, keyed by a hash of its token, so that it can only be used once.
+
+const kLoginLinkKind = "LoginLink"
+
+// {{{ LoginLink
+
+type LoginLink struct {
+	EmailAddress string
+	Created      time.Time
+	Expires      time.Time `datastore:",noindex"`
+	Used         time.Time `datastore:",noindex"` // Zero until it's used
+	RequestIP    string    `datastore:",noindex"`
+}
+
+// }}}
+
+func (cdb ComplaintDB) loginLinkKey(token string) *datastore.Key {
+	sum := sha256.Sum256([]byte(token))
+	return datastore.NewKey(cdb.C, kLoginLinkKind, hex.EncodeToString(sum[:]), 0, nil)
+}
+
+// {{{ cdb.CreateLoginLink
+
+// Returns the token for the link.
+func (cdb ComplaintDB) CreateLoginLink(email, ip string, ttl time.Duration) (string, time.Time, error) {
+	b := make([]byte, 24)
+	if _,err := rand.Read(b); err != nil { return "", time.Time{}, err }
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	l := LoginLink{
+		EmailAddress: email,
+		Created: time.Now(),
+		Expires: time.Now().Add(ttl),
+		RequestIP: ip,
+	}
+	if _,err := datastore.Put(cdb.C, cdb.loginLinkKey(token), &l); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, l.Expires, nil
+}
+
+// }}}
+// {{{ cdb.UseLoginLink
+
+// Marks the link as used; fails if it doesn't exist, was for a different address, has
+// expired, or has already been used.
+func (cdb ComplaintDB) UseLoginLink(email, token string) error {
+	k := cdb.loginLinkKey(token)
+	return datastore.RunInTransaction(cdb.C, func(c appengine.Context) error {
+		l := LoginLink{}
+		if err := datastore.Get(c, k, &l); err != nil {
+			return err
+		} else if l.EmailAddress != email {
+			return fmt.Errorf("link isn't for %s", email)
+		} else if !l.Used.IsZero() {
+			return fmt.Errorf("link was already used at %s", l.Used)
+		} else if time.Now().After(l.Expires) {
+			return fmt.Errorf("link expired at %s", l.Expires)
+		}
+		l.Used = time.Now()
+		_,err := datastore.Put(c, k, &l)
+		return err
+	}, nil)
+}
+
+// }}}
+// {{{ cdb.PruneLoginLinks
+
+// Deletes links that were made before the time; they're all long expired.
+func (cdb ComplaintDB) PruneLoginLinks(before time.Time) (int, error) {
+	q := datastore.NewQuery(kLoginLinkKind).Filter("Created <", before)
+	return cdb.deleteAllInBatches(q)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
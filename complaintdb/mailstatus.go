@@ -0,0 +1,123 @@
+package complaintdb
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// We keep track of the email addresses we can't deliver to, so we can stop trying.
+
+const (
+	kMailStatusKind = "MailStatus"
+
+	kSoftBounceLimit = 5                   // This many soft bounces makes an address undeliverable
+	kSoftBounceWindow = 30 * 24*time.Hour  // ... if they happen without a gap this long
+)
+
+// {{{ MailStatus
+
+type MailStatus struct {
+	EmailAddress  string
+	Undeliverable bool
+	Reason        string    `datastore:",noindex"`
+	HardBounces   int       `datastore:",noindex"`
+	SoftBounces   int       `datastore:",noindex"` // Recent ones; see kSoftBounceWindow
+	Complaints    int       `datastore:",noindex"` // Spam reports
+	LastBounce    time.Time `datastore:",noindex"`
+}
+
+type MailStatusByLastBounceDesc []MailStatus
+func (a MailStatusByLastBounceDesc) Len() int      { return len(a) }
+func (a MailStatusByLastBounceDesc) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a MailStatusByLastBounceDesc) Less(i, j int) bool {
+	return a[i].LastBounce.After(a[j].LastBounce)
+}
+
+// }}}
+
+func (cdb ComplaintDB) mailStatusKey(email string) *datastore.Key {
+	return datastore.NewKey(cdb.C, kMailStatusKind, strings.ToLower(email), 0, nil)
+}
+
+// {{{ cdb.RecordBounce
+
+// bounceType is one of the mailer.Bounce* strings.
+func (cdb ComplaintDB) RecordBounce(email, bounceType, reason string) error {
+	k := cdb.mailStatusKey(email)
+
+	return datastore.RunInTransaction(cdb.C, func(c appengine.Context) error {
+		ms := MailStatus{}
+		if err := datastore.Get(c, k, &ms); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		ms.EmailAddress = strings.ToLower(email)
+
+		switch bounceType {
+		case "hard":
+			ms.HardBounces++
+			ms.Undeliverable = true
+		case "complaint":
+			ms.Complaints++
+			ms.Undeliverable = true
+		default:
+			if time.Since(ms.LastBounce) > kSoftBounceWindow { ms.SoftBounces = 0 }
+			ms.SoftBounces++
+			if ms.SoftBounces >= kSoftBounceLimit { ms.Undeliverable = true }
+		}
+		ms.Reason = reason
+		ms.LastBounce = time.Now()
+
+		_,err := datastore.Put(c, k, &ms)
+		return err
+	}, nil)
+}
+
+// }}}
+// {{{ cdb.ClearMailStatus
+
+// Forget all the bounces for an address, making it deliverable again.
+func (cdb ComplaintDB) ClearMailStatus(email string) error {
+	return datastore.Delete(cdb.C, cdb.mailStatusKey(email))
+}
+
+// }}}
+// {{{ cdb.GetAllMailStatuses
+
+func (cdb ComplaintDB) GetAllMailStatuses() ([]MailStatus, error) {
+	statuses := []MailStatus{}
+	if _,err := datastore.NewQuery(kMailStatusKind).GetAll(cdb.C, &statuses); err != nil {
+		return nil, err
+	}
+	sort.Sort(MailStatusByLastBounceDesc(statuses))
+	return statuses, nil
+}
+
+// }}}
+// {{{ cdb.GetSuppressedAddresses
+
+// The set of addresses we should no longer send email to (all lowercase).
+func (cdb ComplaintDB) GetSuppressedAddresses() (map[string]bool, error) {
+	statuses := []MailStatus{}
+	q := datastore.NewQuery(kMailStatusKind).Filter("Undeliverable =", true)
+	if _,err := q.GetAll(cdb.C, &statuses); err != nil {
+		return map[string]bool{}, err
+	}
+
+	suppressed := map[string]bool{}
+	for _,ms := range statuses { suppressed[ms.EmailAddress] = true }
+	return suppressed, nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,147 @@
+package complaintdb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Phone numbers have to be verified before they go into a profile, else anyone could claim
+// someone else's number (and complain by text as them). We text a code to the number, and
+// keep a record of it (keyed by email address, so each user has at most one pending) until
+// they type it back in.
+
+const (
+	kPhoneVerificationKind = "PhoneVerification"
+	kPhoneVerifyMaxAttempts = 5
+)
+
+// {{{ PhoneVerification
+
+type PhoneVerification struct {
+	PhoneNumber string
+	CodeHash    string    `datastore:",noindex"`
+	Created     time.Time
+	Expires     time.Time `datastore:",noindex"`
+	Attempts    int       `datastore:",noindex"` // Wrong codes entered so far
+}
+
+func (v PhoneVerification)IsExpired() bool { return time.Now().After(v.Expires) }
+
+// }}}
+
+func (cdb ComplaintDB) phoneVerificationKey(email string) *datastore.Key {
+	return datastore.NewKey(cdb.C, kPhoneVerificationKind, email, 0, nil)
+}
+
+func phoneCodeHash(phone, code string) string {
+	sum := sha256.Sum256([]byte(phone + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// {{{ cdb.CreatePhoneVerification
+
+// Replaces any pending verification for the user; returns the six digit code to text them.
+func (cdb ComplaintDB) CreatePhoneVerification(email, phone string, ttl time.Duration) (string, error) {
+	n,err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil { return "", err }
+	code := fmt.Sprintf("%06d", n.Int64())
+
+	v := PhoneVerification{
+		PhoneNumber: phone,
+		CodeHash: phoneCodeHash(phone, code),
+		Created: time.Now(),
+		Expires: time.Now().Add(ttl),
+	}
+	if _,err := datastore.Put(cdb.C, cdb.phoneVerificationKey(email), &v); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// }}}
+// {{{ cdb.GetPhoneVerification
+
+// Returns nil (and no error) if there isn't one.
+func (cdb ComplaintDB) GetPhoneVerification(email string) (*PhoneVerification, error) {
+	v := PhoneVerification{}
+	if err := datastore.Get(cdb.C, cdb.phoneVerificationKey(email), &v); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// }}}
+// {{{ cdb.UsePhoneVerification
+
+// If the code is right, removes the pending verification and returns the number it was for.
+// Each wrong code counts against it; after a few, or once it has expired, it's no good.
+func (cdb ComplaintDB) UsePhoneVerification(email, code string) (string, error) {
+	k := cdb.phoneVerificationKey(email)
+	phone,attempts := "",0
+	err := datastore.RunInTransaction(cdb.C, func(c appengine.Context) error {
+		phone,attempts = "",0 // In case this is a retry
+		v := PhoneVerification{}
+		if err := datastore.Get(c, k, &v); err != nil {
+			return err
+		} else if v.IsExpired() {
+			return fmt.Errorf("code expired at %s", v.Expires)
+		} else if v.Attempts >= kPhoneVerifyMaxAttempts {
+			return fmt.Errorf("too many wrong codes")
+		}
+
+		if !hmac.Equal([]byte(phoneCodeHash(v.PhoneNumber, code)), []byte(v.CodeHash)) {
+			// Returning an error would roll this back, so the count is passed out instead
+			v.Attempts++
+			attempts = v.Attempts
+			_,err := datastore.Put(c, k, &v)
+			return err
+		}
+		phone = v.PhoneNumber
+		return datastore.Delete(c, k)
+	}, nil)
+
+	if err != nil {
+		return "", err
+	} else if phone == "" {
+		return "", fmt.Errorf("wrong code (attempt %d)", attempts)
+	}
+	return phone, nil
+}
+
+// }}}
+// {{{ cdb.DeletePhoneVerification
+
+// Drops any pending verification; it's fine if there isn't one.
+func (cdb ComplaintDB) DeletePhoneVerification(email string) error {
+	err := datastore.Delete(cdb.C, cdb.phoneVerificationKey(email))
+	if err == datastore.ErrNoSuchEntity { err = nil }
+	return err
+}
+
+// }}}
+// {{{ cdb.PrunePhoneVerifications
+
+func (cdb ComplaintDB) PrunePhoneVerifications(before time.Time) (int, error) {
+	q := datastore.NewQuery(kPhoneVerificationKind).Filter("Created <", before)
+	return cdb.deleteAllInBatches(q)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
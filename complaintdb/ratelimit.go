@@ -0,0 +1,40 @@
+package complaintdb
+
+import (
+	"time"
+
+	"appengine/memcache"
+)
+
+// {{{ cdb.UnderRateLimit
+
+// Counts a hit against the key, and says whether there have been no more than limit hits in
+// the current window (which starts with the first hit). Counts live in memcache, so can be
+// lost early; that errs on the side of letting people through.
+func (cdb ComplaintDB) UnderRateLimit(key string, limit int, window time.Duration) (bool, error) {
+	k := "ratelimit:" + key
+	item := memcache.Item{Key: k, Value: []byte("1"), Expiration: window}
+	if err := memcache.Add(cdb.C, &item); err == nil {
+		return true, nil
+	} else if err != memcache.ErrNotStored {
+		return true, err
+	}
+
+	n,err := memcache.IncrementExisting(cdb.C, k, 1)
+	if err == memcache.ErrCacheMiss {
+		return true, nil // Expired since the Add
+	} else if err != nil {
+		return true, err
+	}
+	return n <= uint64(limit), nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
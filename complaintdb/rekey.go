@@ -0,0 +1,278 @@
+package complaintdb
+
+import (
+	"fmt"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+
+	"github.com/skypies/util/date"
+
+	"github.com/skypies/complaints/complaintdb/types"
+)
+
+// Moving an account to a different email address. The address is the name of the root key
+// that the profile and all the complaints hang off. First the profile and everything that
+// can file complaints (sessions, tokens, buttons, webhooks) move over, so that nothing new
+// lands under the old root; then every complaint moves to the new root, a batch at a time,
+// until there are none left; then whatever else is under the old root goes. If the new
+// address already has an account, the two get merged: the new address keeps its own
+// profile, and gains the old one's complaints.
+
+const (
+	kRekeyKind = "Rekey"
+
+	// Moved complaints this recent get queued up for submission again, in case they were
+	// waiting to be sent (the queued task names the old key)
+	kRekeyResubmitWindow = 24 * time.Hour
+)
+
+// {{{ Rekey
+
+type Rekey struct {
+	From      string    `datastore:"-"` // The datastore key name
+	To        string
+	Requested time.Time `datastore:",noindex"`
+	Started   time.Time `datastore:",noindex"` // When the profile etc. moved; zero until then
+	Moved     int       `datastore:",noindex"` // How many complaints, so far
+	Done      time.Time `datastore:",noindex"` // Zero until it has finished
+}
+
+func (r Rekey)IsStarted() bool { return !r.Started.IsZero() }
+
+func (r Rekey)IsDone() bool { return !r.Done.IsZero() }
+
+// }}}
+
+func (cdb ComplaintDB) rekeyKey(from string) *datastore.Key {
+	return datastore.NewKey(cdb.C, kRekeyKind, from, 0, nil)
+}
+
+// {{{ cdb.CreateRekey
+
+func (cdb ComplaintDB) CreateRekey(from, to string) (*Rekey, error) {
+	if from == to {
+		return nil, fmt.Errorf("that's the same address")
+	} else if r,err := cdb.GetRekey(from); err != nil {
+		return nil, err
+	} else if r != nil && !r.IsDone() {
+		return nil, fmt.Errorf("%s is already being moved to %s", from, r.To)
+	} else if r,err := cdb.GetRekey(to); err != nil {
+		return nil, err
+	} else if r != nil && !r.IsDone() {
+		return nil, fmt.Errorf("%s is being moved to %s", to, r.To)
+	}
+
+	r := Rekey{From: from, To: to, Requested: time.Now()}
+	if _,err := datastore.Put(cdb.C, cdb.rekeyKey(from), &r); err != nil { return nil, err }
+	return &r, nil
+}
+
+// }}}
+// {{{ cdb.GetRekey
+
+// Returns nil (and no error) if there isn't one.
+func (cdb ComplaintDB) GetRekey(from string) (*Rekey, error) {
+	r := Rekey{}
+	if err := datastore.Get(cdb.C, cdb.rekeyKey(from), &r); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r.From = from
+	return &r, nil
+}
+
+// }}}
+// {{{ cdb.PutRekey
+
+func (cdb ComplaintDB) PutRekey(r Rekey) error {
+	_,err := datastore.Put(cdb.C, cdb.rekeyKey(r.From), &r)
+	return err
+}
+
+// }}}
+
+// {{{ cdb.MoveComplaints
+
+// Moves up to n complaints from one address to the other, and returns how many it moved;
+// zero means they're all done. Each batch moves in a single (cross-group) transaction, so a
+// complaint is never in both places, or neither. Complaints keep their IDs, unless the new
+// address already has a complaint with the same one.
+func (cdb ComplaintDB) MoveComplaints(from, to string, n int) (int, error) {
+	moved := []types.Complaint{}
+	newKeys := []*datastore.Key{}
+	err := datastore.RunInTransaction(cdb.C, func(c appengine.Context) error {
+		moved,newKeys = nil,nil // In case this is a retry
+		complaints := []types.Complaint{}
+		q := datastore.NewQuery(kComplaintKind).Ancestor(cdb.emailToRootKey(from)).Limit(n)
+		keys,err := q.GetAll(c, &complaints)
+		if err != nil || len(keys) == 0 { return err }
+
+		newRoot := cdb.emailToRootKey(to)
+		for _,k := range keys {
+			newKeys = append(newKeys, datastore.NewKey(c, kComplaintKind, k.StringID(), k.IntID(), newRoot))
+		}
+		existing := make([]datastore.PropertyList, len(newKeys)) // Just to see if they're there
+		err = datastore.GetMulti(c, newKeys, existing)
+		merr,_ := err.(appengine.MultiError)
+		if err != nil && merr == nil { return err }
+		for i,_ := range newKeys {
+			if merr == nil || merr[i] == nil {
+				newKeys[i] = datastore.NewIncompleteKey(c, kComplaintKind, newRoot) // Taken
+			} else if merr[i] != datastore.ErrNoSuchEntity {
+				return merr[i]
+			}
+		}
+
+		for i,_ := range complaints {
+			complaints[i].Profile.EmailAddress = to
+		}
+		if newKeys,err = datastore.PutMulti(c, newKeys, complaints); err != nil { return err }
+		if err := datastore.DeleteMulti(c, keys); err != nil { return err }
+		moved = complaints
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
+
+	if err != nil { return 0, err }
+	cdb.resubmitMovedComplaints(to, moved, newKeys)
+	return len(moved), nil
+}
+
+// }}}
+// {{{ cdb.resubmitMovedComplaints
+
+// A complaint may have been waiting in the queue to be submitted when it moved; the task
+// names the old key, so it won't find it. Queue recent ones up again under the new key; the
+// task checks what still needs sending, so extras are harmless.
+func (cdb ComplaintDB) resubmitMovedComplaints(to string, complaints []types.Complaint, keys []*datastore.Key) {
+	if len(complaints) == 0 { return }
+	cp,err := cdb.GetProfileByEmailAddress(to)
+	if err != nil {
+		cdb.C.Errorf("rekey: resubmit: profile <%s>: %v", to, err)
+		return
+	} else if !cp.CcSfo || !cp.SubmitPromptly {
+		return // The nightly scan sends them
+	}
+
+	for i,c := range complaints {
+		if time.Since(c.Timestamp) > kRekeyResubmitWindow || cp.IsHeldForReview(c) { continue }
+		if err := cdb.EnqueueSubmission(to, keys[i].Encode(), kSubmitSettleDelay); err != nil {
+			cdb.C.Errorf("rekey: resubmit %s: %v", keys[i].Encode(), err)
+		}
+	}
+}
+
+// }}}
+// {{{ cdb.StartRekey
+
+// Before any complaints move, this moves everything that could add more under the old
+// address: the profile (unless the new address already has one; either way, the old one
+// goes, so texts and emails find the new account), and the tokens, buttons, webhooks and
+// roles. The old address's sessions are ended. It's safe to rerun.
+func (cdb ComplaintDB) StartRekey(from, to string) error {
+	oldRoot := cdb.emailToRootKey(from)
+
+	if cp,err := cdb.GetProfileByEmailAddress(from); err == nil {
+		if _,err := cdb.GetProfileByEmailAddress(to); err == datastore.ErrNoSuchEntity {
+			cp.EmailAddress = to
+			if err := cdb.PutProfile(*cp); err != nil { return err }
+		} else if err != nil {
+			return err
+		}
+		if err := datastore.Delete(cdb.C, oldRoot); err != nil { return err }
+	} else if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	// These all say whose they are in an EmailAddress field
+	for _,kind := range []string{kAccessTokenKind, kButtonDeviceKind, kWebhookKind} {
+		pls := []datastore.PropertyList{}
+		keys,err := datastore.NewQuery(kind).Filter("EmailAddress =", from).GetAll(cdb.C, &pls)
+		if err != nil { return err }
+		for i,_ := range pls {
+			for j,_ := range pls[i] {
+				if pls[i][j].Name == "EmailAddress" { pls[i][j].Value = to }
+			}
+		}
+		if _,err := datastore.PutMulti(cdb.C, keys, pls); err != nil { return err }
+	}
+
+	if roles,err := cdb.GetRoles(from); err != nil {
+		return err
+	} else if len(roles) > 0 {
+		if existing,err := cdb.GetRoles(to); err != nil {
+			return err
+		} else if len(existing) == 0 {
+			if err := cdb.SetRoles(to, roles, "moved from "+from); err != nil { return err }
+		}
+		if err := cdb.SetRoles(from, nil, ""); err != nil { return err }
+	}
+
+	if err := cdb.DeletePhoneVerification(from); err != nil { return err }
+
+	if sessions,err := cdb.GetSessionsByEmailAddress(from); err != nil {
+		return err
+	} else {
+		keys := []string{}
+		for _,s := range sessions { keys = append(keys, s.Key) }
+		if err := cdb.DeleteSessions(keys); err != nil { return err }
+	}
+	return nil
+}
+
+// }}}
+// {{{ cdb.FinishRekey
+
+// Once the complaints have moved, this deletes whatever else is left under the old root
+// (e.g. import jobs), and throws away both addresses' cached counts and complaints. It
+// never deletes complaints; any that turn up are left for MoveComplaints.
+func (cdb ComplaintDB) FinishRekey(from, to string) error {
+	oldRoot := cdb.emailToRootKey(from)
+
+	// A kindless query can't filter on kind, so weed the complaints out here
+	keys,err := datastore.NewQuery("").Ancestor(oldRoot).KeysOnly().GetAll(cdb.C, nil)
+	if err != nil { return err }
+	rest := []*datastore.Key{}
+	for _,k := range keys {
+		if k.Kind() != kComplaintKind { rest = append(rest, k) }
+	}
+	for len(rest) > 0 {
+		batch := rest
+		if len(batch) > kDeleteBatchSize { batch = batch[:kDeleteBatchSize] }
+		if err := datastore.DeleteMulti(cdb.C, batch); err != nil { return err }
+		rest = rest[len(batch):]
+	}
+
+	for _,email := range []string{from, to} {
+		if err := cdb.ResetDailyCounts(email); err != nil { return err }
+		cdb.forgetCachedDays(email, 90)
+	}
+	return nil
+}
+
+// }}}
+// {{{ cdb.forgetCachedDays
+
+// GetComplaintsInSpanByEmailAddress caches whole days once they're over; throw away the
+// recent ones. (Dropping the first shard is enough to make it a cache miss.)
+func (cdb ComplaintDB) forgetCachedDays(email string, days int) {
+	keys := []string{}
+	for i:=1; i<=days; i++ {
+		s,e := date.WindowForTime(time.Now().AddDate(0,0,-i))
+		keys = append(keys, fmt.Sprintf("=0=comp-in-span:%s:%d-%d", email, s.Unix(), e.Unix()))
+	}
+	memcache.DeleteMulti(cdb.C, keys) // Mostly cache misses, which are fine
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
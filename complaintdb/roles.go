@@ -0,0 +1,106 @@
+package complaintdb
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"appengine/datastore"
+)
+
+// Roles for staff features; see the rbac package, which uses them to guard handlers. Everyone
+// who is logged in has RoleUser, so it never needs granting; the others are stored per email
+// address. App Engine admins are always treated as having RoleAdmin.
+
+const (
+	kRoleGrantKind = "RoleGrant"
+
+	RoleAdmin         = "admin"          // Everything, including granting roles
+	RoleAnalyst       = "analyst"        // Reports, and the flight database
+	RoleCommunityLead = "community-lead" // Reports
+	RoleUser          = "user"           // Their own complaints
+)
+
+// The roles that can be granted, most powerful first.
+var GrantableRoles = []string{RoleAdmin, RoleAnalyst, RoleCommunityLead}
+
+// {{{ RoleGrant
+
+type RoleGrant struct {
+	EmailAddress string    `datastore:"-"` // The datastore key name
+	Roles        []string  `datastore:",noindex"`
+	GrantedBy    string    `datastore:",noindex"`
+	Updated      time.Time `datastore:",noindex"`
+}
+
+type RoleGrantsByEmail []RoleGrant
+func (a RoleGrantsByEmail) Len() int      { return len(a) }
+func (a RoleGrantsByEmail) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a RoleGrantsByEmail) Less(i, j int) bool { return a[i].EmailAddress < a[j].EmailAddress }
+
+// }}}
+
+func (cdb ComplaintDB) roleGrantKey(email string) *datastore.Key {
+	return datastore.NewKey(cdb.C, kRoleGrantKind, email, 0, nil)
+}
+
+// {{{ cdb.GetRoles
+
+// The roles granted to the email address; nil if there aren't any.
+func (cdb ComplaintDB) GetRoles(email string) ([]string, error) {
+	g := RoleGrant{}
+	if err := datastore.Get(cdb.C, cdb.roleGrantKey(email), &g); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return g.Roles, nil
+}
+
+// }}}
+// {{{ cdb.SetRoles
+
+// Replaces the roles granted to the email address; no roles removes the grant altogether.
+func (cdb ComplaintDB) SetRoles(email string, roles []string, grantedBy string) error {
+	known := map[string]bool{}
+	for _,r := range GrantableRoles { known[r] = true }
+	for _,r := range roles {
+		if !known[r] { return fmt.Errorf("can't grant role %q", r) }
+	}
+
+	k := cdb.roleGrantKey(email)
+	if len(roles) == 0 {
+		if err := datastore.Delete(cdb.C, k); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		return nil
+	}
+
+	g := RoleGrant{Roles: roles, GrantedBy: grantedBy, Updated: time.Now()}
+	_,err := datastore.Put(cdb.C, k, &g)
+	return err
+}
+
+// }}}
+// {{{ cdb.GetRoleGrants
+
+// Everyone who has been granted a role.
+func (cdb ComplaintDB) GetRoleGrants() ([]RoleGrant, error) {
+	grants := []RoleGrant{}
+	keys,err := datastore.NewQuery(kRoleGrantKind).GetAll(cdb.C, &grants)
+	if err != nil { return nil, err }
+
+	for i,k := range keys { grants[i].EmailAddress = k.StringID() }
+	sort.Sort(RoleGrantsByEmail(grants))
+	return grants, nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
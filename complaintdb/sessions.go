@@ -0,0 +1,139 @@
+package complaintdb
+
+import (
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+// Login sessions (see the sessions package, which owns the cookie). They're keyed by a hash
+// of the session ID in the cookie, so the key can be shown on a page, or leak, harmlessly.
+// They're read on every request, so they're cached in memcache.
+
+const (
+	kSessionKind = "Session"
+	kMemcacheSessionPrefix = "session:"
+)
+
+// {{{ Session
+
+type Session struct {
+	Key          string    `datastore:"-"`
+	EmailAddress string    // Who's logged in (the admin, if they're impersonating); "" if nobody
+	Values       []byte    `datastore:",noindex"` // Everything else, gob encoded
+	UserAgent    string    `datastore:",noindex"`
+	IP           string    `datastore:",noindex"` // As of LastSeen
+	Created      time.Time `datastore:",noindex"`
+	LastSeen     time.Time
+	Expires      time.Time
+}
+
+// }}}
+
+// {{{ cdb.GetSession
+
+// Returns nil (and no error) if there is no such session.
+func (cdb ComplaintDB) GetSession(key string) (*Session, error) {
+	s := Session{}
+	if _,err := memcache.Gob.Get(cdb.C, kMemcacheSessionPrefix+key, &s); err == nil {
+		s.Key = key
+		return &s, nil
+	} else if err != memcache.ErrCacheMiss {
+		cdb.C.Errorf("GetSession memcache: %v", err)
+	}
+
+	k := datastore.NewKey(cdb.C, kSessionKind, key, 0, nil)
+	if err := datastore.Get(cdb.C, k, &s); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	s.Key = key
+	cdb.cacheSession(s)
+	return &s, nil
+}
+
+func (cdb ComplaintDB) cacheSession(s Session) {
+	item := memcache.Item{Key: kMemcacheSessionPrefix+s.Key, Object: s, Expiration: time.Hour}
+	if err := memcache.Gob.Set(cdb.C, &item); err != nil {
+		cdb.C.Errorf("session memcache set: %v", err)
+	}
+}
+
+// }}}
+// {{{ cdb.PutSession
+
+func (cdb ComplaintDB) PutSession(s Session) error {
+	k := datastore.NewKey(cdb.C, kSessionKind, s.Key, 0, nil)
+	if _,err := datastore.Put(cdb.C, k, &s); err != nil { return err }
+	cdb.cacheSession(s)
+	return nil
+}
+
+// }}}
+// {{{ cdb.DeleteSessions
+
+func (cdb ComplaintDB) DeleteSessions(keys []string) error {
+	dskeys := []*datastore.Key{}
+	mckeys := []string{}
+	for _,key := range keys {
+		dskeys = append(dskeys, datastore.NewKey(cdb.C, kSessionKind, key, 0, nil))
+		mckeys = append(mckeys, kMemcacheSessionPrefix+key)
+	}
+	if err := datastore.DeleteMulti(cdb.C, dskeys); err != nil { return err }
+	if err := memcache.DeleteMulti(cdb.C, mckeys); err != nil {
+		if me,ok := err.(appengine.MultiError); !ok || !allCacheMisses(me) { return err }
+	}
+	return nil
+}
+
+func allCacheMisses(me appengine.MultiError) bool {
+	for _,err := range me {
+		if err != nil && err != memcache.ErrCacheMiss { return false }
+	}
+	return true
+}
+
+// }}}
+// {{{ cdb.GetSessionsByEmailAddress
+
+// The unexpired sessions someone is logged in to, most recently used first.
+func (cdb ComplaintDB) GetSessionsByEmailAddress(email string) ([]Session, error) {
+	q := datastore.NewQuery(kSessionKind).Filter("EmailAddress =", email).Order("-LastSeen")
+	sessions := []Session{}
+	keys,err := q.GetAll(cdb.C, &sessions)
+	if err != nil { return nil, err }
+
+	ret := []Session{}
+	for i,_ := range sessions {
+		if time.Now().After(sessions[i].Expires) { continue }
+		sessions[i].Key = keys[i].StringID()
+		ret = append(ret, sessions[i])
+	}
+	return ret, nil
+}
+
+// }}}
+// {{{ cdb.PruneSessions
+
+// Deletes sessions that expired before the time.
+func (cdb ComplaintDB) PruneSessions(before time.Time) (int, error) {
+	q := datastore.NewQuery(kSessionKind).Filter("Expires <", before).KeysOnly().Limit(500)
+	keys,err := q.GetAll(cdb.C, nil)
+	if err != nil { return 0, err }
+	strs := []string{}
+	for _,k := range keys { strs = append(strs, k.StringID()) }
+	return len(keys), cdb.DeleteSessions(strs)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
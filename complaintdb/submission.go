@@ -0,0 +1,80 @@
+package complaintdb
+
+import (
+	"fmt"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+
+	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/webhook"
+)
+
+const (
+	// How long to wait before submitting a fresh complaint; this gives any follow-up clicks
+	// the chance to get coalesced into it first.
+	kSubmitSettleDelay = 10 * time.Minute
+)
+
+// {{{ cdb.EnqueueSubmission
+
+// Queue up a task that will submit a single complaint, after the delay.
+func (cdb ComplaintDB) EnqueueSubmission(ownerEmail, keyString string, delay time.Duration) error {
+	t := taskqueue.NewPOSTTask("/task/bksv-submit-complaint", map[string][]string{
+		"user": {ownerEmail},
+		"key":  {keyString},
+	})
+	t.Delay = delay
+
+	_,err := taskqueue.Add(cdb.C, t, "submitreports")
+	return err
+}
+
+// }}}
+// {{{ cdb.AddSubmission
+
+// Record that a complaint was accepted by an airport. This happens in a transaction, so
+// that we don't clobber any edits the user made while we were talking to the airport.
+func (cdb ComplaintDB) AddSubmission(keyString string, ownerEmail string, s types.Submission) error {
+	k,err := datastore.DecodeKey(keyString)
+	if err != nil { return err }
+
+	if k.Parent() == nil {
+		return fmt.Errorf("AddSubmission: key <%v> had no parent", k)
+	}
+	if k.Parent().StringID() != ownerEmail {
+		return fmt.Errorf("AddSubmission: key <%v> owned by %s, not %s", k, k.Parent().StringID(), ownerEmail)
+	}
+
+	complaint := types.Complaint{}
+	added := false
+	err = datastore.RunInTransaction(cdb.C, func(c appengine.Context) error {
+		complaint = types.Complaint{}
+		if err := datastore.Get(c, k, &complaint); err != nil { return err }
+
+		if complaint.HasBeenSubmittedTo(s.Airport) { return nil }
+		complaint.Submissions = append(complaint.Submissions, s)
+
+		_,err := datastore.Put(c, k, &complaint)
+		added = (err == nil)
+		return err
+	}, nil)
+
+	if err == nil && added {
+		FixupComplaint(&complaint, k)
+		cdb.emitWebhookEvent(webhook.EventSubmitted, ownerEmail, complaint, s.Airport)
+	}
+	return err
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,159 @@
+package complaintdb
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"appengine/datastore"
+)
+
+// Personal access tokens, for the API and for buttons. We only store a hash of the token;
+// the token itself is shown to the user once, when it's made.
+
+const (
+	kAccessTokenKind = "AccessToken"
+	kAccessTokenPrefix = "cpt_"
+	kLastUsedGranularity = time.Hour // Don't write the entity back on every single use
+
+	ScopeComplain = "complain" // Make new complaints (e.g. a button)
+	ScopeRead     = "read"     // Read complaints and the profile
+	ScopeWrite    = "write"    // Everything: make, read, change and delete
+)
+
+var AllScopes = []string{ScopeComplain, ScopeRead, ScopeWrite}
+
+// {{{ AccessToken
+
+type AccessToken struct {
+	ID           string    `datastore:"-"` // The hash; the datastore key name
+	EmailAddress string
+	Name         string    `datastore:",noindex"`
+	Hint         string    `datastore:",noindex"` // The first few chars, to help tell tokens apart
+	Scopes       []string  `datastore:",noindex"`
+	Created      time.Time `datastore:",noindex"`
+	LastUsed     time.Time `datastore:",noindex"`
+}
+
+// The write scope implies all the others.
+func (t AccessToken)HasScope(scope string) bool {
+	for _,s := range t.Scopes {
+		if s == scope || s == ScopeWrite { return true }
+	}
+	return false
+}
+
+type AccessTokensByCreatedDesc []AccessToken
+func (a AccessTokensByCreatedDesc) Len() int      { return len(a) }
+func (a AccessTokensByCreatedDesc) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a AccessTokensByCreatedDesc) Less(i, j int) bool { return a[i].Created.After(a[j].Created) }
+
+// }}}
+
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (cdb ComplaintDB) accessTokenKey(id string) *datastore.Key {
+	return datastore.NewKey(cdb.C, kAccessTokenKind, id, 0, nil)
+}
+
+// {{{ IsAccessToken
+
+// Tokens have a fixed prefix, so they're easy to tell apart from caller codes (and easy to
+// spot if they leak somewhere).
+func IsAccessToken(s string) bool { return strings.HasPrefix(s, kAccessTokenPrefix) }
+
+// }}}
+// {{{ cdb.CreateAccessToken
+
+// Returns the new token; this is the only time it's available.
+func (cdb ComplaintDB) CreateAccessToken(email, name string, scopes []string) (string, error) {
+	known := map[string]bool{}
+	for _,s := range AllScopes { known[s] = true }
+	if len(scopes) == 0 { return "", fmt.Errorf("a token needs at least one scope") }
+	for _,s := range scopes {
+		if !known[s] { return "", fmt.Errorf("unknown scope %q", s) }
+	}
+
+	b := make([]byte, 32)
+	if _,err := rand.Read(b); err != nil { return "", err }
+	token := kAccessTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	t := AccessToken{
+		EmailAddress: email,
+		Name: name,
+		Hint: token[:len(kAccessTokenPrefix)+4],
+		Scopes: scopes,
+		Created: time.Now(),
+	}
+	if _,err := datastore.Put(cdb.C, cdb.accessTokenKey(hashAccessToken(token)), &t); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// }}}
+// {{{ cdb.LookupAccessToken
+
+// Returns datastore.ErrNoSuchEntity if the token doesn't exist (or has been revoked). Also
+// notes that the token has been used.
+func (cdb ComplaintDB) LookupAccessToken(token string) (*AccessToken, error) {
+	t := AccessToken{ID: hashAccessToken(token)}
+	k := cdb.accessTokenKey(t.ID)
+	if err := datastore.Get(cdb.C, k, &t); err != nil {
+		return nil, err
+	}
+
+	if time.Since(t.LastUsed) > kLastUsedGranularity {
+		t.LastUsed = time.Now()
+		if _,err := datastore.Put(cdb.C, k, &t); err != nil {
+			cdb.C.Errorf("LookupAccessToken: update LastUsed: %v", err)
+		}
+	}
+	return &t, nil
+}
+
+// }}}
+// {{{ cdb.GetAccessTokens
+
+func (cdb ComplaintDB) GetAccessTokens(email string) ([]AccessToken, error) {
+	tokens := []AccessToken{}
+	q := datastore.NewQuery(kAccessTokenKind).Filter("EmailAddress =", email)
+	keys,err := q.GetAll(cdb.C, &tokens)
+	if err != nil { return nil, err }
+
+	for i,k := range keys { tokens[i].ID = k.StringID() }
+	sort.Sort(AccessTokensByCreatedDesc(tokens))
+	return tokens, nil
+}
+
+// }}}
+// {{{ cdb.RevokeAccessToken
+
+func (cdb ComplaintDB) RevokeAccessToken(email, id string) error {
+	k := cdb.accessTokenKey(id)
+	t := AccessToken{}
+	if err := datastore.Get(cdb.C, k, &t); err != nil {
+		return err
+	} else if t.EmailAddress != email {
+		return fmt.Errorf("RevokeAccessToken: token not owned by %s", email)
+	}
+	return datastore.Delete(cdb.C, k)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
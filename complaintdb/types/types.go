@@ -8,6 +8,8 @@ import (
 	"regexp"
 	"strings"
 	"time"
+
+	"github.com/skypies/util/date"
 	
 	"github.com/skypies/complaints/fr24"
 )
@@ -33,11 +35,38 @@ type PostalAddress struct {
 type ComplainerProfile struct {
 	EmailAddress      string // This is the root key; we get it from the GAE user profile.
 	CallerCode        string
+	PhoneNumber       string // E.164, for complaints by text message; see sms.NormalizePhone
 	FullName          string `datastore:",noindex"`
 	Address           string `datastore:",noindex"`
 	StructuredAddress PostalAddress
 	Lat,Long          float64 `datastore:",noindex"`
 	CcSfo             bool `datastore:",noindex"`
+	SubmitPromptly    bool `datastore:",noindex"` // Submit each complaint shortly after it is made
+
+	// Submission preferences
+	SubmitAirports    []string `datastore:",noindex"` // ICAO codes; empty means bksv.DefaultAirport
+	HoldForReview     bool `datastore:",noindex"` // Hold complaints in the review window for approval
+	ReviewFromHour    int  `datastore:",noindex"` // The review window, in PDT hours: [from,to)
+	ReviewToHour      int  `datastore:",noindex"`
+
+	// Email preferences
+	DigestFrequency   string `datastore:",noindex"` // One of the Digest* values; "" means daily
+	NoAnnouncements   bool   `datastore:",noindex"` // Don't send site news & updates
+}
+
+// How often the user wants their summary email
+const (
+	DigestNone    = "none"
+	DigestDaily   = "daily"
+	DigestWeekly  = "weekly"
+	DigestMonthly = "monthly"
+)
+
+func (p ComplainerProfile)Digest() string {
+	switch p.DigestFrequency {
+	case DigestNone, DigestWeekly, DigestMonthly: return p.DigestFrequency
+	default:                                      return DigestDaily
+	}
 }
 
 // Attempt to split into firstname, surname
@@ -57,6 +86,22 @@ func (p ComplainerProfile)SplitName() (first,last string) {
 	return
 }
 
+// Does the time fall into the user's review window ? The window may wrap past midnight.
+func (p ComplainerProfile)InReviewWindow(t time.Time) bool {
+	h := date.InPdt(t).Hour()
+	if p.ReviewFromHour == p.ReviewToHour {
+		return false
+	} else if p.ReviewFromHour < p.ReviewToHour {
+		return h >= p.ReviewFromHour && h < p.ReviewToHour
+	}
+	return h >= p.ReviewFromHour || h < p.ReviewToHour
+}
+
+// Complaints made during the review window wait until the user has approved them.
+func (p ComplainerProfile)IsHeldForReview(c Complaint) bool {
+	return p.HoldForReview && !c.ReviewedOK && p.InReviewWindow(c.Timestamp)
+}
+
 var towns = []string{
 	"aptos", "soquel", "capitola", "santa cruz", "scotts valley",
 	"glenwood", "los gatos", "palo alto",
@@ -106,6 +151,16 @@ func (p *ComplainerProfile)Base64Decode(str string) error {
 
 // }}}
 
+// {{{ Submission{}
+
+// A Submission records that a complaint was accepted by an airport's complaint system.
+type Submission struct {
+	Airport          string        // ICAO code, e.g. KSFO
+	T                time.Time
+	OperationType    string        // bksv.Operation*, as sent to this airport
+}
+
+// }}}
 // {{{ Complaint{}
 
 type Complaint struct {
@@ -113,6 +168,8 @@ type Complaint struct {
 	Description      string        `datastore:",noindex"`
 	Timestamp        time.Time
 	AircraftOverhead fr24.Aircraft `datastore:",noindex"`
+	AircraftCategory string        `datastore:",noindex"` // bksv.Category*, from the EquipType
+	OldOperationType string        `datastore:"OperationType,noindex"` // Unused; see Submission
 	Debug            string        `datastore:",noindex"` // Debugging; mostly about flight lookup
 
 	HeardSpeedbreaks bool
@@ -121,12 +178,23 @@ type Complaint struct {
 
 	Profile          ComplainerProfile                    // Embed the whole profile
 
+	Submissions      []Submission  `datastore:",noindex"` // Which airports have accepted this
+	DoNotSubmit      bool          `datastore:",noindex"` // User doesn't want this one sent off
+	ReviewedOK       bool          `datastore:",noindex"` // User has approved a held complaint
+
 	// Synthetic fields
 	DatastoreKey     string        `datastore:"-"`
 	Dist2KM          float64       `datastore:"-"`        // Distance from home to aircraft
 	Dist3KM          float64       `datastore:"-"`
 }
 
+func (c Complaint) HasBeenSubmittedTo(airport string) bool {
+	for _,s := range c.Submissions {
+		if s.Airport == airport { return true }
+	}
+	return false
+}
+
 type ComplaintsByTimeDesc []Complaint
 func (a ComplaintsByTimeDesc) Len() int           { return len(a) }
 func (a ComplaintsByTimeDesc) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
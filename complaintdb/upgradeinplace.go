@@ -97,7 +97,8 @@ func upgradeUserHandler(w http.ResponseWriter, r *http.Request) {
 				
 			} else if noProfile {
 				complaint.Profile = p
-				if err := cdb.UpdateComplaint(complaint, p.EmailAddress); err != nil {
+				// Not UpdateComplaint; a migration shouldn't look like an edit to the webhooks
+				if err := cdb.updateComplaint(complaint, p.EmailAddress); err != nil {
 					c.Errorf("upgradeUserHandler/%s: updatecomplaints failed: %v", p.EmailAddress, err)
 					http.Error(w, err.Error(), http.StatusInternalServerError)
 					return
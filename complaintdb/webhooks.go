@@ -0,0 +1,230 @@
+package complaintdb
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"appengine/datastore"
+	"appengine/taskqueue"
+
+	"github.com/skypies/complaints/complaintdb/types"
+	"github.com/skypies/complaints/webhook"
+)
+
+// Webhooks: URLs that we POST complaint events to (see the webhook package for the format).
+// Users register hooks for their own complaints; admins can register global ones, with no
+// EmailAddress, that get everyone's. Each event is delivered by its own task, so that the
+// queue takes care of retries and backoff; every attempt is logged as a WebhookDelivery, and
+// kept for a while. (They aren't children of the hook, so a busy hook isn't limited to the
+// write rate of a single entity group.)
+
+const (
+	kWebhookKind = "Webhook"
+	kWebhookDeliveryKind = "WebhookDelivery"
+)
+
+// {{{ Webhook, WebhookDelivery
+
+type Webhook struct {
+	ID           int64     `datastore:"-"`
+	EmailAddress string    // "" for a global hook
+	URL          string    `datastore:",noindex"`
+	Secret       string    `datastore:",noindex"`
+	Events       []string  `datastore:",noindex"` // webhook.Event*; empty means all of them
+	Created      time.Time `datastore:",noindex"`
+}
+
+func (h Webhook)Wants(event string) bool {
+	if len(h.Events) == 0 { return true }
+	for _,e := range h.Events {
+		if e == event { return true }
+	}
+	return false
+}
+
+type WebhookDelivery struct {
+	HookID     int64
+	DeliveryID string
+	Event      string    `datastore:",noindex"`
+	Time       time.Time
+	Attempt    int       `datastore:",noindex"` // 0 for the first try
+	StatusCode int       `datastore:",noindex"` // 0 if we didn't get a response
+	Error      string    `datastore:",noindex"`
+	Duration   time.Duration `datastore:",noindex"`
+}
+
+func (d WebhookDelivery)OK() bool { return d.StatusCode >= 200 && d.StatusCode < 300 }
+
+// }}}
+
+func (cdb ComplaintDB) webhookKey(id int64) *datastore.Key {
+	return datastore.NewKey(cdb.C, kWebhookKind, "", id, nil)
+}
+
+// {{{ cdb.CreateWebhook
+
+// email is "" for a global hook.
+func (cdb ComplaintDB) CreateWebhook(email, url string, events []string) (*Webhook, error) {
+	known := map[string]bool{}
+	for _,e := range webhook.AllEvents { known[e] = true }
+	for _,e := range events {
+		if !known[e] { return nil, fmt.Errorf("unknown event %q", e) }
+	}
+
+	secret := make([]byte, 24)
+	if _,err := rand.Read(secret); err != nil { return nil, err }
+
+	h := Webhook{
+		EmailAddress: email,
+		URL: url,
+		Secret: base64.RawURLEncoding.EncodeToString(secret),
+		Events: events,
+		Created: time.Now(),
+	}
+	k,err := datastore.Put(cdb.C, datastore.NewIncompleteKey(cdb.C, kWebhookKind, nil), &h)
+	if err != nil { return nil, err }
+	h.ID = k.IntID()
+	return &h, nil
+}
+
+// }}}
+// {{{ cdb.GetWebhook
+
+func (cdb ComplaintDB) GetWebhook(id int64) (*Webhook, error) {
+	h := Webhook{ID: id}
+	if err := datastore.Get(cdb.C, cdb.webhookKey(id), &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// }}}
+// {{{ cdb.GetWebhooks
+
+// The hooks registered by the user; or for email == "", the global ones.
+func (cdb ComplaintDB) GetWebhooks(email string) ([]Webhook, error) {
+	hooks := []Webhook{}
+	q := datastore.NewQuery(kWebhookKind).Filter("EmailAddress =", email)
+	keys,err := q.GetAll(cdb.C, &hooks)
+	if err != nil { return nil, err }
+	for i,k := range keys { hooks[i].ID = k.IntID() }
+	return hooks, nil
+}
+
+// }}}
+// {{{ cdb.DeleteWebhook
+
+// Deletes the hook, and then its delivery log. email is "" for a global hook.
+func (cdb ComplaintDB) DeleteWebhook(email string, id int64) error {
+	h,err := cdb.GetWebhook(id)
+	if err != nil {
+		return err
+	} else if h.EmailAddress != email {
+		return fmt.Errorf("DeleteWebhook: hook %d not owned by '%s'", id, email)
+	}
+
+	if err := datastore.Delete(cdb.C, cdb.webhookKey(id)); err != nil { return err }
+	_,err = cdb.deleteAllInBatches(datastore.NewQuery(kWebhookDeliveryKind).Filter("HookID =", id))
+	return err
+}
+
+// }}}
+
+// {{{ cdb.RecordWebhookDelivery
+
+func (cdb ComplaintDB) RecordWebhookDelivery(hookID int64, d WebhookDelivery) error {
+	d.HookID = hookID
+	_,err := datastore.Put(cdb.C, datastore.NewIncompleteKey(cdb.C, kWebhookDeliveryKind, nil), &d)
+	return err
+}
+
+// }}}
+// {{{ cdb.GetWebhookDeliveries
+
+// The most recent n delivery attempts, newest first.
+func (cdb ComplaintDB) GetWebhookDeliveries(hookID int64, n int) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	q := datastore.NewQuery(kWebhookDeliveryKind).Filter("HookID =", hookID).
+		Order("-Time").Limit(n)
+	if _,err := q.GetAll(cdb.C, &deliveries); err != nil { return nil, err }
+	return deliveries, nil
+}
+
+// }}}
+// {{{ cdb.PruneWebhookDeliveries
+
+// Deletes the delivery log entries from before the time, for every hook.
+func (cdb ComplaintDB) PruneWebhookDeliveries(before time.Time) (int, error) {
+	return cdb.deleteAllInBatches(datastore.NewQuery(kWebhookDeliveryKind).Filter("Time <", before))
+}
+
+// }}}
+
+// {{{ cdb.emitWebhookEvent
+
+// Queues up a delivery of the event to every interested hook. Failures are only logged;
+// webhooks shouldn't get in the way of complaining. airport is only for EventSubmitted.
+func (cdb ComplaintDB) emitWebhookEvent(event, email string, c types.Complaint, airport string) {
+	hooks,err := cdb.GetWebhooks(email)
+	if err != nil {
+		cdb.C.Errorf("emitWebhookEvent: %v", err)
+		return
+	}
+	if global,err := cdb.GetWebhooks(""); err != nil {
+		cdb.C.Errorf("emitWebhookEvent: global: %v", err)
+	} else {
+		hooks = append(hooks, global...)
+	}
+	if len(hooks) == 0 { return }
+
+	p := webhook.Payload{
+		Event: event,
+		Time: time.Now(),
+		User: email,
+		Complaint: webhook.Complaint{Key: c.DatastoreKey, Airport: airport},
+	}
+	if event != webhook.EventDeleted {
+		p.Complaint.Timestamp = c.Timestamp
+		p.Complaint.Loudness = c.Loudness
+		p.Complaint.Speedbrakes = c.HeardSpeedbreaks
+		p.Complaint.Activity = c.Activity
+		p.Complaint.Description = c.Description
+		p.Complaint.FlightNumber = c.AircraftOverhead.FlightNumber
+	}
+	body,err := json.Marshal(p)
+	if err != nil {
+		cdb.C.Errorf("emitWebhookEvent: %v", err)
+		return
+	}
+
+	for _,h := range hooks {
+		if !h.Wants(event) { continue }
+
+		id := make([]byte, 8)
+		rand.Read(id)
+		t := taskqueue.NewPOSTTask("/task/deliver-webhook", map[string][]string{
+			"hook":     {strconv.FormatInt(h.ID, 10)},
+			"event":    {event},
+			"delivery": {hex.EncodeToString(id)},
+			"body":     {string(body)},
+		})
+		if _,err := taskqueue.Add(cdb.C, t, "webhooks"); err != nil {
+			cdb.C.Errorf("emitWebhookEvent: enqueue hook %d: %v", h.ID, err)
+		}
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -86,7 +86,9 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	session := sessions.Get(r)
+	sessions.StopImpersonation(session) // A real login ends any impersonation
 	session.Values["email"] = jsonMap["email"]
+	sessions.ResetCSRF(session)
 	session.Save(r,w)
 	
 	// appengine.NewContext(r).Infof(" ** Facebook user logged in ! [%s]", jsonMap["email"])
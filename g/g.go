@@ -54,7 +54,9 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Snag their email address forever more
 	session := sessions.Get(r)
+	sessions.StopImpersonation(session) // A real login ends any impersonation
 	session.Values["email"] = u.Email
+	sessions.ResetCSRF(session)
 	session.Save(r,w)
 
 	// Now head back to the main page
@@ -0,0 +1,177 @@
+// Package live is the anonymised complaint event that /live/stream sends out as Server-Sent
+// Events, and a client for that stream. It has no App Engine dependencies.
+//
+// App Engine can't hold a response open indefinitely, so the server sends what it has (or
+// waits up to half a minute for something to happen) and then ends the response; the client
+// reconnects with the Last-Event-ID header, and carries on from there. Browsers' EventSource
+// does this by itself.
+package live
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Locations are rounded to a grid of this many degrees (about 1km), so that nobody's address
+// can be read off the stream.
+const CellSize = 0.01
+
+// {{{ Event
+
+type Event struct {
+	ID           string    `json:"-"` // Opaque; it's where the stream has got to
+	Time         time.Time `json:"time"`
+	Lat          float64   `json:"lat"`  // The middle of the cell
+	Long         float64   `json:"long"`
+	Zip          string    `json:"zip,omitempty"`
+	City         string    `json:"city,omitempty"`
+	FlightNumber string    `json:"flight,omitempty"`
+	Loudness     int       `json:"loudness"`
+}
+
+// The middle of the grid cell that contains the location.
+func Cell(lat, long float64) (float64, float64) {
+	round := func(x float64) float64 {
+		return (math.Floor(x/CellSize) + 0.5) * CellSize
+	}
+	return round(lat), round(long)
+}
+
+// }}}
+// {{{ Filter
+
+// Filter picks out which events a subscriber wants; the zero value matches everything.
+type Filter struct {
+	Zip      string
+	City     string
+	Lat,Long float64
+	RadiusKM float64 // Ignored if zero
+}
+
+func (f Filter)Values() url.Values {
+	v := url.Values{}
+	if f.Zip != ""  { v.Set("zip", f.Zip) }
+	if f.City != "" { v.Set("city", f.City) }
+	if f.RadiusKM > 0 {
+		v.Set("lat", fmt.Sprintf("%.4f", f.Lat))
+		v.Set("long", fmt.Sprintf("%.4f", f.Long))
+		v.Set("radius_km", fmt.Sprintf("%.2f", f.RadiusKM))
+	}
+	return v
+}
+
+func (f Filter)Matches(e Event) bool {
+	if f.Zip != "" && f.Zip != e.Zip { return false }
+	if f.City != "" && !strings.EqualFold(f.City, e.City) { return false }
+	if f.RadiusKM > 0 && distKM(f.Lat, f.Long, e.Lat, e.Long) > f.RadiusKM { return false }
+	return true
+}
+
+// Haversine; plenty good enough at this scale
+func distKM(lat1, long1, lat2, long2 float64) float64 {
+	rad := func(d float64) float64 { return d * math.Pi / 180 }
+	dLat,dLong := rad(lat2-lat1), rad(long2-long1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 6371.0 * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// }}}
+
+// {{{ Client
+
+type Client struct {
+	URL        string // e.g. "https://stop.jetnoise.net/live/stream"
+	Filter     Filter
+	LastID     string // Where to start from; "" means from now
+	HTTPClient *http.Client
+}
+
+func NewClient(url string, f Filter) *Client {
+	return &Client{URL: url, Filter: f, HTTPClient: &http.Client{Timeout: 2 * time.Minute}}
+}
+
+// }}}
+// {{{ c.Run
+
+// Run delivers events to the channel until stop is closed, reconnecting as needed. It backs
+// off (up to a minute) while the server is unreachable.
+func (c *Client)Run(events chan<- Event, stop <-chan struct{}) {
+	backoff := time.Second
+	for {
+		select {
+		case <-stop: return
+		default:
+		}
+
+		if err := c.poll(events, stop); err != nil {
+			select {
+			case <-stop: return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > time.Minute { backoff = time.Minute }
+		} else {
+			backoff = time.Second
+		}
+	}
+}
+
+// }}}
+// {{{ c.poll
+
+// Makes one request, and reads events until the server ends the response.
+func (c *Client)poll(events chan<- Event, stop <-chan struct{}) error {
+	u := c.URL
+	if q := c.Filter.Values().Encode(); q != "" { u += "?" + q }
+	req,err := http.NewRequest("GET", u, nil)
+	if err != nil { return err }
+	req.Header.Set("Accept", "text/event-stream")
+	if c.LastID != "" { req.Header.Set("Last-Event-ID", c.LastID) }
+
+	resp,err := c.HTTPClient.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK { return fmt.Errorf("live: %s", resp.Status) }
+
+	id,data := "",""
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// The end of a message; ones without data just move the ID along
+			if id != "" { c.LastID = id }
+			if data != "" {
+				e := Event{}
+				if err := json.Unmarshal([]byte(data), &e); err != nil { return err }
+				e.ID = c.LastID
+				select {
+				case events <- e:
+				case <-stop: return nil
+				}
+			}
+			id,data = "",""
+		case strings.HasPrefix(line, "id:"):
+			id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	return scanner.Err()
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
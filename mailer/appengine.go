@@ -0,0 +1,43 @@
+package mailer
+
+import (
+	netmail "net/mail"
+
+	"appengine"
+	"appengine/mail"
+)
+
+// The App Engine mail API only lets a few headers through; drop the others.
+var kAppEngineHeaders = map[string]bool{
+	"In-Reply-To": true,
+	"List-Id": true,
+	"List-Unsubscribe": true,
+	"On-Behalf-Of": true,
+	"References": true,
+	"Resent-Date": true,
+	"Resent-From": true,
+	"Resent-To": true,
+}
+
+type AppEngineMailer struct {
+	C appengine.Context
+}
+
+func (m AppEngineMailer) Send(msg *Message) error {
+	headers := netmail.Header{}
+	for k,v := range msg.Headers {
+		if kAppEngineHeaders[k] { headers[k] = v }
+	}
+
+	return mail.Send(m.C, &mail.Message{
+		Sender:   msg.Sender,
+		ReplyTo:  msg.ReplyTo,
+		To:       msg.To,
+		Cc:       msg.Cc,
+		Bcc:      msg.Bcc,
+		Subject:  msg.Subject,
+		Body:     msg.Body,
+		HTMLBody: msg.HTMLBody,
+		Headers:  headers,
+	})
+}
@@ -0,0 +1,151 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// Kinds of bounce
+const (
+	BounceHard      = "hard"      // Permanent failure (DSN status 5.x.x)
+	BounceSoft      = "soft"      // Transient failure (DSN status 4.x.x, delayed, or unrecognised)
+	BounceComplaint = "complaint" // The recipient reported us as spam (ARF feedback report)
+)
+
+type Bounce struct {
+	Recipient  string
+	Type       string
+	Status     string // DSN status code, e.g. "5.1.1"; or ARF feedback type, e.g. "abuse"
+	Diagnostic string
+}
+
+func (b Bounce)String() string {
+	return fmt.Sprintf("%s bounce for <%s> [%s] %s", b.Type, b.Recipient, b.Status, b.Diagnostic)
+}
+
+// {{{ ParseBounce
+
+// ParseBounce picks apart a bounce message: a delivery status notification (RFC 3464), or
+// an abuse feedback report (RFC 5965). If the message is neither, we fall back to guessing
+// from the text; fallbackRecipient is used if no recipient can be found in the message.
+func ParseBounce(r io.Reader, fallbackRecipient string) (*Bounce, error) {
+	msg,err := mail.ReadMessage(r)
+	if err != nil { return nil, fmt.Errorf("ParseBounce: %v", err) }
+
+	b := Bounce{}
+	mediaType,params,_ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+
+	if mediaType == "multipart/report" {
+		mr := multipart.NewReader(msg.Body, params["boundary"])
+		for {
+			part,err := mr.NextPart()
+			if err == io.EOF { break }
+			if err != nil { return nil, fmt.Errorf("ParseBounce: multipart: %v", err) }
+			partType,_,_ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			body,_ := ioutil.ReadAll(part)
+
+			switch partType {
+			case "message/delivery-status":
+				parseDeliveryStatus(body, &b)
+			case "message/feedback-report":
+				parseFeedbackReport(body, &b)
+			case "message/rfc822", "text/rfc822-headers":
+				// The original message; the last resort for finding who it was sent to
+				if b.Recipient == "" {
+					if orig,err := mail.ReadMessage(bytes.NewReader(body)); err == nil {
+						if addrs,err := orig.Header.AddressList("To"); err == nil && len(addrs) > 0 {
+							b.Recipient = addrs[0].Address
+						}
+					}
+				}
+			}
+		}
+
+	} else {
+		// Not a standard report; look for an SMTP status code in the text. Only a permanent
+		// failure code makes it hard; anything else (including no code at all, e.g. an
+		// autoreply) counts as soft, so one odd message can't get an address suppressed.
+		body,_ := ioutil.ReadAll(msg.Body)
+		b.Status = regexp.MustCompile(`\b[45]\.\d{1,3}\.\d{1,3}\b`).FindString(string(body))
+		b.Type = BounceSoft
+		if strings.HasPrefix(b.Status, "5.") { b.Type = BounceHard }
+		b.Diagnostic = msg.Header.Get("Subject")
+	}
+
+	if b.Recipient == "" { b.Recipient = fallbackRecipient }
+	if b.Recipient == "" { return nil, fmt.Errorf("ParseBounce: could not identify recipient") }
+	if b.Type == "" { return nil, fmt.Errorf("ParseBounce: could not identify bounce type") }
+
+	b.Recipient = strings.ToLower(strings.TrimSpace(b.Recipient))
+	return &b, nil
+}
+
+// }}}
+// {{{ parseDeliveryStatus
+
+// A delivery-status body is a per-message block of fields, followed by one block for each
+// recipient. We pick the first recipient that failed or was delayed.
+func parseDeliveryStatus(body []byte, b *Bounce) {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(body)))
+	if _,err := tp.ReadMIMEHeader(); err != nil { return } // Skip the per-message block
+
+	for {
+		h,err := tp.ReadMIMEHeader()
+		if len(h) > 0 {
+			action := strings.ToLower(h.Get("Action"))
+			if action == "failed" || action == "delayed" {
+				b.Recipient = addressFromTypedField(h.Get("Final-Recipient"))
+				if b.Recipient == "" { b.Recipient = addressFromTypedField(h.Get("Original-Recipient")) }
+				b.Status = strings.TrimSpace(h.Get("Status"))
+				b.Diagnostic = addressFromTypedField(h.Get("Diagnostic-Code"))
+				b.Type = BounceHard
+				if action == "delayed" || strings.HasPrefix(b.Status, "4.") { b.Type = BounceSoft }
+				return
+			}
+		}
+		if err != nil { return }
+	}
+}
+
+// }}}
+// {{{ parseFeedbackReport
+
+func parseFeedbackReport(body []byte, b *Bounce) {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(body)))
+	h,_ := tp.ReadMIMEHeader()
+
+	b.Type = BounceComplaint
+	b.Status = strings.ToLower(h.Get("Feedback-Type"))
+	b.Diagnostic = h.Get("User-Agent")
+	if rcpt := h.Get("Original-Rcpt-To"); rcpt != "" {
+		b.Recipient = strings.Trim(rcpt, "<> ")
+	}
+}
+
+// }}}
+// {{{ addressFromTypedField
+
+// "rfc822; foo@bar.com" -> "foo@bar.com"; "smtp; 550 no such user" -> "550 no such user"
+func addressFromTypedField(s string) string {
+	if i := strings.Index(s, ";"); i >= 0 { s = s[i+1:] }
+	return strings.Trim(s, "<> \t")
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
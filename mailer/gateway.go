@@ -0,0 +1,44 @@
+package mailer
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"appengine"
+	"appengine/urlfetch"
+)
+
+// GatewayMailer hands the message to an HTTP mail gateway (a CGI script that sends it on).
+// Only one body is passed along; the HTML one, if there is one.
+type GatewayMailer struct {
+	C        appengine.Context
+	URL      string
+	Password string
+}
+
+func (m GatewayMailer) Send(msg *Message) error {
+	if m.URL == "" { return fmt.Errorf("gateway: no mail.gateway.url configured") }
+
+	body := msg.HTMLBody
+	if body == "" { body = msg.Body }
+
+	data := url.Values{
+		"pwqiry":  {m.Password},
+		"to":      {strings.Join(msg.To, ",")},
+		"bcc":     {strings.Join(msg.Bcc, ",")},
+		"replyto": {msg.ReplyTo},
+		"subject": {msg.Subject},
+		"body":    {body},
+	}
+
+	resp,err := urlfetch.Client(m.C).PostForm(m.URL, data)
+	if err != nil { return err }
+	defer resp.Body.Close()
+
+	m.C.Infof("Mail gateway response:-\n%v", resp)
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("gateway: HTTP %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package mailer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// {{{ InboundMessage
+
+// The parts of an incoming email that we care about.
+type InboundMessage struct {
+	From    string    // Bare, lowercased address
+	Subject string
+	Date    time.Time // From the Date: header, which the sender controls; zero if unparseable
+	Text    string    // The plain text body, without any quoted reply or signature
+	Header  mail.Header
+}
+
+// }}}
+// {{{ ParseInbound
+
+// ParseInbound reads a raw RFC 5322 message. If there is no text/plain part, the text is
+// pulled out of the HTML.
+func ParseInbound(r io.Reader) (*InboundMessage, error) {
+	msg,err := mail.ReadMessage(r)
+	if err != nil { return nil, fmt.Errorf("ParseInbound: %v", err) }
+
+	from,err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil { return nil, fmt.Errorf("ParseInbound: From: %v", err) }
+
+	in := InboundMessage{
+		From: strings.ToLower(from.Address),
+		Header: msg.Header,
+	}
+	dec := new(mime.WordDecoder)
+	if in.Subject,err = dec.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		in.Subject = msg.Header.Get("Subject")
+	}
+	if t,err := msg.Header.Date(); err == nil { in.Date = t }
+
+	text,html,err := textFromPart(msg.Header.Get("Content-Type"),
+		msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil { return nil, fmt.Errorf("ParseInbound: %v", err) }
+	if text == "" && html != "" { text = stripHTML(html) }
+
+	in.Text = stripReply(text)
+	return &in, nil
+}
+
+// }}}
+// {{{ Authenticated
+
+// Authenticated is true if the server that received the message (authservID, e.g.
+// "mx.google.com") recorded that DKIM or SPF passed for the From: address's domain, and that
+// DMARC didn't fail. The domains have to match exactly; mail with no results, or results of
+// none, neutral or softfail, doesn't count.
+//
+// Anyone can put an Authentication-Results header in their message, so only the first one
+// from authservID is looked at; the receiving server adds its own on top of any forged ones.
+func (in InboundMessage)Authenticated(authservID string) bool {
+	i := strings.LastIndex(in.From, "@")
+	if i < 0 || authservID == "" { return false }
+	fromDomain := in.From[i+1:]
+
+	for _,ar := range in.Header["Authentication-Results"] {
+		id,results := parseAuthResults(ar)
+		if id != strings.ToLower(authservID) { continue }
+
+		pass := false
+		for _,res := range results {
+			switch {
+			case res["dmarc"] == "fail":
+				return false
+			case res["dkim"] == "pass":
+				d := res["header.d"]
+				if d == "" { d = domainOf(res["header.i"]) }
+				if d == fromDomain { pass = true }
+			case res["spf"] == "pass":
+				if domainOf(res["smtp.mailfrom"]) == fromDomain { pass = true }
+			}
+		}
+		return pass
+	}
+	return false
+}
+
+// }}}
+// {{{ IsAutomatic
+
+// IsAutomatic is true for mail that a program sent rather than a person: out-of-office
+// replies, autoresponders, and bulk or list mail (RFC 3834, and the common non-standard
+// headers). Answering these can start a mail loop.
+func (in InboundMessage)IsAutomatic() bool {
+	h := in.Header
+	if v := strings.ToLower(strings.TrimSpace(h.Get("Auto-Submitted"))); v != "" && v != "no" {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(h.Get("Precedence"))) {
+	case "bulk", "junk", "list", "auto_reply":
+		return true
+	}
+	for _,k := range []string{"X-Autoreply", "X-Autorespond", "X-Auto-Response"} {
+		if _,exists := h[k]; exists { return true }
+	}
+	return false
+}
+
+// }}}
+// {{{ parseAuthResults
+
+// "mx.google.com; dkim=pass header.i=@example.com; spf=pass (a comment) smtp.mailfrom=a@b.com"
+//   -> "mx.google.com", [{dkim:pass header.i:@example.com} {spf:pass smtp.mailfrom:a@b.com}]
+func parseAuthResults(s string) (string, []map[string]string) {
+	s = regexp.MustCompile(`\([^)]*\)`).ReplaceAllString(strings.ToLower(s), "")
+	parts := strings.Split(s, ";")
+
+	id := ""
+	if f := strings.Fields(parts[0]); len(f) > 0 { id = f[0] }
+
+	results := []map[string]string{}
+	for _,part := range parts[1:] {
+		res := map[string]string{}
+		for _,f := range strings.Fields(part) {
+			if kv := strings.SplitN(f, "=", 2); len(kv) == 2 { res[kv[0]] = strings.Trim(kv[1], `"`) }
+		}
+		results = append(results, res)
+	}
+	return id, results
+}
+
+// }}}
+// {{{ domainOf
+
+// "alice@example.com", "@example.com" and "example.com" all give "example.com".
+func domainOf(s string) string {
+	if i := strings.LastIndex(s, "@"); i >= 0 { s = s[i+1:] }
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// }}}
+
+// {{{ textFromPart
+
+// Walks a (possibly multipart) body, returning the first text/plain and text/html parts.
+func textFromPart(contentType, encoding string, body io.Reader) (text, html string, err error) {
+	mediaType,params,err := mime.ParseMediaType(contentType)
+	if err != nil { mediaType,params,err = "text/plain", map[string]string{}, nil }
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part,err := mr.NextPart()
+			if err == io.EOF { break }
+			if err != nil { return text, html, err }
+			// multipart.Reader quietly undoes quoted-printable; it drops the header when it does
+			t,h,err := textFromPart(part.Header.Get("Content-Type"),
+				part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil { return text, html, err }
+			if text == "" { text = t }
+			if html == "" { html = h }
+		}
+		return text, html, nil
+	}
+
+	switch strings.ToLower(encoding) {
+	case "quoted-printable": body = quotedprintable.NewReader(body)
+	case "base64":           body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	b,err := ioutil.ReadAll(body)
+	if err != nil { return "", "", err }
+
+	switch mediaType {
+	case "text/plain": text = string(b)
+	case "text/html":  html = string(b)
+	}
+	return text, html, nil
+}
+
+// }}}
+// {{{ stripHTML
+
+func stripHTML(s string) string {
+	s = regexp.MustCompile(`(?is)<(script|style).*?</(script|style)>`).ReplaceAllString(s, "")
+	s = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>`).ReplaceAllString(s, "\n")
+	s = regexp.MustCompile(`<[^>]*>`).ReplaceAllString(s, "")
+	r := strings.NewReplacer("&nbsp;", " ", "&amp;", "&", "&lt;", "<", "&gt;", ">", "&quot;", `"`)
+	return r.Replace(s)
+}
+
+// }}}
+// {{{ stripReply
+
+// Drops everything from the start of a quoted reply ("On ... wrote:", or "> " lines), or a
+// signature ("-- "), onwards.
+func stripReply(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	wrote := regexp.MustCompile(`^On .* wrote:$`)
+	lines := []string{}
+	for _,line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(line, ">") || line == "-- " || wrote.MatchString(line) ||
+			strings.HasPrefix(line, "-----Original Message-----") {
+			break
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,70 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func inboundMessage(t *testing.T, from string, headers ...string) *InboundMessage {
+	raw := "From: " + from + "\r\n" + strings.Join(headers, "") +
+		"Subject: Re: your complaint\r\n" +
+		"Date: Mon, 14 Mar 2016 06:40:00 -0700\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"Very loud at 6:40am\r\n\r\nOn Sun, Mar 13, 2016 someone wrote:\r\n> old stuff\r\n"
+	in,err := ParseInbound(strings.NewReader(raw))
+	if err != nil { t.Fatalf("ParseInbound: %v", err) }
+	return in
+}
+
+func TestParseInbound(t *testing.T) {
+	in := inboundMessage(t, "Alice <Alice@Example.com>")
+	if in.From != "alice@example.com" { t.Errorf("From: got %q", in.From) }
+	if in.Subject != "Re: your complaint" { t.Errorf("Subject: got %q", in.Subject) }
+	if in.Text != "Very loud at 6:40am" { t.Errorf("Text: got %q", in.Text) }
+	if in.Date.IsZero() { t.Errorf("Date: not parsed") }
+}
+
+func TestAuthenticated(t *testing.T) {
+	ar := func(s string) string { return "Authentication-Results: " + s + "\r\n" }
+	tests := []struct {
+		name    string
+		from    string
+		headers []string
+		want    bool
+	}{
+		{"no results", "alice@example.com", nil, false},
+		{"dkim pass", "alice@example.com",
+			[]string{ar("mx.google.com; dkim=pass header.i=@example.com header.s=s1")}, true},
+		{"dkim pass, header.d", "alice@example.com",
+			[]string{ar("mx.google.com; dkim=pass header.d=example.com")}, true},
+		{"spf pass", "alice@example.com",
+			[]string{ar("mx.google.com; spf=pass (google.com: domain of alice@example.com " +
+				"designates 1.2.3.4 as permitted sender) smtp.mailfrom=alice@example.com")}, true},
+		{"dkim pass for another domain", "alice@example.com",
+			[]string{ar("mx.google.com; dkim=pass header.d=evil.com")}, false},
+		{"spf pass for another domain", "alice@example.com",
+			[]string{ar("mx.google.com; spf=pass smtp.mailfrom=bob@evil.com")}, false},
+		{"softfail", "alice@example.com",
+			[]string{ar("mx.google.com; spf=softfail smtp.mailfrom=alice@example.com")}, false},
+		{"neutral and none", "alice@example.com",
+			[]string{ar("mx.google.com; dkim=none; spf=neutral smtp.mailfrom=alice@example.com")}, false},
+		{"dmarc fail", "alice@example.com",
+			[]string{ar("mx.google.com; dkim=pass header.d=example.com; dmarc=fail header.from=example.com")},
+			false},
+		{"untrusted server", "alice@example.com",
+			[]string{ar("mx.evil.com; dkim=pass header.d=example.com")}, false},
+		{"forged header below the real one", "alice@example.com",
+			[]string{ar("mx.google.com; spf=softfail smtp.mailfrom=alice@example.com"),
+				ar("mx.google.com; dkim=pass header.d=example.com")}, false},
+	}
+
+	for _,test := range tests {
+		in := inboundMessage(t, test.from, test.headers...)
+		if got := in.Authenticated("mx.google.com"); got != test.want {
+			t.Errorf("%s: got %v, wanted %v", test.name, got, test.want)
+		}
+	}
+
+	in := inboundMessage(t, "alice@example.com", ar("mx.google.com; dkim=pass header.d=example.com"))
+	if in.Authenticated("") { t.Errorf("unconfigured authserv: should never authenticate") }
+}
@@ -0,0 +1,179 @@
+// Package mailer sends outbound email via a transport chosen in config. The transports:
+//   "appengine" - the App Engine mail API (the default)
+//   "smtp"      - an SMTP server, with STARTTLS and auth
+//   "spool"     - writes each message into a maildir on local disk; for testing
+//   "gateway"   - POSTs the message to an HTTP mail gateway
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/skypies/complaints/config"
+)
+
+// {{{ Message
+
+type Message struct {
+	Sender   string
+	ReplyTo  string
+	To       []string
+	Cc       []string
+	Bcc      []string
+	Subject  string
+	Body     string      // Plain text
+	HTMLBody string
+	Headers  mail.Header // Extras, e.g. List-Unsubscribe
+}
+
+// }}}
+// {{{ Mailer
+
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// }}}
+
+// {{{ New
+
+// New returns the transport configured via "mail.transport".
+func New(c appengine.Context) Mailer {
+	switch config.Get("mail.transport") {
+	case "smtp":
+		port := config.Get("mail.smtp.port")
+		if port == "" { port = "587" }
+		return SMTPMailer{
+			C:        c,
+			Host:     config.Get("mail.smtp.host"),
+			Port:     port,
+			Username: config.Get("mail.smtp.username"),
+			Password: config.Get("mail.smtp.password"),
+		}
+	case "spool":
+		return SpoolMailer{Dir: config.Get("mail.spool.dir")}
+	case "gateway":
+		return GatewayMailer{
+			C:        c,
+			URL:      config.Get("mail.gateway.url"),
+			Password: config.Get("mail.gateway.password"),
+		}
+	default:
+		return AppEngineMailer{C: c}
+	}
+}
+
+// }}}
+
+// {{{ msg.Recipients
+
+// Bare addresses of everyone the message should be delivered to, Bcc included.
+func (msg *Message) Recipients() ([]string, error) {
+	rcpts := []string{}
+	for _,list := range [][]string{msg.To, msg.Cc, msg.Bcc} {
+		for _,s := range list {
+			addr,err := mail.ParseAddress(s)
+			if err != nil { return nil, fmt.Errorf("bad recipient '%s': %v", s, err) }
+			rcpts = append(rcpts, addr.Address)
+		}
+	}
+	return rcpts, nil
+}
+
+// }}}
+// {{{ msg.Bytes
+
+// Renders the message in RFC 5322 format. If there is both a plain text and an HTML body,
+// they're sent as multipart/alternative. Bcc recipients are (of course) not included.
+func (msg *Message) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+
+	h := textproto.MIMEHeader{}
+	h.Set("From", msg.Sender)
+	if msg.ReplyTo != "" { h.Set("Reply-To", msg.ReplyTo) }
+	if len(msg.To) > 0 { h.Set("To", strings.Join(msg.To, ", ")) }
+	if len(msg.Cc) > 0 { h.Set("Cc", strings.Join(msg.Cc, ", ")) }
+	h.Set("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	h.Set("Date", time.Now().Format(time.RFC1123Z))
+	h.Set("Message-Id", newMessageId(msg.Sender))
+	h.Set("Mime-Version", "1.0")
+	for k,vals := range msg.Headers {
+		for _,v := range vals { h.Add(k, v) }
+	}
+
+	var body bytes.Buffer
+	if msg.Body != "" && msg.HTMLBody != "" {
+		mw := multipart.NewWriter(&body)
+		h.Set("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+		if err := writePart(mw, "text/plain; charset=UTF-8", msg.Body); err != nil { return nil,err }
+		if err := writePart(mw, "text/html; charset=UTF-8", msg.HTMLBody); err != nil { return nil,err }
+		if err := mw.Close(); err != nil { return nil,err }
+
+	} else {
+		contentType,text := "text/plain; charset=UTF-8", msg.Body
+		if msg.HTMLBody != "" { contentType,text = "text/html; charset=UTF-8", msg.HTMLBody }
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+		qp := quotedprintable.NewWriter(&body)
+		if _,err := qp.Write([]byte(text)); err != nil { return nil,err }
+		if err := qp.Close(); err != nil { return nil,err }
+	}
+
+	writeHeader(&buf, h)
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+func writePart(mw *multipart.Writer, contentType, text string) error {
+	pw,err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil { return err }
+	qp := quotedprintable.NewWriter(pw)
+	if _,err := qp.Write([]byte(text)); err != nil { return err }
+	return qp.Close()
+}
+
+// Headers in a stable order, so that output is predictable
+func writeHeader(buf *bytes.Buffer, h textproto.MIMEHeader) {
+	keys := []string{}
+	for k,_ := range h { keys = append(keys, k) }
+	sort.Strings(keys)
+	for _,k := range keys {
+		for _,v := range h[k] { fmt.Fprintf(buf, "%s: %s\r\n", k, v) }
+	}
+	buf.WriteString("\r\n")
+}
+
+func newMessageId(sender string) string {
+	domain := "localhost"
+	if addr,err := mail.ParseAddress(sender); err == nil {
+		if i := strings.LastIndex(addr.Address, "@"); i >= 0 { domain = addr.Address[i+1:] }
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().Unix(), hex.EncodeToString(b), domain)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,65 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+
+	"appengine"
+	"appengine/socket"
+)
+
+// SMTPMailer talks to an SMTP server (usually a submission port, 587). It upgrades the
+// connection with STARTTLS when offered, and won't send credentials without it.
+type SMTPMailer struct {
+	C        appengine.Context
+	Host     string
+	Port     string
+	Username string
+	Password string
+}
+
+func (m SMTPMailer) Send(msg *Message) error {
+	if m.Host == "" { return fmt.Errorf("smtp: no mail.smtp.host configured") }
+
+	rcpts,err := msg.Recipients()
+	if err != nil { return err }
+	from,err := mail.ParseAddress(msg.Sender)
+	if err != nil { return fmt.Errorf("smtp: bad sender '%s': %v", msg.Sender, err) }
+	body,err := msg.Bytes()
+	if err != nil { return err }
+
+	conn,err := socket.Dial(m.C, "tcp", net.JoinHostPort(m.Host, m.Port))
+	if err != nil { return fmt.Errorf("smtp: dial: %v", err) }
+	client,err := smtp.NewClient(conn, m.Host)
+	if err != nil { conn.Close(); return fmt.Errorf("smtp: %v", err) }
+	defer client.Close()
+
+	if ok,_ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return fmt.Errorf("smtp: starttls: %v", err)
+		}
+	} else if m.Username != "" {
+		return fmt.Errorf("smtp: %s does not offer STARTTLS; not sending credentials", m.Host)
+	}
+
+	if m.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return fmt.Errorf("smtp: auth: %v", err)
+		}
+	}
+
+	if err := client.Mail(from.Address); err != nil { return fmt.Errorf("smtp: MAIL: %v", err) }
+	for _,rcpt := range rcpts {
+		if err := client.Rcpt(rcpt); err != nil { return fmt.Errorf("smtp: RCPT %s: %v", rcpt, err) }
+	}
+
+	wc,err := client.Data()
+	if err != nil { return fmt.Errorf("smtp: DATA: %v", err) }
+	if _,err := wc.Write(body); err != nil { return fmt.Errorf("smtp: write: %v", err) }
+	if err := wc.Close(); err != nil { return fmt.Errorf("smtp: end DATA: %v", err) }
+
+	return client.Quit()
+}
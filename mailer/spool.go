@@ -0,0 +1,58 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var spoolCounter int64
+
+// SpoolMailer doesn't send anything; it writes each message into a maildir, so that tests
+// and local development can see exactly what would have gone out. The envelope recipients
+// (which include any Bcc) are recorded in an X-Envelope-To header.
+type SpoolMailer struct {
+	Dir string
+}
+
+func (m SpoolMailer) Send(msg *Message) error {
+	if m.Dir == "" { return fmt.Errorf("spool: no mail.spool.dir configured") }
+
+	rcpts,err := msg.Recipients()
+	if err != nil { return err }
+	body,err := msg.Bytes()
+	if err != nil { return err }
+
+	for _,sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(m.Dir, sub), 0755); err != nil { return err }
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "X-Envelope-To: %s\r\n", strings.Join(rcpts, ", "))
+	buf.Write(body)
+
+	// Maildir delivery: write into tmp/, then rename into new/
+	hostname,_ := os.Hostname()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", time.Now().Unix(), time.Now().Nanosecond()/1000,
+		os.Getpid(), atomic.AddInt64(&spoolCounter, 1), hostname)
+	tmpPath := filepath.Join(m.Dir, "tmp", name)
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil { return err }
+
+	return os.Rename(tmpPath, filepath.Join(m.Dir, "new", name))
+}
+
+// Spooled returns the paths of all the messages in the spool's new/ dir, oldest first.
+func (m SpoolMailer) Spooled() ([]string, error) {
+	infos,err := ioutil.ReadDir(filepath.Join(m.Dir, "new"))
+	if err != nil { return nil, err }
+	paths := []string{}
+	for _,info := range infos {
+		paths = append(paths, filepath.Join(m.Dir, "new", info.Name()))
+	}
+	return paths, nil
+}
@@ -0,0 +1,243 @@
+// Package gae has the App Engine handlers for logging in with OpenID Connect providers (see
+// the oidc package). Providers are set up in config:
+//   oidc.providers              - names of the providers to offer, separated by commas
+//   oidc.<name>.label           - e.g. "Okta", for the login button
+//   oidc.<name>.issuer          - e.g. https://example.okta.com
+//   oidc.<name>.clientid
+//   oidc.<name>.clientsecret    - "" for a public client
+//   oidc.<name>.scopes          - any extra scopes, separated by spaces
+// Register <site>/login/oidc/<name>/callback as the redirect URI with the provider.
+//
+// On the dev appserver, a provider whose issuer is <this server>/oidc-mock gets a MockIssuer
+// served there, so logins can be tried out without a real provider.
+package gae
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/urlfetch"
+
+	gsessions "github.com/gorilla/sessions"
+
+	"github.com/skypies/complaints/config"
+	"github.com/skypies/complaints/oidc"
+	"github.com/skypies/complaints/sessions"
+)
+
+const (
+	kLoginPath = "/login/oidc/" // + <name> to start, + <name>/callback to finish
+	kMockPath = "/oidc-mock"
+	kMaxAttemptAge = 10 * time.Minute
+)
+
+func init() {
+	http.HandleFunc(kLoginPath, loginHandler)
+	http.HandleFunc(kMockPath+"/", mockHandler)
+}
+
+// {{{ Providers, LoginLinks
+
+// The providers listed in config.
+func Providers() []oidc.Provider {
+	providers := []oidc.Provider{}
+	for _,name := range strings.Split(config.Get("oidc.providers"), ",") {
+		if name = strings.TrimSpace(name); name == "" { continue }
+		providers = append(providers, oidc.Provider{
+			Name: name,
+			Label: config.Get("oidc."+name+".label"),
+			Issuer: config.Get("oidc."+name+".issuer"),
+			ClientID: config.Get("oidc."+name+".clientid"),
+			ClientSecret: config.Get("oidc."+name+".clientsecret"),
+			Scopes: strings.Fields(config.Get("oidc."+name+".scopes")),
+		})
+	}
+	return providers
+}
+
+func getProvider(name string) (oidc.Provider, bool) {
+	for _,p := range Providers() {
+		if p.Name == name { return p, true }
+	}
+	return oidc.Provider{}, false
+}
+
+type LoginLink struct {
+	Label string
+	URL   string
+}
+
+// For the landing page; one per provider.
+func LoginLinks() []LoginLink {
+	links := []LoginLink{}
+	for _,p := range Providers() {
+		links = append(links, LoginLink{Label: p.Label, URL: kLoginPath + p.Name})
+	}
+	return links
+}
+
+// }}}
+// {{{ redirectURL
+
+func redirectURL(r *http.Request, name string) string {
+	scheme := "https"
+	if appengine.IsDevAppServer() { scheme = "http" }
+	return fmt.Sprintf("%s://%s%s%s/callback", scheme, r.Host, kLoginPath, name)
+}
+
+// }}}
+// {{{ attempt storage
+
+// The attempt lives in the session (which is signed) until the provider sends the browser
+// back; it's only good for that one provider, and for kMaxAttemptAge.
+func saveAttempt(r *http.Request, w http.ResponseWriter, name string, a oidc.Attempt) {
+	session := sessions.Get(r)
+	session.Values["oidc.provider"] = name
+	session.Values["oidc.state"] = a.State
+	session.Values["oidc.nonce"] = a.Nonce
+	session.Values["oidc.verifier"] = a.Verifier
+	session.Values["oidc.started"] = time.Now().Unix()
+	session.Save(r, w)
+}
+
+// Returns the attempt, and removes it from the session (but doesn't save the session).
+func takeAttempt(session *gsessions.Session, name string) (oidc.Attempt, error) {
+	provider,_ := session.Values["oidc.provider"].(string)
+	started,_ := session.Values["oidc.started"].(int64)
+	a := oidc.Attempt{}
+	a.State,_ = session.Values["oidc.state"].(string)
+	a.Nonce,_ = session.Values["oidc.nonce"].(string)
+	a.Verifier,_ = session.Values["oidc.verifier"].(string)
+	for _,k := range []string{"oidc.provider", "oidc.state", "oidc.nonce", "oidc.verifier", "oidc.started"} {
+		delete(session.Values, k)
+	}
+
+	if provider != name || a.State == "" {
+		return a, fmt.Errorf("no login in progress with %s; are cookies turned off ?", name)
+	} else if time.Since(time.Unix(started, 0)) > kMaxAttemptAge {
+		return a, fmt.Errorf("login took too long; please try again")
+	}
+	return a, nil
+}
+
+// }}}
+
+// {{{ loginHandler
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	path := strings.TrimPrefix(r.URL.Path, kLoginPath)
+	name := strings.TrimSuffix(path, "/callback")
+
+	p,ok := getProvider(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if path != name {
+		callbackHandler(w, r, p)
+		return
+	}
+
+	a := oidc.NewAttempt()
+	u,err := p.AuthCodeURL(urlfetch.Client(c), redirectURL(r, name), a)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, "Sorry, we can't reach "+p.Label+" right now", http.StatusBadGateway)
+		return
+	}
+	saveAttempt(r, w, name, a)
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// }}}
+// {{{ callbackHandler
+
+func callbackHandler(w http.ResponseWriter, r *http.Request, p oidc.Provider) {
+	c := appengine.NewContext(r)
+	session := sessions.Get(r)
+
+	a,err := takeAttempt(session, p.Name)
+	session.Save(r, w) // Whatever happens, the attempt is used up
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if e := r.FormValue("error"); e != "" {
+		c.Infof("oidc %s: provider said %s: %s", p.Name, e, r.FormValue("error_description"))
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	} else if !hmac.Equal([]byte(r.FormValue("state")), []byte(a.State)) {
+		c.Errorf("oidc %s: state mismatch", p.Name)
+		http.Error(w, "login failed (state mismatch); please try again", http.StatusBadRequest)
+		return
+	}
+
+	claims,err := p.Exchange(urlfetch.Client(c), redirectURL(r, p.Name), r.FormValue("code"), a,
+		time.Now())
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, "login failed; please try again", http.StatusForbidden)
+		return
+	}
+
+	sessions.StopImpersonation(session) // A real login ends any impersonation
+	session.Values["email"] = claims.Email
+	sessions.ResetCSRF(session)
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// }}}
+
+// {{{ mockHandler
+
+var mock struct {
+	sync.Mutex
+	issuer *oidc.MockIssuer
+}
+
+// Only on the dev appserver, and only if a provider is configured to use it.
+func mockHandler(w http.ResponseWriter, r *http.Request) {
+	var p *oidc.Provider
+	for _,x := range Providers() {
+		if strings.HasSuffix(x.Issuer, kMockPath) { p = &x; break }
+	}
+	if !appengine.IsDevAppServer() || p == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	mock.Lock()
+	if mock.issuer == nil {
+		m,err := oidc.NewMockIssuer(p.ClientID, p.ClientSecret, "test@example.com")
+		if err != nil {
+			mock.Unlock()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		m.Issuer = p.Issuer
+		mock.issuer = m
+	}
+	mock.Unlock()
+
+	mock.issuer.ServeHTTP(w, r)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
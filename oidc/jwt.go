@@ -0,0 +1,217 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// {{{ Claims
+
+// The ID token claims we look at.
+type Claims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expiry          int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   flexBool `json:"email_verified"`
+}
+
+// aud can be a string, or a list of them.
+type audience []string
+
+func (a *audience)UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil { return err }
+	*a = audience(l)
+	return nil
+}
+
+func (a audience)Contains(s string) bool {
+	for _,x := range a {
+		if x == s { return true }
+	}
+	return false
+}
+
+// Some providers send email_verified as the string "true".
+type flexBool bool
+
+func (f *flexBool)UnmarshalJSON(b []byte) error {
+	switch string(b) {
+	case "true", `"true"`: *f = true
+	default:               *f = false
+	}
+	return nil
+}
+
+// }}}
+// {{{ JWKS
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`   // RSA
+	E   string `json:"e"`
+	Crv string `json:"crv"` // EC
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b,err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil { return nil, err }
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jwk)publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n,err := b64Int(k.N)
+		if err != nil { return nil, err }
+		e,err := b64Int(k.E)
+		if err != nil { return nil, err }
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" { return nil, fmt.Errorf("unsupported curve %q", k.Crv) }
+		x,err := b64Int(k.X)
+		if err != nil { return nil, err }
+		y,err := b64Int(k.Y)
+		if err != nil { return nil, err }
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// Finds the key in the provider's JWKS. Providers rotate keys, so if it's not there we
+// fetch the set again, in case ours is stale.
+func (p Provider)key(client *http.Client, jwksURI, kid string) (crypto.PublicKey, error) {
+	for _,fresh := range []bool{false, true} {
+		set := jwks{}
+		if err := getJSON(client, jwksURI, fresh, &set); err != nil { return nil, err }
+		for _,k := range set.Keys {
+			if k.Kid == kid && (k.Use == "" || k.Use == "sig") { return k.publicKey() }
+		}
+	}
+	return nil, fmt.Errorf("no key %q in %s", kid, jwksURI)
+}
+
+// }}}
+
+// {{{ verifySignature
+
+// Checks a JWS compact signature over "header.payload". We only take asymmetric algorithms;
+// "none" and the HMAC ones (which would use the client secret as the key) are refused.
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	sum := sha256.Sum256([]byte(signed))
+
+	switch alg {
+	case "RS256":
+		k,ok := key.(*rsa.PublicKey)
+		if !ok { return fmt.Errorf("RS256 token, but the key isn't RSA") }
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig)
+
+	case "ES256":
+		k,ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 { return fmt.Errorf("bad ES256 key or signature") }
+		r,s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, sum[:], r, s) { return fmt.Errorf("bad signature") }
+		return nil
+	}
+	return fmt.Errorf("unsupported alg %q", alg)
+}
+
+// }}}
+// {{{ p.VerifyIDToken
+
+// VerifyIDToken checks the token came from the provider, for us, for this login (nonce), and
+// is current; and that it has an email address the provider has verified.
+func (p Provider)VerifyIDToken(client *http.Client, raw, nonce string, now time.Time) (*Claims, error) {
+	fail := func(f string, args ...interface{}) (*Claims, error) {
+		return nil, fmt.Errorf("oidc %s: id_token: %s", p.Name, fmt.Sprintf(f, args...))
+	}
+
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 { return fail("not a JWS") }
+
+	hdr := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if b,err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil {
+		return fail("header: %v", err)
+	} else if err := json.Unmarshal(b, &hdr); err != nil {
+		return fail("header: %v", err)
+	}
+	sig,err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil { return fail("signature: %v", err) }
+
+	d,err := p.Discover(client)
+	if err != nil { return nil, err }
+	key,err := p.key(client, d.JWKSURI, hdr.Kid)
+	if err != nil { return fail("%v", err) }
+	if err := verifySignature(hdr.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return fail("%v", err)
+	}
+
+	claims := Claims{}
+	if b,err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return fail("payload: %v", err)
+	} else if err := json.Unmarshal(b, &claims); err != nil {
+		return fail("payload: %v", err)
+	}
+
+	switch {
+	case claims.Issuer != p.Issuer:
+		return fail("issuer is %q", claims.Issuer)
+	case !claims.Audience.Contains(p.ClientID):
+		return fail("not for us; audience is %v", claims.Audience)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID:
+		return fail("not for us; azp is %q", claims.AuthorizedParty)
+	case now.After(time.Unix(claims.Expiry, 0).Add(MaxSkew)):
+		return fail("expired")
+	case now.Add(MaxSkew).Before(time.Unix(claims.IssuedAt, 0)):
+		return fail("issued in the future")
+	case nonce == "" || claims.Nonce != nonce:
+		return fail("wrong nonce")
+	case claims.Email == "":
+		return fail("no email address; is the email scope allowed ?")
+	case !bool(claims.EmailVerified):
+		return fail("email address %s isn't verified", claims.Email)
+	}
+	return &claims, nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
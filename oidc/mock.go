@@ -0,0 +1,220 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// {{{ MockIssuer
+
+// MockIssuer is a tiny OpenID Connect provider, to run logins against in tests (e.g. behind an
+// httptest.Server) or locally. It logs everyone straight in as Email, without asking, but
+// otherwise plays by the rules: it checks the client, redirect URI and PKCE verifier, and
+// signs its ID tokens with its own RSA key. Set Issuer to the URL it is served at.
+type MockIssuer struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	Email         string
+	EmailVerified bool
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	RedirectURI string
+	Challenge   string
+	Nonce       string
+	Email       string
+}
+
+func NewMockIssuer(clientID, clientSecret, email string) (*MockIssuer, error) {
+	key,err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil { return nil, err }
+	return &MockIssuer{
+		ClientID: clientID,
+		ClientSecret: clientSecret,
+		Email: email,
+		EmailVerified: true,
+		key: key,
+		codes: map[string]mockGrant{},
+	}, nil
+}
+
+// The Provider for logging in against this issuer.
+func (m *MockIssuer)Provider() Provider {
+	return Provider{Name: "mock", Label: "Mock", Issuer: m.Issuer, ClientID: m.ClientID,
+		ClientSecret: m.ClientSecret}
+}
+
+// }}}
+// {{{ m.ServeHTTP
+
+// It can be mounted under any path; only the end of the path matters.
+func (m *MockIssuer)ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch p := r.URL.Path; {
+	case strings.HasSuffix(p, "/.well-known/openid-configuration"):
+		base := strings.TrimSuffix(m.Issuer, "/")
+		m.writeJSON(w, http.StatusOK, Discovery{
+			Issuer: m.Issuer,
+			AuthorizationEndpoint: base + "/authorize",
+			TokenEndpoint: base + "/token",
+			JWKSURI: base + "/jwks",
+		})
+	case strings.HasSuffix(p, "/jwks"):
+		m.writeJSON(w, http.StatusOK, jwks{Keys: []jwk{{
+			Kty: "RSA", Kid: "mock", Use: "sig",
+			N: base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}}})
+	case strings.HasSuffix(p, "/authorize"):
+		m.authorize(w, r)
+	case strings.HasSuffix(p, "/token"):
+		m.token(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *MockIssuer)writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (m *MockIssuer)tokenError(w http.ResponseWriter, code, desc string) {
+	m.writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": desc})
+}
+
+// }}}
+// {{{ m.authorize
+
+// ?login_hint= logs in as someone other than Email.
+func (m *MockIssuer)authorize(w http.ResponseWriter, r *http.Request) {
+	redirect := r.FormValue("redirect_uri")
+	if r.FormValue("client_id") != m.ClientID || redirect == "" {
+		http.Error(w, "bad client_id or redirect_uri", http.StatusBadRequest)
+		return
+	} else if r.FormValue("response_type") != "code" || r.FormValue("code_challenge_method") != "S256" {
+		http.Error(w, "only the code flow, with S256 PKCE", http.StatusBadRequest)
+		return
+	}
+
+	g := mockGrant{
+		RedirectURI: redirect,
+		Challenge: r.FormValue("code_challenge"),
+		Nonce: r.FormValue("nonce"),
+		Email: m.Email,
+	}
+	if hint := r.FormValue("login_hint"); hint != "" { g.Email = hint }
+
+	code := randomString()
+	m.mu.Lock()
+	m.codes[code] = g
+	m.mu.Unlock()
+
+	u,err := url.Parse(redirect)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := u.Query()
+	q.Set("code", code)
+	q.Set("state", r.FormValue("state"))
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// }}}
+// {{{ m.token
+
+func (m *MockIssuer)token(w http.ResponseWriter, r *http.Request) {
+	id,secret,basic := r.BasicAuth()
+	if basic {
+		id,_ = url.QueryUnescape(id)
+		secret,_ = url.QueryUnescape(secret)
+	} else {
+		id,secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if id != m.ClientID || secret != m.ClientSecret {
+		m.tokenError(w, "invalid_client", "bad client credentials")
+		return
+	}
+
+	code := r.PostFormValue("code")
+	m.mu.Lock()
+	g,ok := m.codes[code]
+	delete(m.codes, code) // Codes are single use
+	m.mu.Unlock()
+
+	switch {
+	case r.PostFormValue("grant_type") != "authorization_code":
+		m.tokenError(w, "unsupported_grant_type", "")
+	case !ok:
+		m.tokenError(w, "invalid_grant", "unknown code")
+	case r.PostFormValue("redirect_uri") != g.RedirectURI:
+		m.tokenError(w, "invalid_grant", "redirect_uri doesn't match")
+	case Challenge(r.PostFormValue("code_verifier")) != g.Challenge:
+		m.tokenError(w, "invalid_grant", "PKCE verifier doesn't match")
+	default:
+		idToken,err := m.sign(g)
+		if err != nil {
+			m.tokenError(w, "server_error", err.Error())
+			return
+		}
+		m.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"access_token": randomString(),
+			"token_type": "Bearer",
+			"expires_in": 3600,
+			"id_token": idToken,
+		})
+	}
+}
+
+// }}}
+// {{{ m.sign
+
+func (m *MockIssuer)sign(g mockGrant) (string, error) {
+	now := time.Now()
+	hdr,_ := json.Marshal(map[string]string{"alg": "RS256", "kid": "mock", "typ": "JWT"})
+	payload,err := json.Marshal(map[string]interface{}{
+		"iss": m.Issuer,
+		"sub": "mock-" + g.Email,
+		"aud": m.ClientID,
+		"exp": now.Add(time.Hour).Unix(),
+		"iat": now.Unix(),
+		"nonce": g.Nonce,
+		"email": g.Email,
+		"email_verified": m.EmailVerified,
+	})
+	if err != nil { return "", err }
+
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig,err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, sum[:])
+	if err != nil { return "", err }
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,230 @@
+// Package oidc logs people in with any OpenID Connect provider, using the authorization
+// code flow with PKCE. A login goes:
+//   1. a := NewAttempt(); keep it somewhere the browser can't change (e.g. the session)
+//   2. send the browser to p.AuthCodeURL(client, redirectURL, a)
+//   3. the provider sends it back to redirectURL with "state" and "code"; check the state
+//      against a.State, then p.Exchange(client, redirectURL, code, a, now) returns the
+//      checked claims from the ID token
+// Exchange checks the ID token's signature (RS256 or ES256, against the provider's JWKS),
+// issuer, audience, expiry and nonce, and that the email address has been verified.
+//
+// This package has no App Engine dependencies; everything goes through the *http.Client it's
+// given, so it can be run against a MockIssuer. The handlers live in oidc/gae.
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long we trust what we fetched from the provider's discovery document and JWKS
+	DiscoveryTTL = time.Hour
+
+	// How far the provider's clock can be from ours, when checking exp & iat
+	MaxSkew = 2 * time.Minute
+)
+
+// {{{ Provider
+
+type Provider struct {
+	Name         string // Ours; goes in URLs
+	Label        string // For humans, e.g. "Okta"
+	Issuer       string // e.g. https://accounts.google.com; the discovery doc is under here
+	ClientID     string
+	ClientSecret string // "" for a public client, which relies on PKCE alone
+	Scopes       []string // "openid" and "email" are always asked for
+}
+
+// }}}
+// {{{ Discovery
+
+// The bits of /.well-known/openid-configuration we use.
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// }}}
+// {{{ Attempt
+
+// An Attempt is the secret state of one login, from the redirect to the provider until it
+// comes back.
+type Attempt struct {
+	State    string // Sent to the provider and back, to tie the callback to this browser
+	Nonce    string // Goes into the ID token, to tie it to this login
+	Verifier string // PKCE; only its hash is sent with the redirect
+}
+
+func NewAttempt() Attempt {
+	return Attempt{State: randomString(), Nonce: randomString(), Verifier: randomString()}
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _,err := rand.Read(b); err != nil { panic(err) }
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// The PKCE S256 code challenge, for the verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// }}}
+
+// {{{ cache
+
+// Discovery docs and key sets are shared across requests (and clients), by URL.
+var cache = struct {
+	sync.Mutex
+	m map[string]cacheEntry
+}{m: map[string]cacheEntry{}}
+
+type cacheEntry struct {
+	body    []byte
+	fetched time.Time
+}
+
+// Fetches the URL, or uses a recent enough copy. fresh skips the cache.
+func getJSON(client *http.Client, u string, fresh bool, v interface{}) error {
+	cache.Lock()
+	e,ok := cache.m[u]
+	cache.Unlock()
+
+	if !ok || fresh || time.Since(e.fetched) > DiscoveryTTL {
+		resp,err := client.Get(u)
+		if err != nil { return err }
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("GET %s: %s", u, resp.Status)
+		}
+		body,err := ioutil.ReadAll(resp.Body)
+		if err != nil { return err }
+
+		e = cacheEntry{body: body, fetched: time.Now()}
+		cache.Lock()
+		cache.m[u] = e
+		cache.Unlock()
+	}
+
+	return json.Unmarshal(e.body, v)
+}
+
+// }}}
+// {{{ p.Discover
+
+func (p Provider)Discover(client *http.Client) (*Discovery, error) {
+	d := Discovery{}
+	u := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(client, u, false, &d); err != nil {
+		return nil, fmt.Errorf("oidc %s: discovery: %v", p.Name, err)
+	}
+
+	// The spec says the discovery doc has to match the issuer exactly
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("oidc %s: discovery says issuer is %q", p.Name, d.Issuer)
+	} else if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc %s: discovery is missing endpoints", p.Name)
+	}
+	return &d, nil
+}
+
+// }}}
+// {{{ p.AuthCodeURL
+
+// Where to send the browser to log in.
+func (p Provider)AuthCodeURL(client *http.Client, redirectURL string, a Attempt) (string, error) {
+	d,err := p.Discover(client)
+	if err != nil { return "", err }
+
+	scopes := []string{"openid", "email"}
+	for _,s := range p.Scopes {
+		if s != "openid" && s != "email" { scopes = append(scopes, s) }
+	}
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", redirectURL)
+	v.Set("scope", strings.Join(scopes, " "))
+	v.Set("state", a.State)
+	v.Set("nonce", a.Nonce)
+	v.Set("code_challenge", Challenge(a.Verifier))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") { sep = "&" }
+	return d.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// }}}
+// {{{ p.Exchange
+
+// Swaps the code from the callback for an ID token, and checks it. The caller must already
+// have checked the callback's state against a.State.
+func (p Provider)Exchange(client *http.Client, redirectURL, code string, a Attempt, now time.Time) (*Claims, error) {
+	d,err := p.Discover(client)
+	if err != nil { return nil, err }
+
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", redirectURL)
+	v.Set("code_verifier", a.Verifier)
+	if p.ClientSecret == "" {
+		v.Set("client_id", p.ClientID)
+	}
+
+	req,err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil { return nil, err }
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		// client_secret_basic, the default; the ID & secret are form-encoded first
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp,err := client.Do(req)
+	if err != nil { return nil, fmt.Errorf("oidc %s: token: %v", p.Name, err) }
+	defer resp.Body.Close()
+	body,err := ioutil.ReadAll(resp.Body)
+	if err != nil { return nil, fmt.Errorf("oidc %s: token: %v", p.Name, err) }
+
+	tok := struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+		Desc    string `json:"error_description"`
+	}{}
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return nil, fmt.Errorf("oidc %s: token: %s: %v", p.Name, resp.Status, err)
+	} else if resp.StatusCode != http.StatusOK || tok.Error != "" {
+		return nil, fmt.Errorf("oidc %s: token: %s: %s %s", p.Name, resp.Status, tok.Error, tok.Desc)
+	} else if tok.IDToken == "" {
+		return nil, fmt.Errorf("oidc %s: token: no id_token", p.Name)
+	}
+
+	return p.VerifyIDToken(client, tok.IDToken, a.Nonce, now)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
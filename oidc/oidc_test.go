@@ -0,0 +1,94 @@
+package oidc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const kTestRedirect = "https://complaints.example.com/login/oidc/mock/callback"
+
+// Runs a login against a MockIssuer, as far as the callback; returns the code from it.
+func mockLogin(t *testing.T, m *MockIssuer, a Attempt) string {
+	p := m.Provider()
+	u,err := p.AuthCodeURL(http.DefaultClient, kTestRedirect, a)
+	if err != nil { t.Fatalf("AuthCodeURL: %v", err) }
+
+	req,err := http.NewRequest("GET", u, nil)
+	if err != nil { t.Fatalf("NewRequest: %v", err) }
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("authorize: got %d %s", rec.Code, rec.Body.String())
+	}
+
+	cb,err := url.Parse(rec.Header().Get("Location"))
+	if err != nil { t.Fatalf("authorize: bad redirect: %v", err) }
+	if got := cb.Scheme + "://" + cb.Host + cb.Path; got != kTestRedirect {
+		t.Fatalf("authorize: redirected to %s", got)
+	} else if cb.Query().Get("state") != a.State {
+		t.Fatalf("authorize: state %q, wanted %q", cb.Query().Get("state"), a.State)
+	}
+	return cb.Query().Get("code")
+}
+
+func TestExchange(t *testing.T) {
+	tests := []struct {
+		name       string
+		unverified bool
+		change     func(a *Attempt) // Messes with the attempt, between the redirect and callback
+		wantErr    string
+	}{
+		{"happy path", false, nil, ""},
+		{"bad PKCE verifier", false, func(a *Attempt) { a.Verifier = randomString() }, "PKCE"},
+		{"wrong nonce", false, func(a *Attempt) { a.Nonce = randomString() }, "wrong nonce"},
+		{"email not verified", true, nil, "isn't verified"},
+	}
+
+	for _,test := range tests {
+		m,err := NewMockIssuer("client-1", "sekrit", "alice@example.com")
+		if err != nil { t.Fatalf("NewMockIssuer: %v", err) }
+		m.EmailVerified = !test.unverified
+		srv := httptest.NewServer(m)
+		m.Issuer = srv.URL
+
+		a := NewAttempt()
+		code := mockLogin(t, m, a)
+		if test.change != nil { test.change(&a) }
+
+		claims,err := m.Provider().Exchange(http.DefaultClient, kTestRedirect, code, a, time.Now())
+		srv.Close()
+
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: Exchange: %v", test.name, err)
+			} else if claims.Email != "alice@example.com" || !bool(claims.EmailVerified) {
+				t.Errorf("%s: got claims %+v", test.name, claims)
+			}
+		} else if err == nil {
+			t.Errorf("%s: Exchange succeeded, as %s", test.name, claims.Email)
+		} else if !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: got error %q, wanted one mentioning %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestExchangeCodeIsSingleUse(t *testing.T) {
+	m,err := NewMockIssuer("client-1", "", "alice@example.com")
+	if err != nil { t.Fatalf("NewMockIssuer: %v", err) }
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	m.Issuer = srv.URL
+
+	a := NewAttempt()
+	code := mockLogin(t, m, a)
+	if _,err := m.Provider().Exchange(http.DefaultClient, kTestRedirect, code, a, time.Now()); err != nil {
+		t.Fatalf("first Exchange: %v", err)
+	}
+	if _,err := m.Provider().Exchange(http.DefaultClient, kTestRedirect, code, a, time.Now()); err == nil {
+		t.Errorf("second Exchange with the same code succeeded")
+	}
+}
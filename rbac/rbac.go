@@ -0,0 +1,125 @@
+// Package rbac guards handlers by role (see complaintdb.Role*). Wrap a handler when
+// registering it:
+//   http.HandleFunc("/stats-reset", rbac.Require(statsResetHandler, complaintdb.RoleAdmin))
+// Requests made by App Engine itself, from cron or a task queue, are always let through.
+package rbac
+
+import (
+	"net/http"
+
+	"appengine"
+	"appengine/user"
+
+	"github.com/skypies/complaints/complaintdb"
+	"github.com/skypies/complaints/sessions"
+)
+
+// {{{ Identify
+
+// Who is making the request: their Google account if they're signed into one, else whoever
+// the session says. Staff should use Google accounts; an admin impersonating someone (see
+// sessions.Impersonation) is still themselves, as far as roles go. "" if we don't know.
+func Identify(r *http.Request) string {
+	if u := user.Current(appengine.NewContext(r)); u != nil {
+		return u.Email
+	}
+	session := sessions.Get(r)
+	if email,ok := session.Values["email"].(string); ok && sessions.GetImpersonation(session) == nil {
+		return email
+	}
+	return ""
+}
+
+// }}}
+// {{{ Roles
+
+// The roles of whoever made the request; nil if we don't know who they are.
+func Roles(r *http.Request) []string {
+	c := appengine.NewContext(r)
+	email := Identify(r)
+	if email == "" { return nil }
+
+	roles := []string{complaintdb.RoleUser}
+	if u := user.Current(c); u != nil && u.Admin {
+		roles = append(roles, complaintdb.RoleAdmin)
+	}
+
+	cdb := complaintdb.ComplaintDB{C: c}
+	if granted,err := cdb.GetRoles(email); err != nil {
+		c.Errorf("rbac: roles for <%s>: %v", email, err)
+	} else {
+		roles = append(roles, granted...)
+	}
+	return roles
+}
+
+// }}}
+// {{{ HasRole, Has
+
+// Whether the roles include any of the wanted ones. Admins have every role.
+func HasRole(roles []string, wanted ...string) bool {
+	for _,r := range roles {
+		if r == complaintdb.RoleAdmin { return true }
+		for _,w := range wanted {
+			if r == w { return true }
+		}
+	}
+	return false
+}
+
+// Whether whoever made the request has any of the roles.
+func Has(r *http.Request, wanted ...string) bool {
+	return HasRole(Roles(r), wanted...)
+}
+
+// }}}
+// {{{ isAppEngine
+
+// App Engine strips these headers from outside requests, so they can be trusted.
+func isAppEngine(r *http.Request) bool {
+	return r.Header.Get("X-Appengine-Cron") == "true" || r.Header.Get("X-Appengine-Queuename") != ""
+}
+
+// }}}
+// {{{ Require
+
+// Require wraps the handler so that it only runs for someone with one of the roles. People we
+// don't know are sent to sign in with Google; people without the role get a 403.
+func Require(h http.HandlerFunc, wanted ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isAppEngine(r) {
+			h(w, r)
+			return
+		}
+
+		c := appengine.NewContext(r)
+		roles := Roles(r)
+		if roles == nil {
+			if r.Method == "GET" {
+				if url,err := user.LoginURL(c, r.URL.String()); err == nil {
+					http.Redirect(w, r, url, http.StatusFound)
+					return
+				}
+			}
+			http.Error(w, "Please sign in", http.StatusUnauthorized)
+			return
+		}
+
+		if !HasRole(roles, wanted...) {
+			c.Infof("rbac: <%s> %v lacks %v for %s", Identify(r), roles, wanted, r.URL.Path)
+			http.Error(w, "You don't have access to this page", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
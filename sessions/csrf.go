@@ -0,0 +1,119 @@
+package sessions
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+
+	sessions "github.com/gorilla/sessions"
+)
+
+// Anything that changes state on behalf of the session's user needs proof that the request
+// came from one of our own pages, and not from some other site that the user's browser
+// happens to be visiting. Each session gets a random token; pages put it in their forms as
+// a hidden "csrf_token" field (or send it in an X-CSRF-Token header), and we check it. The
+// cookie is also SameSite=Lax (see Init), so most browsers won't even send it cross-site.
+
+const (
+	kCSRFKey      = "csrf"
+	CSRFFormField = "csrf_token"
+	CSRFHeader    = "X-CSRF-Token"
+)
+
+// {{{ CSRFToken
+
+// CSRFToken returns the session's token, creating it if needed. As that may mean saving the
+// session, call it before writing anything to w.
+func CSRFToken(r *http.Request, w http.ResponseWriter) string {
+	session := Get(r)
+	if t,ok := session.Values[kCSRFKey].(string); ok && t != "" {
+		return t
+	}
+	t := newCSRFToken()
+	session.Values[kCSRFKey] = t
+	session.Save(r, w)
+	return t
+}
+
+// ResetCSRF gives the session a new token; do this when someone logs in, so that a token
+// seen before then is no use afterwards.
+func ResetCSRF(s *sessions.Session) {
+	s.Values[kCSRFKey] = newCSRFToken()
+}
+
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	if _,err := rand.Read(b); err != nil { panic(err) }
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// }}}
+// {{{ CheckCSRF
+
+// CheckCSRF says whether the request carries the session's token, and (if the browser says
+// where it came from) came from this site.
+func CheckCSRF(r *http.Request) bool {
+	if !sameOrigin(r) { return false }
+
+	want,_ := Get(r).Values[kCSRFKey].(string)
+	if want == "" { return false }
+
+	got := r.Header.Get(CSRFHeader)
+	if got == "" { got = r.FormValue(CSRFFormField) }
+
+	return hmac.Equal([]byte(got), []byte(want))
+}
+
+// Browsers send Origin with POSTs (and Referer, mostly); if either is there, it must be us.
+func sameOrigin(r *http.Request) bool {
+	for _,h := range []string{"Origin", "Referer"} {
+		v := r.Header.Get(h)
+		if v == "" { continue }
+		if v == "null" { return false } // Sandboxed frames, data: URLs, and the like
+		u,err := url.Parse(v)
+		if err != nil || u.Host != r.Host { return false }
+		return true
+	}
+	return true
+}
+
+// }}}
+// {{{ ProtectCSRF, RequireCSRF
+
+// ProtectCSRF wraps a handler that shows a page on GET, but changes things on POST; anything
+// other than GET or HEAD needs a valid token.
+func ProtectCSRF(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" && !CheckCSRF(r) {
+			http.Error(w, "Forbidden: bad or missing CSRF token; please reload the page and try again",
+				http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// RequireCSRF wraps a handler that only ever changes things; it must be POSTed to, with a
+// valid token.
+func RequireCSRF(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ProtectCSRF(h)(w, r)
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,87 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	sessions "github.com/gorilla/sessions"
+)
+
+// A gorilla sessions.Store that stands in for the datastore-backed one, with a session
+// holding just the CSRF token (if any).
+type testStore struct {
+	token string
+}
+
+func (st testStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(st, name)
+}
+func (st testStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	s := sessions.NewSession(st, name)
+	if st.token != "" { s.Values[kCSRFKey] = st.token }
+	return s, nil
+}
+func (st testStore) Save(r *http.Request, w http.ResponseWriter, s *sessions.Session) error {
+	return nil
+}
+
+func TestCSRF(t *testing.T) {
+	const tok = "the-right-token"
+	const self = "https://stop.jetnoise.net"
+
+	tests := []struct {
+		name    string
+		method  string
+		session string // The session's token
+		form    string // The token POSTed in the form
+		header  string // The token sent in the X-CSRF-Token header
+		origin  string
+		referer string
+		protect int    // Response codes from ProtectCSRF and RequireCSRF
+		require int
+	}{
+		{"valid POST", "POST", tok, tok, "", self, "", 200, 200},
+		{"valid POST, token in header", "POST", tok, "", tok, "", "", 200, 200},
+		{"valid POST, same-site referer", "POST", tok, tok, "", "", self + "/profile", 200, 200},
+		{"GET passthrough", "GET", tok, "", "", "", "", 200, 405},
+		{"GET with a foreign origin", "GET", tok, "", "", "https://evil.example", "", 200, 405},
+		{"missing token", "POST", tok, "", "", self, "", 403, 403},
+		{"wrong token", "POST", tok, "not-" + tok, "", self, "", 403, 403},
+		{"no token in the session", "POST", "", "", "", self, "", 403, 403},
+		{"foreign origin", "POST", tok, tok, "", "https://evil.example", "", 403, 403},
+		{"origin null", "POST", tok, tok, "", "null", "", 403, 403},
+		{"foreign referer", "POST", tok, tok, "", "", "https://evil.example/x", 403, 403},
+	}
+
+	for _,test := range tests {
+		for _,wrap := range []struct {
+			name string
+			f    func(http.HandlerFunc) http.HandlerFunc
+			want int
+		}{{"ProtectCSRF", ProtectCSRF, test.protect}, {"RequireCSRF", RequireCSRF, test.require}} {
+			called := false
+			h := wrap.f(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+			form := url.Values{}
+			if test.form != "" { form.Set(CSRFFormField, test.form) }
+			r,err := http.NewRequest(test.method, self+"/profile-update", strings.NewReader(form.Encode()))
+			if err != nil { t.Fatal(err) }
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if test.header != "" { r.Header.Set(CSRFHeader, test.header) }
+			if test.origin != "" { r.Header.Set("Origin", test.origin) }
+			if test.referer != "" { r.Header.Set("Referer", test.referer) }
+			sessions.GetRegistry(r).Get(testStore{token: test.session}, kCookieName)
+
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != wrap.want {
+				t.Errorf("%s: %s: got %d, wanted %d", test.name, wrap.name, w.Code, wrap.want)
+			} else if called != (wrap.want == 200) {
+				t.Errorf("%s: %s: handler called = %v", test.name, wrap.name, called)
+			}
+		}
+	}
+}
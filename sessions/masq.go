@@ -0,0 +1,102 @@
+package sessions
+
+import (
+	"time"
+
+	sessions "github.com/gorilla/sessions"
+)
+
+// Admins can look at the site as another user. While they do, the session's "email" is the
+// other user's, and the rest of the impersonation lives alongside it; the admin's own email
+// is put back when they stop, or when it expires.
+
+const (
+	kMasqAdmin   = "masq.admin"
+	kMasqPrev    = "masq.prev"    // Whatever "email" was before
+	kMasqExpires = "masq.expires" // Unix seconds
+	kMasqWrite   = "masq.write"
+	kMasqAuditID = "masq.audit"
+)
+
+// {{{ Impersonation
+
+type Impersonation struct {
+	Admin   string // The admin's own (Google) account
+	Email   string // Who they're looking at the site as
+	Expires time.Time
+	Write   bool   // By default, impersonation is read-only
+	AuditID int64  // The complaintdb.Impersonation that logs what they do
+}
+
+// }}}
+
+// {{{ StartImpersonation
+
+func StartImpersonation(s *sessions.Session, imp Impersonation) {
+	if _,already := s.Values[kMasqAdmin]; !already {
+		s.Values[kMasqPrev] = s.Values["email"]
+	}
+	s.Values["email"] = imp.Email
+	s.Values[kMasqAdmin] = imp.Admin
+	s.Values[kMasqExpires] = imp.Expires.Unix()
+	s.Values[kMasqWrite] = imp.Write
+	s.Values[kMasqAuditID] = imp.AuditID
+}
+
+// }}}
+// {{{ StopImpersonation
+
+// Returns what was stopped, or nil if there wasn't an impersonation.
+func StopImpersonation(s *sessions.Session) *Impersonation {
+	imp := GetImpersonation(s)
+	if imp == nil { return nil }
+
+	if prev,ok := s.Values[kMasqPrev].(string); ok {
+		s.Values["email"] = prev
+	} else {
+		delete(s.Values, "email")
+	}
+	for _,k := range []string{kMasqAdmin, kMasqPrev, kMasqExpires, kMasqWrite, kMasqAuditID} {
+		delete(s.Values, k)
+	}
+	return imp
+}
+
+// }}}
+// {{{ GetImpersonation
+
+// Returns nil if the session isn't an impersonation.
+func GetImpersonation(s *sessions.Session) *Impersonation {
+	admin,ok := s.Values[kMasqAdmin].(string)
+	if !ok { return nil }
+
+	imp := Impersonation{Admin: admin}
+	imp.Email,_ = s.Values["email"].(string)
+	imp.Write,_ = s.Values[kMasqWrite].(bool)
+	imp.AuditID,_ = s.Values[kMasqAuditID].(int64)
+	if secs,ok := s.Values[kMasqExpires].(int64); ok {
+		imp.Expires = time.Unix(secs, 0)
+	}
+	return &imp
+}
+
+// }}}
+// {{{ expireImpersonation
+
+// Drops an impersonation that has run out of time. The stored session isn't updated until
+// something saves it, but every Get will keep dropping it until then.
+func expireImpersonation(s *sessions.Session) {
+	if imp := GetImpersonation(s); imp != nil && !time.Now().Before(imp.Expires) {
+		StopImpersonation(s)
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -2,21 +2,38 @@ package sessions
 
 import (
 	"net/http"
+
+	"github.com/gorilla/securecookie"
 	sessions "github.com/gorilla/sessions"
 )
 
-var sessionStore *sessions.CookieStore
+var sessionStore *store
 
 func Init(key, prevkey string) {
-	sessionStore = sessions.NewCookieStore(
-		[]byte(key), nil,
-		[]byte(prevkey), nil)
-
+	sessionStore = &store{
+		codecs: securecookie.CodecsFromPairs(
+			[]byte(key), nil,
+			[]byte(prevkey), nil),
+		options: sessions.Options{
+			Path: "/",
+			MaxAge: kMaxAge,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode, // Not sent along with POSTs from other sites; see csrf.go
+		},
+	}
 }
 
 func Get(r *http.Request) *sessions.Session {
-	session, _ := sessionStore.Get(r, "serfr0")
+	session, _ := sessionStore.Get(r, kCookieName)
+	expireImpersonation(session)
 	return session
 }
 
 // Need to call `session.Save(r,w)` to update it
+
+// End logs the request's session out, and forgets it.
+func End(r *http.Request, w http.ResponseWriter) error {
+	session := Get(r)
+	session.Options.MaxAge = -1
+	return session.Save(r, w)
+}
@@ -0,0 +1,181 @@
+package sessions
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"appengine"
+
+	"github.com/gorilla/securecookie"
+	sessions "github.com/gorilla/sessions"
+
+	"github.com/skypies/complaints/complaintdb"
+)
+
+// Sessions are kept server-side, in the datastore (see complaintdb/sessions.go); the cookie
+// just holds a random session ID, signed. So we know which sessions someone has (and from
+// where), and ending one - logging out, or revoking it from another device - really ends it.
+
+const (
+	kCookieName = "serfr0"
+	kMaxAge = 86400 * 30
+	kLastSeenEvery = 10 * time.Minute // Don't write to the datastore on every request
+)
+
+// {{{ store
+
+// A gorilla sessions.Store.
+type store struct {
+	codecs  []securecookie.Codec
+	options sessions.Options
+}
+
+// Key is the datastore key of the session, which is safe to show to people.
+func Key(s *sessions.Session) string {
+	if s.ID == "" { return "" }
+	sum := sha256.Sum256([]byte(s.ID))
+	return hex.EncodeToString(sum[:])
+}
+
+func newSessionID() string {
+	b := make([]byte, 32)
+	if _,err := rand.Read(b); err != nil { panic(err) }
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// The session is counted as belonging to whoever really logged in to it.
+func owner(s *sessions.Session) string {
+	v := s.Values["email"]
+	if _,masq := s.Values[kMasqAdmin]; masq {
+		v = s.Values[kMasqPrev]
+	}
+	email,_ := v.(string)
+	return email
+}
+
+// }}}
+// {{{ s.Get, s.New
+
+func (st *store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(st, name) // Only load it once per request
+}
+
+// New loads the session named in the cookie; if there isn't one (or it has ended), it
+// returns a new, empty session.
+func (st *store) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(st, name)
+	opts := st.options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie,err := r.Cookie(name)
+	if err != nil { return session, nil }
+
+	c := appengine.NewContext(r)
+	id := ""
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, st.codecs...); err != nil {
+		return session, nil // Including cookies from before sessions were kept server-side
+	}
+
+	cdb := complaintdb.ComplaintDB{C: c}
+	session.ID = id
+	rec,err := cdb.GetSession(Key(session))
+	if err != nil {
+		c.Errorf("sessions: load: %v", err)
+		session.ID = ""
+		return session, err
+	} else if rec == nil || time.Now().After(rec.Expires) {
+		session.ID = "" // It was ended, or has expired
+		return session, nil
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(rec.Values)).Decode(&session.Values); err != nil {
+		c.Errorf("sessions: decode %s: %v", rec.Key, err)
+	}
+	session.IsNew = false
+
+	if time.Since(rec.LastSeen) > kLastSeenEvery {
+		rec.LastSeen = time.Now()
+		rec.IP = r.RemoteAddr
+		if err := cdb.PutSession(*rec); err != nil {
+			c.Errorf("sessions: update lastseen: %v", err)
+		}
+	}
+
+	return session, nil
+}
+
+// }}}
+// {{{ s.Save
+
+// Setting session.Options.MaxAge < 0 ends the session. When someone logs in or out, the
+// session gets a new ID.
+func (st *store) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	c := appengine.NewContext(r)
+	cdb := complaintdb.ComplaintDB{C: c}
+
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := cdb.DeleteSessions([]string{Key(session)}); err != nil { return err }
+		}
+		session.ID = ""
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	var rec *complaintdb.Session
+	if session.ID != "" {
+		var err error
+		if rec,err = cdb.GetSession(Key(session)); err != nil {
+			return err
+		} else if rec == nil {
+			return fmt.Errorf("session has been ended") // Since this request began
+		}
+	}
+
+	who := owner(session)
+	if rec != nil && rec.EmailAddress != who {
+		if err := cdb.DeleteSessions([]string{rec.Key}); err != nil { return err }
+		rec = nil
+	}
+
+	if rec == nil {
+		session.ID = newSessionID()
+		rec = &complaintdb.Session{
+			Key: Key(session),
+			UserAgent: r.UserAgent(),
+			Created: time.Now(),
+			Expires: time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second),
+		}
+		encoded,err := securecookie.EncodeMulti(session.Name(), session.ID, st.codecs...)
+		if err != nil { return err }
+		http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil { return err }
+	rec.Values = buf.Bytes()
+	rec.EmailAddress = who
+	rec.LastSeen = time.Now()
+	rec.IP = r.RemoteAddr
+
+	session.IsNew = false
+	return cdb.PutSession(*rec)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,52 @@
+package sms
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// LocalProvider stands in for a real provider, for local development and testing. It trusts
+// whatever it's sent, so it must never be configured in production. To try it:
+//   curl -d from=6505551234 -d body="very loud" http://localhost:8080/sms/inbound
+//   curl -d from=6505551234 -d digits=3 http://localhost:8080/voice/inbound
+type LocalProvider struct{}
+
+func (p LocalProvider)Parse(r *http.Request) (*Inbound, error) {
+	from,err := NormalizePhone(r.FormValue("from"))
+	if err != nil { return nil, err }
+	return &Inbound{
+		From: from,
+		Body: r.FormValue("body"),
+		Digits: r.FormValue("digits"),
+	}, nil
+}
+
+func (p LocalProvider)Reply(w http.ResponseWriter, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "SMS: %s\n", text)
+}
+
+func (p LocalProvider)Say(w http.ResponseWriter, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "SAY: %s\n", text)
+}
+
+func (p LocalProvider)Gather(w http.ResponseWriter, prompt, action string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "SAY: %s\nGATHER 1 digit -> %s\n", prompt, action)
+}
+
+// Send just prints the text, which ends up in the dev server's console.
+func (p LocalProvider)Send(client *http.Client, to, text string) error {
+	fmt.Fprintf(os.Stderr, "SMS to %s: %s\n", to, text)
+	return nil
+}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
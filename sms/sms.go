@@ -0,0 +1,100 @@
+// Package sms takes complaints by text message and phone call, from the webhooks of a
+// provider chosen in config, and sends the odd text (e.g. to verify a number). The providers:
+//   "twilio" - Twilio; requests are checked against their X-Twilio-Signature header
+//   "local"  - no provider at all: plain form POSTs (from=, body=, digits=) with plain text
+//              replies, so the handlers can be tried out with curl; sent texts go to stderr
+package sms
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/skypies/complaints/config"
+)
+
+// {{{ Inbound
+
+// An incoming text, or a step in a phone call.
+type Inbound struct {
+	From   string // Normalized; see NormalizePhone
+	Body   string // The text of the message; "" for a call
+	Digits string // For calls, the keys pressed in response to a Gather
+}
+
+// }}}
+// {{{ Provider
+
+type Provider interface {
+	// Parse checks that the request really came from the provider, and pulls out the message.
+	Parse(r *http.Request) (*Inbound, error)
+
+	// Reply texts back to the sender of a message.
+	Reply(w http.ResponseWriter, text string)
+
+	// For calls: Say speaks the text and hangs up; Gather speaks the prompt, then sends the
+	// key pressed (as Digits) to the action URL path.
+	Say(w http.ResponseWriter, text string)
+	Gather(w http.ResponseWriter, prompt, action string)
+
+	// Send texts someone out of the blue; the client does the fetching (on App Engine, it
+	// should come from urlfetch).
+	Send(client *http.Client, to, text string) error
+}
+
+// }}}
+
+// {{{ New
+
+// New returns the provider configured via "sms.provider"; nil if there isn't one.
+func New() Provider {
+	switch config.Get("sms.provider") {
+	case "twilio":
+		return TwilioProvider{
+			AccountSID: config.Get("sms.twilio.accountsid"),
+			AuthToken:  config.Get("sms.twilio.authtoken"),
+			From:       config.Get("sms.twilio.from"),
+			BaseURL:    config.Get("site.url"),
+		}
+	case "local":
+		return LocalProvider{}
+	default:
+		return nil
+	}
+}
+
+// }}}
+// {{{ NormalizePhone
+
+// NormalizePhone turns a phone number into E.164 (e.g. "+16505551234"). Numbers without a
+// country code are taken to be in the US.
+func NormalizePhone(s string) (string, error) {
+	digits := ""
+	for _,r := range s {
+		if r >= '0' && r <= '9' { digits += string(r) }
+	}
+
+	switch {
+	case strings.HasPrefix(strings.TrimSpace(s), "+"):
+	case len(digits) == 10:
+		digits = "1" + digits
+	case len(digits) == 11 && digits[0] == '1':
+	default:
+		return "", fmt.Errorf("%q doesn't look like a phone number", s)
+	}
+
+	if len(digits) < 8 || len(digits) > 15 {
+		return "", fmt.Errorf("%q doesn't look like a phone number", s)
+	}
+	return "+" + digits, nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,82 @@
+package sms
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // "" if it should be rejected
+	}{
+		{"6505551234", "+16505551234"},
+		{"(650) 555-1234", "+16505551234"},
+		{"650.555.1234", "+16505551234"},
+		{"16505551234", "+16505551234"},
+		{"1-650-555-1234", "+16505551234"},
+		{"+1 650 555 1234", "+16505551234"},
+		{" +44 20 7946 0958 ", "+442079460958"},
+		{"5551234", ""},
+		{"26505551234", ""},
+		{"+1234567", ""},
+		{"+1234567890123456", ""},
+		{"", ""},
+		{"call me", ""},
+	}
+
+	for _,test := range tests {
+		got,err := NormalizePhone(test.in)
+		if test.want == "" && err == nil {
+			t.Errorf("%q: accepted, as %q", test.in, got)
+		} else if test.want != "" && (err != nil || got != test.want) {
+			t.Errorf("%q: got %q, %v; wanted %q", test.in, got, err, test.want)
+		}
+	}
+}
+
+// The example from https://www.twilio.com/docs/usage/security#validating-requests
+func TestTwilioSignature(t *testing.T) {
+	p := TwilioProvider{AuthToken: "12345", BaseURL: "https://mycompany.com"}
+	form := url.Values{
+		"CallSid": {"CA1234567890ABCDE"},
+		"Caller":  {"+12349013030"},
+		"Digits":  {"1234"},
+		"From":    {"+12349013030"},
+		"To":      {"+18005551212"},
+	}
+	const sig = "0/KCTR6DLpKmkAf8muzZqo1nDgQ="
+
+	req := func(sig string, form url.Values) *http.Request {
+		r,err := http.NewRequest("POST", "https://mycompany.com/myapp.php?foo=1&bar=2",
+			strings.NewReader(form.Encode()))
+		if err != nil { t.Fatal(err) }
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if sig != "" { r.Header.Set("X-Twilio-Signature", sig) }
+		return r
+	}
+
+	if in,err := p.Parse(req(sig, form)); err != nil {
+		t.Errorf("good signature: %v", err)
+	} else if in.From != "+12349013030" || in.Digits != "1234" {
+		t.Errorf("good signature: got %+v", in)
+	}
+
+	if _,err := p.Parse(req("", form)); err == nil {
+		t.Errorf("no signature: accepted")
+	}
+	tampered := url.Values{}
+	for k,v := range form { tampered[k] = v }
+	tampered.Set("From", "+16505551234")
+	if _,err := p.Parse(req(sig, tampered)); err == nil {
+		t.Errorf("tampered form: accepted")
+	}
+	if _,err := (TwilioProvider{AuthToken: "54321", BaseURL: p.BaseURL}).Parse(req(sig, form)); err == nil {
+		t.Errorf("wrong auth token: accepted")
+	}
+	if _,err := (TwilioProvider{BaseURL: p.BaseURL}).Parse(req(sig, form)); err == nil {
+		t.Errorf("no auth token: accepted")
+	}
+}
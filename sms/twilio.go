@@ -0,0 +1,140 @@
+package sms
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// TwilioProvider handles Twilio's messaging and voice webhooks, and answers them with TwiML.
+// https://www.twilio.com/docs/usage/security#validating-requests
+type TwilioProvider struct {
+	AccountSID string
+	AuthToken  string
+	From       string // Our number, that texts are sent from
+	BaseURL    string // The scheme & host that Twilio is configured to call, e.g. https://stop.jetnoise.net
+}
+
+const kTwilioAPIURL = "https://api.twilio.com/2010-04-01"
+
+// {{{ p.signature
+
+// Twilio signs the full URL it called, followed by each POST param's name and value, sorted
+// by name.
+func (p TwilioProvider)signature(r *http.Request) string {
+	s := p.BaseURL + r.URL.RequestURI()
+
+	names := []string{}
+	for k,_ := range r.PostForm { names = append(names, k) }
+	sort.Strings(names)
+	for _,k := range names {
+		for _,v := range r.PostForm[k] { s += k + v }
+	}
+
+	mac := hmac.New(sha1.New, []byte(p.AuthToken))
+	mac.Write([]byte(s))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// }}}
+// {{{ p.Parse
+
+func (p TwilioProvider)Parse(r *http.Request) (*Inbound, error) {
+	if err := r.ParseForm(); err != nil { return nil, err }
+	if p.AuthToken == "" {
+		return nil, fmt.Errorf("twilio: no sms.twilio.authtoken configured")
+	}
+	if !hmac.Equal([]byte(r.Header.Get("X-Twilio-Signature")), []byte(p.signature(r))) {
+		return nil, fmt.Errorf("twilio: bad signature")
+	}
+
+	from,err := NormalizePhone(r.PostFormValue("From"))
+	if err != nil { return nil, err }
+	return &Inbound{
+		From: from,
+		Body: r.PostFormValue("Body"),
+		Digits: r.PostFormValue("Digits"),
+	}, nil
+}
+
+// }}}
+// {{{ p.Reply, p.Say, p.Gather
+
+type twiml struct {
+	XMLName xml.Name     `xml:"Response"`
+	Message string       `xml:",omitempty"`
+	Say     string       `xml:",omitempty"`
+	Gather  *twimlGather `xml:",omitempty"`
+}
+type twimlGather struct {
+	NumDigits int    `xml:"numDigits,attr"`
+	Action    string `xml:"action,attr"`
+	Method    string `xml:"method,attr"`
+	Say       string
+}
+
+func writeTwiML(w http.ResponseWriter, t twiml) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(t)
+}
+
+func (p TwilioProvider)Reply(w http.ResponseWriter, text string) {
+	writeTwiML(w, twiml{Message: text})
+}
+
+func (p TwilioProvider)Say(w http.ResponseWriter, text string) {
+	writeTwiML(w, twiml{Say: text})
+}
+
+// If no key is pressed, Twilio carries on to the next verb; there isn't one, so it hangs up.
+func (p TwilioProvider)Gather(w http.ResponseWriter, prompt, action string) {
+	writeTwiML(w, twiml{Gather: &twimlGather{NumDigits: 1, Action: action, Method: "POST", Say: prompt}})
+}
+
+// }}}
+// {{{ p.Send
+
+// https://www.twilio.com/docs/messaging/api/message-resource#create-a-message-resource
+func (p TwilioProvider)Send(client *http.Client, to, text string) error {
+	if p.AccountSID == "" || p.AuthToken == "" || p.From == "" {
+		return fmt.Errorf("twilio: sms.twilio.{accountsid,authtoken,from} not all configured")
+	}
+
+	form := url.Values{}
+	form.Set("To", to)
+	form.Set("From", p.From)
+	form.Set("Body", text)
+	u := kTwilioAPIURL + "/Accounts/" + p.AccountSID + "/Messages.json"
+	req,err := http.NewRequest("POST", u, strings.NewReader(form.Encode()))
+	if err != nil { return err }
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(p.AccountSID, p.AuthToken)
+
+	resp,err := client.Do(req)
+	if err != nil { return fmt.Errorf("twilio: send: %v", err) }
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body,_ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("twilio: send: %s: %s", resp.Status, body)
+	}
+	return nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,79 @@
+// Package webhook is the format of the events we POST to user-registered URLs, and the
+// signature on them. It has no App Engine dependencies, so receivers can use Verify.
+//
+// Each delivery is a JSON Payload, with these headers:
+//   X-Complaints-Event:     the event name, e.g. "complaint.created"
+//   X-Complaints-Delivery:  an ID, the same across retries of the same delivery
+//   X-Complaints-Signature: "sha256=" + hex HMAC-SHA256 of the body, keyed by the hook's secret
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+const (
+	EventCreated   = "complaint.created"
+	EventCoalesced = "complaint.coalesced" // A new complaint was merged into an existing one
+	EventUpdated   = "complaint.updated"
+	EventDeleted   = "complaint.deleted"
+	EventSubmitted = "complaint.submitted" // An airport accepted the complaint
+
+	HeaderEvent     = "X-Complaints-Event"
+	HeaderDelivery  = "X-Complaints-Delivery"
+	HeaderSignature = "X-Complaints-Signature"
+)
+
+var AllEvents = []string{EventCreated, EventCoalesced, EventUpdated, EventDeleted, EventSubmitted}
+
+// {{{ Payload
+
+type Complaint struct {
+	Key          string    `json:"key"`
+	Timestamp    time.Time `json:"timestamp,omitempty"`
+	Loudness     int       `json:"loudness,omitempty"`
+	Speedbrakes  bool      `json:"speedbrakes,omitempty"`
+	Activity     string    `json:"activity,omitempty"`
+	Description  string    `json:"description,omitempty"`
+	FlightNumber string    `json:"flight_number,omitempty"`
+	Airport      string    `json:"airport,omitempty"` // Only for EventSubmitted
+}
+
+type Payload struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	Complaint Complaint `json:"complaint"` // Only the key, for EventDeleted
+}
+
+// }}}
+
+// {{{ Sign
+
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// }}}
+// {{{ Verify
+
+// Verify checks the X-Complaints-Signature header value against the body.
+func Verify(secret string, body []byte, sig string) bool {
+	if secret == "" || !strings.HasPrefix(sig, "sha256=") { return false }
+	return hmac.Equal([]byte(sig), []byte(Sign(secret, body)))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}